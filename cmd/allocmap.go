@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// An Extent is a range of bytes relative to the start of a partition.
+type Extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// AllocatedExtents returns the ranges of the partition that hold data according to its filesystem, so copies can
+// skip free space. A nil result with no error means the filesystem has no allocation map we can read, and the
+// whole partition must be treated as allocated.
+func (part *Partition) AllocatedExtents() ([]Extent, error) {
+	sb, err := part.Probe()
+	if err != nil {
+		return nil, nil
+	}
+
+	var extents []Extent
+	switch sb.Type {
+	case "ext2", "ext3", "ext4":
+		extents, err = extAllocated(part, sb)
+	case "f2fs":
+		extents, err = f2fsAllocated(part, sb)
+	default:
+		return nil, nil
+	}
+	if err != nil || extents == nil {
+		return nil, err
+	}
+
+	//Anything past the end of the filesystem, such as an AVB footer, isn't in its allocation map
+	if end := sb.Size(); end < part.GetSize() {
+		extents = append(extents, Extent{Offset: end, Length: part.GetSize() - end})
+	}
+	return mergeExtents(extents), nil
+}
+
+// Sort extents and join any that touch or overlap.
+func mergeExtents(extents []Extent) []Extent {
+	sort.Slice(extents, func(i, j int) bool { return extents[i].Offset < extents[j].Offset })
+	merged := make([]Extent, 0, len(extents))
+	for i := 0; i < len(extents); i++ {
+		if extents[i].Length <= 0 {
+			continue
+		}
+		last := len(merged) - 1
+		if last >= 0 && extents[i].Offset <= merged[last].Offset+merged[last].Length {
+			if end := extents[i].Offset + extents[i].Length; end > merged[last].Offset+merged[last].Length {
+				merged[last].Length = end - merged[last].Offset
+			}
+			continue
+		}
+		merged = append(merged, extents[i])
+	}
+	return merged
+}
+
+// Add a run of blocks to extents, extending the last extent when the run follows straight on from it.
+func addBlocks(extents []Extent, block, count, blockSize int64) []Extent {
+	offset := block * blockSize
+	length := count * blockSize
+	if last := len(extents) - 1; last >= 0 && extents[last].Offset+extents[last].Length == offset {
+		extents[last].Length += length
+		return extents
+	}
+	return append(extents, Extent{Offset: offset, Length: length})
+}
+
+// Returns true if group holds a backup superblock and group descriptors with sparse_super: groups 0, 1 and the
+// powers of 3, 5 and 7.
+func extGroupHasSuper(group int64) bool {
+	if group <= 1 {
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		for n := base; n <= group; n *= base {
+			if n == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read the block bitmap of every ext2/3/4 block group. Groups whose bitmap was never initialised only hold
+// their superblock backup, group descriptors and the metadata the descriptors point at.
+func extAllocated(part *Partition, sb *Superblock) ([]Extent, error) {
+	le := binary.LittleEndian
+	super, err := readExact(part, 1024, 1024)
+	if super == nil || err != nil {
+		return nil, err
+	}
+	firstDataBlock := int64(le.Uint32(super[0x14:]))
+	blocksPerGroup := int64(le.Uint32(super[0x20:]))
+	inodesPerGroup := int64(le.Uint32(super[0x28:]))
+	inodeSize := int64(le.Uint16(super[0x58:]))
+	compat := le.Uint32(super[0x5C:])
+	incompat := le.Uint32(super[0x60:])
+	roCompat := le.Uint32(super[0x64:])
+	reservedGDT := int64(le.Uint16(super[0xCE:]))
+	descSize := int64(32)
+	if incompat&0x80 != 0 { //64bit
+		descSize = int64(le.Uint16(super[0xFE:]))
+	}
+	if blocksPerGroup == 0 || descSize < 32 || inodeSize == 0 {
+		return nil, fmt.Errorf("allocmap: Invalid ext superblock on %s", part.GetName())
+	}
+	if compat&0x200 != 0 || incompat&0x10 != 0 { //sparse_super2 and meta_bg put metadata where we can't find it from here
+		debug("allocmap: %s uses sparse_super2 or meta_bg, copying it whole", part.GetName())
+		return nil, nil
+	}
+
+	groups := (sb.BlockCount - firstDataBlock + blocksPerGroup - 1) / blocksPerGroup
+	gdtBlocks := (groups*descSize + sb.BlockSize - 1) / sb.BlockSize
+	gdt, err := readExact(part, (firstDataBlock+1)*sb.BlockSize, gdtBlocks*sb.BlockSize)
+	if gdt == nil || err != nil {
+		return nil, fmt.Errorf("allocmap: Failed to read group descriptors of %s: %v", part.GetName(), err)
+	}
+	inodeTableBlocks := (inodesPerGroup*inodeSize + sb.BlockSize - 1) / sb.BlockSize
+
+	extents := make([]Extent, 0)
+	extents = addBlocks(extents, 0, firstDataBlock+1+gdtBlocks+reservedGDT, sb.BlockSize)
+	for group := int64(0); group < groups; group++ {
+		desc := gdt[group*descSize : (group+1)*descSize]
+		blockBitmap := int64(le.Uint32(desc[0x0:]))
+		inodeBitmap := int64(le.Uint32(desc[0x4:]))
+		inodeTable := int64(le.Uint32(desc[0x8:]))
+		if descSize >= 64 {
+			blockBitmap |= int64(le.Uint32(desc[0x20:])) << 32
+			inodeBitmap |= int64(le.Uint32(desc[0x24:])) << 32
+			inodeTable |= int64(le.Uint32(desc[0x28:])) << 32
+		}
+		flags := le.Uint16(desc[0x12:])
+
+		//Group metadata, which may live in another group with flex_bg
+		extents = append(extents, Extent{Offset: blockBitmap * sb.BlockSize, Length: sb.BlockSize})
+		extents = append(extents, Extent{Offset: inodeBitmap * sb.BlockSize, Length: sb.BlockSize})
+		extents = append(extents, Extent{Offset: inodeTable * sb.BlockSize, Length: inodeTableBlocks * sb.BlockSize})
+
+		groupStart := firstDataBlock + group*blocksPerGroup
+		groupBlocks := blocksPerGroup
+		if groupStart+groupBlocks > sb.BlockCount {
+			groupBlocks = sb.BlockCount - groupStart
+		}
+		if flags&0x2 != 0 { //BLOCK_UNINIT
+			if roCompat&0x1 == 0 || extGroupHasSuper(group) {
+				extents = append(extents, Extent{Offset: groupStart * sb.BlockSize, Length: (1 + gdtBlocks + reservedGDT) * sb.BlockSize})
+			}
+			continue
+		}
+
+		bitmap, err := readExact(part, blockBitmap*sb.BlockSize, sb.BlockSize)
+		if bitmap == nil || err != nil {
+			return nil, fmt.Errorf("allocmap: Failed to read block bitmap of group %d on %s: %v", group, part.GetName(), err)
+		}
+		extents = addBitmap(extents, bitmap, groupStart, groupBlocks, sb.BlockSize, false)
+	}
+
+	return extents, nil
+}
+
+// Add the set bits of an allocation bitmap as extents. ext bitmaps number bits from the least significant bit of
+// each byte, f2fs bitmaps from the most significant.
+func addBitmap(extents []Extent, bitmap []byte, firstBlock, blocks, blockSize int64, msbFirst bool) []Extent {
+	run := int64(-1)
+	for i := int64(0); i <= blocks; i++ {
+		set := false
+		if i < blocks && i/8 < int64(len(bitmap)) {
+			bit := uint(i % 8)
+			if msbFirst {
+				bit = 7 - bit
+			}
+			set = bitmap[i/8]&(1<<bit) != 0
+		}
+		if set && run < 0 {
+			run = i
+		} else if !set && run >= 0 {
+			extents = addBlocks(extents, firstBlock+run, i-run, blockSize)
+			run = -1
+		}
+	}
+	return extents
+}
+
+// The f2fs on-disk layout constants this reader depends on.
+const (
+	f2fsSITEntrySize      = 74
+	f2fsSITJournalEntries = 6
+	f2fsSummaryJournal    = 3584 //Offset of the journal in a normal summary block, after 512 7-byte entries
+	f2fsCPCompactSumFlag  = 0x4
+	f2fsCPLargeNATFlag    = 0x400
+	f2fsCursegs           = 3 //Hot, warm and cold logs of each of node and data
+)
+
+// Read the segment information table of an f2fs filesystem. Everything before the main area is metadata and is
+// always copied, and the segments the checkpoint has open are copied whole. SIT entries still in the checkpoint's
+// journal override the ones in the SIT area.
+func f2fsAllocated(part *Partition, sb *Superblock) ([]Extent, error) {
+	le := binary.LittleEndian
+	super, err := readExact(part, 1024, 2048)
+	if super == nil || err != nil {
+		return nil, err
+	}
+	blocksPerSeg := int64(1) << le.Uint32(super[20:])
+	segmentCountSIT := int64(le.Uint32(super[56:]))
+	segmentCountMain := int64(le.Uint32(super[68:]))
+	cpAddr := int64(le.Uint32(super[76:]))
+	sitAddr := int64(le.Uint32(super[80:]))
+	mainAddr := int64(le.Uint32(super[92:]))
+	cpPayload := le.Uint32(super[1664:])
+	if blocksPerSeg != 512 {
+		return nil, fmt.Errorf("allocmap: Unsupported f2fs segment size of %d blocks on %s", blocksPerSeg, part.GetName())
+	}
+
+	//Find the current checkpoint pack, the same way Probe does
+	var cp []byte
+	cpBlock := int64(0)
+	for pack := int64(0); pack < 2; pack++ {
+		block := cpAddr + pack*blocksPerSeg
+		packData, err := readExact(part, block*sb.BlockSize, sb.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+		if packData != nil && (cp == nil || le.Uint64(packData[0:]) > le.Uint64(cp[0:])) {
+			cp = packData
+			cpBlock = block
+		}
+	}
+	if cp == nil {
+		return nil, fmt.Errorf("allocmap: Failed to read f2fs checkpoint on %s", part.GetName())
+	}
+	cpFlags := le.Uint32(cp[132:])
+	if cpPayload > 0 || cpFlags&f2fsCPLargeNATFlag != 0 {
+		debug("allocmap: %s keeps its SIT bitmap outside the checkpoint block, copying it whole", part.GetName())
+		return nil, nil
+	}
+	sitPerBlock := sb.BlockSize / f2fsSITEntrySize
+	sitBlocks := (segmentCountMain + sitPerBlock - 1) / sitPerBlock
+	sitBitmapSize := int64(le.Uint32(cp[156:]))
+	if 192+sitBitmapSize > int64(len(cp)) || sitBitmapSize*8 < sitBlocks {
+		return nil, fmt.Errorf("allocmap: Invalid SIT bitmap size %d in the f2fs checkpoint of %s", sitBitmapSize, part.GetName())
+	}
+	sitBitmap := cp[192 : 192+sitBitmapSize]
+
+	//SIT entries, from the SIT area and then from the journal
+	entries := make([][]byte, segmentCountMain)
+	for i := int64(0); i < sitBlocks; i++ {
+		block := sitAddr + i
+		if sitBitmap[i/8]&(1<<uint(7-i%8)) != 0 {
+			block += segmentCountSIT / 2 * blocksPerSeg //The second copy is the current one
+		}
+		data, err := readExact(part, block*sb.BlockSize, sb.BlockSize)
+		if data == nil || err != nil {
+			return nil, fmt.Errorf("allocmap: Failed to read SIT block %d of %s: %v", i, part.GetName(), err)
+		}
+		for j := int64(0); j < sitPerBlock && i*sitPerBlock+j < segmentCountMain; j++ {
+			entries[i*sitPerBlock+j] = data[j*f2fsSITEntrySize : (j+1)*f2fsSITEntrySize]
+		}
+	}
+
+	sumStart := int64(le.Uint32(cp[140:]))
+	journalBlock := cpBlock + sumStart + 2 //The cold data summary holds the SIT journal
+	journalOffset := int64(f2fsSummaryJournal)
+	if cpFlags&f2fsCPCompactSumFlag != 0 {
+		journalBlock = cpBlock + sumStart
+		journalOffset = 507 //Compact summaries start with the NAT journal, then the SIT journal
+	}
+	journal, err := readExact(part, journalBlock*sb.BlockSize, sb.BlockSize)
+	if journal == nil || err != nil {
+		return nil, fmt.Errorf("allocmap: Failed to read SIT journal of %s: %v", part.GetName(), err)
+	}
+	journal = journal[journalOffset:]
+	sits := int64(le.Uint16(journal[0:]))
+	if sits > f2fsSITJournalEntries {
+		return nil, fmt.Errorf("allocmap: Invalid SIT journal of %d entries on %s", sits, part.GetName())
+	}
+	for i := int64(0); i < sits; i++ {
+		entry := journal[2+i*(4+f2fsSITEntrySize):]
+		segno := int64(le.Uint32(entry[0:]))
+		if segno < segmentCountMain {
+			entries[segno] = entry[4 : 4+f2fsSITEntrySize]
+		}
+	}
+
+	open := make(map[int64]bool)
+	for i := int64(0); i < f2fsCursegs; i++ {
+		open[int64(le.Uint32(cp[36+i*4:]))] = true //Node logs
+		open[int64(le.Uint32(cp[84+i*4:]))] = true //Data logs
+	}
+
+	extents := make([]Extent, 0)
+	extents = addBlocks(extents, 0, mainAddr, sb.BlockSize)
+	for segno := int64(0); segno < segmentCountMain; segno++ {
+		first := mainAddr + segno*blocksPerSeg
+		if open[segno] {
+			extents = addBlocks(extents, first, blocksPerSeg, sb.BlockSize)
+			continue
+		}
+		entry := entries[segno]
+		if le.Uint16(entry[0:])&0x3FF == 0 {
+			continue
+		}
+		extents = addBitmap(extents, entry[2:2+blocksPerSeg/8], first, blocksPerSeg, sb.BlockSize, true)
+	}
+
+	return extents, nil
+}
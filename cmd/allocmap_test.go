@@ -0,0 +1,333 @@
+package main
+
+import (
+	stdbytes "bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// A partition read from memory.
+func testAllocPartition(image []byte) *Partition {
+	name := "test"
+	return &Partition{Name: &name, reader: stdbytes.NewReader(image)}
+}
+
+// Compare extents in bytes against the block ranges they should cover.
+func checkExtents(t *testing.T, got []Extent, blockSize int64, want [][2]int64) {
+	t.Helper()
+	got = mergeExtents(got)
+	if len(got) != len(want) {
+		t.Fatalf("got extents %v, want blocks %v", got, want)
+	}
+	for i := 0; i < len(want); i++ {
+		if got[i].Offset != want[i][0]*blockSize || got[i].Length != (want[i][1]-want[i][0])*blockSize {
+			t.Fatalf("got extents %v, want blocks %v", got, want)
+		}
+	}
+}
+
+func TestExtGroupHasSuper(t *testing.T) {
+	tests := []struct {
+		group int64
+		want  bool
+	}{
+		{0, true}, {1, true}, {2, false}, {3, true}, {5, true}, {7, true}, {9, true},
+		{15, false}, {25, true}, {27, true}, {49, true}, {81, true}, {100, false}, {125, true},
+	}
+	for _, tt := range tests {
+		if got := extGroupHasSuper(tt.group); got != tt.want {
+			t.Errorf("extGroupHasSuper(%d) = %v, want %v", tt.group, got, tt.want)
+		}
+	}
+}
+
+// An ext block group in a test image, with the blocks its bitmap marks used counted from the start of the group.
+type testExtGroup struct {
+	blockBitmap, inodeBitmap, inodeTable int64
+	uninit                               bool
+	used                                 []int64
+}
+
+// Build an ext image with 16 inodes of 128 bytes per group and 2 reserved GDT blocks.
+func buildExtImage(blockSize, blocksPerGroup, blockCount, descSize int64, compat, incompat, roCompat uint32, groups []testExtGroup) ([]byte, *Superblock) {
+	le := binary.LittleEndian
+	image := make([]byte, blockCount*blockSize)
+	firstDataBlock := int64(0)
+	if blockSize == 1024 {
+		firstDataBlock = 1
+	}
+	super := image[1024:2048]
+	le.PutUint32(super[0x4:], uint32(blockCount))
+	le.PutUint32(super[0x14:], uint32(firstDataBlock))
+	le.PutUint32(super[0x20:], uint32(blocksPerGroup))
+	le.PutUint32(super[0x28:], 16)
+	le.PutUint16(super[0x38:], 0xEF53)
+	le.PutUint16(super[0x58:], 128)
+	le.PutUint32(super[0x5C:], compat)
+	le.PutUint32(super[0x60:], incompat)
+	le.PutUint32(super[0x64:], roCompat)
+	le.PutUint16(super[0xCE:], 2)
+	le.PutUint16(super[0xFE:], uint16(descSize))
+
+	gdt := image[(firstDataBlock+1)*blockSize:]
+	for i := int64(0); i < int64(len(groups)); i++ {
+		g := groups[i]
+		desc := gdt[i*descSize:]
+		le.PutUint32(desc[0x0:], uint32(g.blockBitmap))
+		le.PutUint32(desc[0x4:], uint32(g.inodeBitmap))
+		le.PutUint32(desc[0x8:], uint32(g.inodeTable))
+		if g.uninit {
+			le.PutUint16(desc[0x12:], 0x2)
+			continue
+		}
+		bitmap := image[g.blockBitmap*blockSize:]
+		for _, block := range g.used {
+			bitmap[block/8] |= 1 << uint(block%8)
+		}
+	}
+	return image, &Superblock{Type: "ext4", BlockSize: blockSize, BlockCount: blockCount}
+}
+
+func TestExtAllocated(t *testing.T) {
+	tests := []struct {
+		name                      string
+		blockSize, blocksPerGroup int64
+		blockCount, descSize      int64
+		compat, incompat          uint32
+		roCompat                  uint32
+		groups                    []testExtGroup
+		want                      [][2]int64 //Block ranges, nil when the filesystem can't be mapped
+		err                       string
+	}{
+		{
+			//Blocks 0-4 are the boot block, superblock, GDT and reserved GDT. Group 1 has a backup superblock
+			//with sparse_super, group 2 doesn't, and only the first 7 blocks of group 3 exist.
+			name: "1k blocks", blockSize: 1024, blocksPerGroup: 64, blockCount: 200, descSize: 32, roCompat: 0x1,
+			groups: []testExtGroup{
+				{blockBitmap: 5, inodeBitmap: 6, inodeTable: 7, used: []int64{0, 1, 2, 3, 4, 5, 6, 7, 19, 20, 21}},
+				{blockBitmap: 9, inodeBitmap: 10, inodeTable: 11, uninit: true},
+				{blockBitmap: 13, inodeBitmap: 14, inodeTable: 15, uninit: true},
+				{blockBitmap: 17, inodeBitmap: 18, inodeTable: 30, used: []int64{2, 3, 10}},
+			},
+			want: [][2]int64{{0, 19}, {20, 23}, {30, 32}, {65, 69}, {195, 197}},
+		},
+		{
+			//Without sparse_super every group keeps a backup superblock
+			name: "no sparse_super", blockSize: 1024, blocksPerGroup: 64, blockCount: 193, descSize: 32,
+			groups: []testExtGroup{
+				{blockBitmap: 5, inodeBitmap: 6, inodeTable: 7, used: []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+				{blockBitmap: 9, inodeBitmap: 10, inodeTable: 11, uninit: true},
+				{blockBitmap: 13, inodeBitmap: 14, inodeTable: 15, uninit: true},
+			},
+			want: [][2]int64{{0, 17}, {65, 69}, {129, 133}},
+		},
+		{
+			name: "64bit descriptors", blockSize: 4096, blocksPerGroup: 32, blockCount: 64, descSize: 64, incompat: 0x80,
+			groups: []testExtGroup{
+				{blockBitmap: 4, inodeBitmap: 5, inodeTable: 6, used: []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 31}},
+				{blockBitmap: 7, inodeBitmap: 8, inodeTable: 9, used: []int64{0, 1, 31}},
+			},
+			want: [][2]int64{{0, 10}, {31, 34}, {63, 64}},
+		},
+		{name: "sparse_super2", blockSize: 1024, blocksPerGroup: 64, blockCount: 64, descSize: 32, compat: 0x200},
+		{name: "meta_bg", blockSize: 1024, blocksPerGroup: 64, blockCount: 64, descSize: 32, incompat: 0x10},
+		{name: "no blocks per group", blockSize: 1024, blockCount: 64, descSize: 32, err: "Invalid ext superblock"},
+		{name: "short descriptors", blockSize: 4096, blocksPerGroup: 32, blockCount: 64, descSize: 16, incompat: 0x80, err: "Invalid ext superblock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, sb := buildExtImage(tt.blockSize, tt.blocksPerGroup, tt.blockCount, tt.descSize, tt.compat, tt.incompat, tt.roCompat, tt.groups)
+			got, err := extAllocated(testAllocPartition(image), sb)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extAllocated: %v", err)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("got extents %v, want none for a filesystem that can't be mapped", got)
+				}
+				return
+			}
+			checkExtents(t, got, tt.blockSize, tt.want)
+		})
+	}
+}
+
+// Where things are in the f2fs test images, in 4096 byte blocks. The SIT area is two segments, one per copy.
+const (
+	testF2fsCP       = 512
+	testF2fsSIT      = 1536
+	testF2fsMain     = 2560
+	testF2fsSegments = 16
+	testF2fsSumStart = 1
+)
+
+// An f2fs test image. Segments are given as the blocks their SIT entry marks valid, counted from the start of the
+// segment. The open logs are segments 10 to 15 unless the newer checkpoint pack says otherwise.
+type testF2fs struct {
+	logBlocksPerSeg uint32 //9 if not set, for 512 block segments
+	flags           uint32
+	bitmapSize      uint32 //64 if not set
+	payload         uint32
+	secondPack      bool //The second checkpoint pack is the newer one, with segment 9 as an open log
+	secondSIT       bool //The SIT block is current in its second copy, with garbage in the first
+	sit             map[int64][]int64
+	journal         map[int64][]int64
+}
+
+// Encode a SIT entry with the given valid blocks.
+func f2fsSITEntry(blocks []int64) []byte {
+	entry := make([]byte, f2fsSITEntrySize)
+	binary.LittleEndian.PutUint16(entry[0:], uint16(len(blocks)))
+	for _, block := range blocks {
+		entry[2+block/8] |= 1 << uint(7-block%8)
+	}
+	return entry
+}
+
+func buildF2fsImage(tt testF2fs) ([]byte, *Superblock) {
+	le := binary.LittleEndian
+	const blockSize = 4096
+	if tt.logBlocksPerSeg == 0 {
+		tt.logBlocksPerSeg = 9
+	}
+	if tt.bitmapSize == 0 {
+		tt.bitmapSize = 64
+	}
+	image := make([]byte, (testF2fsSIT+1024)*blockSize)
+	super := image[1024:]
+	le.PutUint32(super[20:], tt.logBlocksPerSeg)
+	le.PutUint32(super[56:], 2)
+	le.PutUint32(super[68:], testF2fsSegments)
+	le.PutUint32(super[76:], testF2fsCP)
+	le.PutUint32(super[80:], testF2fsSIT)
+	le.PutUint32(super[92:], testF2fsMain)
+	le.PutUint32(super[1664:], tt.payload)
+
+	cpBlock := int64(testF2fsCP)
+	packs := []int64{testF2fsCP, testF2fsCP + 512}
+	for pack := 0; pack < len(packs); pack++ {
+		cp := image[packs[pack]*blockSize:]
+		version := uint64(10 + pack)
+		if tt.secondPack == (pack == 0) {
+			version = uint64(9 - pack)
+		} else {
+			cpBlock = packs[pack]
+		}
+		le.PutUint64(cp[0:], version)
+		for i := 0; i < f2fsCursegs; i++ {
+			le.PutUint32(cp[36+i*4:], uint32(10+i))
+			le.PutUint32(cp[84+i*4:], uint32(13+i))
+		}
+		if pack == 1 {
+			le.PutUint32(cp[36:], 9)
+		}
+		le.PutUint32(cp[132:], tt.flags)
+		le.PutUint32(cp[140:], testF2fsSumStart)
+		le.PutUint32(cp[156:], tt.bitmapSize)
+		if tt.secondSIT {
+			cp[192] = 0x80
+		}
+	}
+
+	sit := image[testF2fsSIT*blockSize:]
+	if tt.secondSIT {
+		for segno := int64(0); segno < testF2fsSegments; segno++ {
+			copy(sit[segno*f2fsSITEntrySize:], f2fsSITEntry([]int64{0, 1, 2, 3, 4, 5, 6, 7}))
+		}
+		sit = image[(testF2fsSIT+512)*blockSize:]
+	}
+	for segno, blocks := range tt.sit {
+		copy(sit[segno*f2fsSITEntrySize:], f2fsSITEntry(blocks))
+	}
+
+	journalBlock := cpBlock + testF2fsSumStart + 2
+	journalOffset := int64(f2fsSummaryJournal)
+	if tt.flags&f2fsCPCompactSumFlag != 0 {
+		journalBlock = cpBlock + testF2fsSumStart
+		journalOffset = 507
+	}
+	journal := image[journalBlock*blockSize+journalOffset:]
+	le.PutUint16(journal[0:], uint16(len(tt.journal)))
+	i := int64(0)
+	for segno, blocks := range tt.journal {
+		entry := journal[2+i*(4+f2fsSITEntrySize):]
+		le.PutUint32(entry[0:], uint32(segno))
+		copy(entry[4:], f2fsSITEntry(blocks))
+		i++
+	}
+	return image, &Superblock{Type: "f2fs", BlockSize: blockSize, BlockCount: testF2fsMain + testF2fsSegments*512}
+}
+
+func TestF2fsAllocated(t *testing.T) {
+	//Everything before the main area, and the open logs
+	const main = testF2fsMain
+	metadata := [2]int64{0, main}
+	logs := [2]int64{main + 10*512, main + 16*512}
+
+	tests := []struct {
+		name  string
+		image testF2fs
+		want  [][2]int64 //Block ranges, nil when the filesystem can't be mapped
+		err   string
+	}{
+		{
+			name:  "sit area",
+			image: testF2fs{sit: map[int64][]int64{0: {0, 1, 2, 3}, 2: {100, 101}, 10: {0}}},
+			want:  [][2]int64{{0, main + 4}, {main + 2*512 + 100, main + 2*512 + 102}, logs},
+		},
+		{
+			name:  "second sit copy",
+			image: testF2fs{secondSIT: true, sit: map[int64][]int64{1: {511}}},
+			want:  [][2]int64{metadata, {main + 512 + 511, main + 2*512}, logs},
+		},
+		{
+			name:  "journal",
+			image: testF2fs{sit: map[int64][]int64{0: {0, 1}, 4: {8}}, journal: map[int64][]int64{0: {5}, 3: {6, 7}, 99: {0}}},
+			want:  [][2]int64{metadata, {main + 5, main + 6}, {main + 3*512 + 6, main + 3*512 + 8}, {main + 4*512 + 8, main + 4*512 + 9}, logs},
+		},
+		{
+			name:  "compact summaries",
+			image: testF2fs{flags: f2fsCPCompactSumFlag, journal: map[int64][]int64{3: {6, 7}}},
+			want:  [][2]int64{metadata, {main + 3*512 + 6, main + 3*512 + 8}, logs},
+		},
+		{
+			name:  "newer second pack",
+			image: testF2fs{secondPack: true, journal: map[int64][]int64{3: {6}}},
+			want:  [][2]int64{metadata, {main + 3*512 + 6, main + 3*512 + 7}, {main + 9*512, main + 10*512}, {main + 11*512, main + 16*512}},
+		},
+		{name: "large nat bitmap", image: testF2fs{flags: f2fsCPLargeNATFlag}},
+		{name: "checkpoint payload", image: testF2fs{payload: 1}},
+		{name: "small segments", image: testF2fs{logBlocksPerSeg: 8}, err: "Unsupported f2fs segment size"},
+		{name: "huge sit bitmap", image: testF2fs{bitmapSize: 4000}, err: "Invalid SIT bitmap size"},
+		{name: "journal overflow", image: testF2fs{journal: map[int64][]int64{0: {}, 1: {}, 2: {}, 3: {}, 4: {}, 5: {}, 6: {}}}, err: "Invalid SIT journal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, sb := buildF2fsImage(tt.image)
+			got, err := f2fsAllocated(testAllocPartition(image), sb)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("f2fsAllocated: %v", err)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("got extents %v, want none for a filesystem that can't be mapped", got)
+				}
+				return
+			}
+			checkExtents(t, got, sb.BlockSize, tt.want)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A TableBackup holds the raw bytes of everything on a disk that describes its partitions: the MBR and EBRs,
+// both copies of the GPT, and the dynamic partition metadata of super when it's being changed.
+type TableBackup struct {
+	Parted   *Parted
+	Ranges   []*savedRange
+	Outdated []string //Partitions that have moved or grown since, which the saved tables no longer describe
+}
+
+// A savedRange is a run of bytes read from the disk at an offset.
+type savedRange struct {
+	Offset int64
+	Data   []byte
+}
+
+// The partition tables saved before anything was modified, restored by fatal until the changes are committed.
+var backups []*TableBackup
+
+// Save a byte range of the disk into the backup.
+func (b *TableBackup) save(offset, length int64) error {
+	data, err := b.Parted.ReadDisk(offset, length)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < length {
+		return fmt.Errorf("backup: Only read %d of %d bytes at offset %d", len(data), length, offset)
+	}
+	b.Ranges = append(b.Ranges, &savedRange{Offset: offset, Data: data})
+	return nil
+}
+
+// BackupTables saves the partition tables of the disk, so they can be restored if applying the plan fails.
+func (p *Parted) BackupTables() (*TableBackup, error) {
+	b := &TableBackup{Parted: p, Ranges: make([]*savedRange, 0)}
+	sector := p.SectorSizeLogical
+
+	switch p.PartitionTable {
+	case "GPT":
+		primary, err := p.ReadGPT(1)
+		if err != nil {
+			return nil, err
+		}
+		backup, err := p.ReadGPT(primary.AlternateLBA)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.save(0, sector); err != nil { //The protective MBR
+			return nil, err
+		}
+		for _, gpt := range []*GPT{primary, backup} {
+			if err := b.save(gpt.HeaderLBA*sector, sector); err != nil {
+				return nil, err
+			}
+			if err := b.save(gpt.EntriesLBA*sector, gpt.EntryCount*gpt.EntrySize); err != nil {
+				return nil, err
+			}
+		}
+	case "MSDOS":
+		entries, err := p.ReadMBR()
+		if err != nil {
+			return nil, err
+		}
+		if err := b.save(0, sector); err != nil {
+			return nil, err
+		}
+		for num, e := range entries {
+			if num >= mbrFirstLogical {
+				if err := b.save(e.Sector*sector, sector); err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("backup: Can't back up %s partition tables", p.PartitionTable)
+	}
+
+	if p.Super != nil {
+		metadataSize := int64(p.Super.Metadata.BlockDevices[0].FirstLogicalSector) * lpSectorSize
+		if err := b.save(*p.Super.Part.Start, metadataSize); err != nil {
+			return nil, err
+		}
+	}
+
+	size := int64(0)
+	for i := 0; i < len(b.Ranges); i++ {
+		size += int64(len(b.Ranges[i].Data))
+	}
+	debug("backup: Saved %s of partition tables from %s in %d ranges", bytes(size), p.Config.Disk, len(b.Ranges))
+	return b, nil
+}
+
+// Outdate records that the partition is about to move or grow. From then on its data may be somewhere the saved
+// tables don't point, or its filesystem larger than the saved tables say, so they can't be put back.
+func (b *TableBackup) Outdate(name string) {
+	b.Outdated = append(b.Outdated, name)
+}
+
+// Restore writes the saved partition tables back and asks the kernel to read them again.
+func (b *TableBackup) Restore() error {
+	p := b.Parted
+	for i := 0; i < len(b.Ranges); i++ {
+		if err := p.WriteDisk(b.Ranges[i].Offset, b.Ranges[i].Data); err != nil {
+			return fmt.Errorf("backup: %v", err)
+		}
+	}
+	if err := p.WriteFile.Sync(); err != nil {
+		return fmt.Errorf("backup: Failed to sync %s: %v", p.Config.Disk, err)
+	}
+	if err := p.RereadPartitions(); err != nil {
+		warn("backup: Kernel didn't reread partition table of %s, reboot before using it: %v", p.Config.Disk, err)
+	}
+	return nil
+}
+
+// rollback restores the partition tables of every disk saved in backups, newest first. Data that was wiped or
+// filesystems that were shrunk stay that way, inside partitions that are back where they were with their old
+// sizes. A disk where a partition has started to move or grow is left as it is, as its old table would point at
+// data that's been overwritten or cut a grown filesystem short; the table on it matches the data up to the step
+// that failed, and the partitions involved are reported.
+func rollback() {
+	for i := len(backups) - 1; i >= 0; i-- {
+		disk := backups[i].Parted.Config.Disk
+		step := stepBegin("rollback", disk)
+		if len(backups[i].Outdated) > 0 {
+			err := fmt.Errorf("%s already started moving or growing", strings.Join(backups[i].Outdated, ", "))
+			step.Done(err)
+			logAt(LevelError, "Not restoring partition table of %s, %v and the old table doesn't match their data", disk, err)
+			continue
+		}
+		err := backups[i].Restore()
+		step.Done(err)
+		if err != nil {
+			logAt(LevelError, "Failed to restore partition table of %s: %v", disk, err)
+			continue
+		}
+		log("Restored partition table of %s", disk)
+	}
+	backups = nil
+}
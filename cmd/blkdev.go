@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Block device ioctls from linux/fs.h.
+const (
+	ioctlBLKDISCARD    = 0x1277
+	ioctlBLKSECDISCARD = 0x127d
+	ioctlBLKZEROOUT    = 0x127f
+	ioctlBLKRRPART     = 0x125f
+)
+
+// The size of the buffer used to write zeroes when the disk can't zero a range itself.
+const zeroChunk = 1024 * 1024
+
+// Run a block device ioctl that takes a byte range, such as BLKDISCARD.
+func blkRangeIoctl(fd uintptr, req uintptr, offset, length int64) error {
+	rng := [2]uint64{uint64(offset), uint64(length)}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&rng))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// DiscardDisk tells the disk a byte range no longer holds data with BLKDISCARD, or BLKSECDISCARD if secure.
+func (p *Parted) DiscardDisk(offset, length int64, secure bool) error {
+	if err := p.CheckWrite(offset, length); err != nil {
+		return fmt.Errorf("DiscardDisk: %v", err)
+	}
+	if err := p.OpenWrite(); err != nil {
+		return fmt.Errorf("DiscardDisk: %v", err)
+	}
+	req := uintptr(ioctlBLKDISCARD)
+	if secure {
+		req = ioctlBLKSECDISCARD
+	}
+	if err := blkRangeIoctl(p.WriteFile.Fd(), req, offset, length); err != nil {
+		return fmt.Errorf("DiscardDisk: Failed to discard %d bytes at offset %d: %v", length, offset, err)
+	}
+	return nil
+}
+
+// ZeroDisk fills a byte range with zeroes, using BLKZEROOUT when the disk supports it and writing zeroes otherwise.
+func (p *Parted) ZeroDisk(offset, length int64) error {
+	if err := p.CheckWrite(offset, length); err != nil {
+		return fmt.Errorf("ZeroDisk: %v", err)
+	}
+	if err := p.OpenWrite(); err != nil {
+		return fmt.Errorf("ZeroDisk: %v", err)
+	}
+	if err := blkRangeIoctl(p.WriteFile.Fd(), ioctlBLKZEROOUT, offset, length); err == nil {
+		return nil
+	}
+
+	zeroes := make([]byte, zeroChunk)
+	for done := int64(0); done < length; done += zeroChunk {
+		count := length - done
+		if count > zeroChunk {
+			count = zeroChunk
+		}
+		if err := p.WriteDisk(offset+done, zeroes[:count]); err != nil {
+			return fmt.Errorf("ZeroDisk: %v", err)
+		}
+	}
+	return nil
+}
+
+// RereadPartitions asks the kernel to read the partition table of the disk again with BLKRRPART, which fails
+// while any of its partitions are in use.
+func (p *Parted) RereadPartitions() error {
+	if err := p.OpenWrite(); err != nil {
+		return fmt.Errorf("RereadPartitions: %v", err)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, p.WriteFile.Fd(), ioctlBLKRRPART, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
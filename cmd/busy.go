@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// What to do with busy partitions, set with "busy" in the config.
+const (
+	busyRefuse  = "refuse"  //Stop before changing anything, the default
+	busyUnmount = "unmount" //Unmount them and turn off swap on them, forcing it if needed
+)
+
+// BusyConfig says what to do when a partition reparted will change is in use.
+type BusyConfig struct {
+	Action string   `json:"action"` //refuse or unmount
+	Order  []string `json:"order"`  //Mount points to unmount first, in this order; the rest go deepest first
+}
+
+// A Use is something holding a partition: a mount, swap, or a device-mapper device built on top of it.
+type Use struct {
+	Partition string
+	Kind      string //mount, swap or holder
+	What      string //The mount point, swap device or file, or holder device
+	ReadOnly  bool   //A mount that can't be written through
+}
+
+// The open handles holding the lock of every disk, kept until reparted exits.
+var diskLocks = make(map[string]*os.File)
+
+// lockDisk takes an exclusive flock on the disk, the convention udev and disk tools use to keep off a device
+// while it's being partitioned. O_EXCL isn't used, as it would stop fsck and resize tools from opening the
+// partitions themselves. The lock is only taken once per disk and is kept across reloads.
+func lockDisk(disk string) error {
+	if diskLocks[disk] != nil {
+		return nil
+	}
+	f, err := os.Open(disk)
+	if err != nil {
+		return fmt.Errorf("Failed to open disk %s for locking: %v", disk, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("Disk %s is locked by another process, is another reparted running?", disk)
+		}
+		return fmt.Errorf("Failed to lock disk %s: %v", disk, err)
+	}
+	diskLocks[disk] = f
+	debug("Locked disk %s", disk)
+	return nil
+}
+
+// Split a device number into its major and minor numbers, the way the kernel encodes them.
+func devMajorMinor(dev uint64) (uint64, uint64) {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return major, minor
+}
+
+// Undo the octal escapes mountinfo uses for spaces and other special characters in paths.
+func unescapeMountPath(path string) string {
+	out := ""
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			c := 0
+			if _, err := fmt.Sscanf(path[i+1:i+4], "%o", &c); err == nil {
+				out += string(rune(c))
+				i += 3
+				continue
+			}
+		}
+		out += string(path[i])
+	}
+	return out
+}
+
+// Uses returns everything holding the partition: its mounts from /proc/self/mountinfo, swap on it or on a file
+// it holds from /proc/swaps, and device-mapper devices on top of it from /sys/block/*/holders.
+func (part *Partition) Uses() ([]*Use, error) {
+	uses := make([]*Use, 0)
+	path := part.GetPath()
+	st := &syscall.Stat_t{}
+	if err := syscall.Stat(path, st); err != nil {
+		if err == syscall.ENOENT {
+			//A partition that was only just created may not have a device node yet, so nothing can be holding it
+			debug("%s has no device node yet, so it isn't in use", path)
+			return uses, nil
+		}
+		return nil, fmt.Errorf("Failed to stat %s: %v", path, err)
+	}
+	dev := uint64(st.Rdev)
+	major, minor := devMajorMinor(dev)
+
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read mounts: %v", err)
+	}
+	defer mountinfo.Close()
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[2] != fmt.Sprintf("%d:%d", major, minor) {
+			continue
+		}
+		//Either the mount or the superblock being read-only keeps the filesystem from changing
+		readOnly := len(fields) > 5 && strings.HasPrefix(fields[5]+",", "ro,")
+		for i := 6; i+3 < len(fields); i++ {
+			if fields[i] == "-" {
+				readOnly = readOnly || strings.HasPrefix(fields[i+3]+",", "ro,")
+				break
+			}
+		}
+		uses = append(uses, &Use{Partition: part.GetName(), Kind: "mount", What: unescapeMountPath(fields[4]), ReadOnly: readOnly})
+	}
+
+	if swaps, err := os.ReadFile("/proc/swaps"); err == nil {
+		lines := strings.Split(string(swaps), "\n")
+		for i := 1; i < len(lines); i++ {
+			fields := strings.Fields(lines[i])
+			if len(fields) == 0 {
+				continue
+			}
+			swap := unescapeMountPath(fields[0])
+			swapSt := &syscall.Stat_t{}
+			if err := syscall.Stat(swap, swapSt); err != nil {
+				continue
+			}
+			//A swap partition is the device itself, a swap file lives on a filesystem on it
+			if uint64(swapSt.Rdev) == dev || uint64(swapSt.Dev) == dev {
+				uses = append(uses, &Use{Partition: part.GetName(), Kind: "swap", What: swap})
+			}
+		}
+	}
+
+	disk := part.Parted.Config.Disk
+	if resolved, err := filepath.EvalSymlinks(disk); err == nil {
+		disk = resolved
+	}
+	partDev := path
+	if resolved, err := filepath.EvalSymlinks(partDev); err == nil {
+		partDev = resolved
+	}
+	holders, _ := os.ReadDir(filepath.Join("/sys/block", filepath.Base(disk), filepath.Base(partDev), "holders"))
+	for i := 0; i < len(holders); i++ {
+		holder := holders[i].Name()
+		if name, err := os.ReadFile(filepath.Join("/sys/class/block", holder, "dm", "name")); err == nil {
+			holder += " (" + strings.TrimSpace(string(name)) + ")"
+		}
+		uses = append(uses, &Use{Partition: part.GetName(), Kind: "holder", What: holder})
+	}
+
+	return uses, nil
+}
+
+// CheckSettled returns an error if the partition may be written to while it's read, because it's mounted
+// read-write or swap is on it. Device-mapper devices on top of it are only warned about, as most are read-only.
+func (part *Partition) CheckSettled() error {
+	uses, err := part.Uses()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(uses); i++ {
+		switch {
+		case uses[i].Kind == "swap":
+			return fmt.Errorf("Partition %s holds swap %s, turn it off first", part.GetName(), uses[i].What)
+		case uses[i].Kind == "mount" && !uses[i].ReadOnly:
+			return fmt.Errorf("Partition %s is mounted read-write at %s, unmount it or remount it read-only first", part.GetName(), uses[i].What)
+		case uses[i].Kind == "holder":
+			warn("Partition %s is held by %s, which may be writing to it", part.GetName(), uses[i].What)
+		}
+	}
+	return nil
+}
+
+// Holds reports whether path is on a filesystem mounted from the partition. A path that doesn't exist yet would be
+// created on whatever its nearest existing parent is on.
+func (part *Partition) Holds(path string) (bool, error) {
+	partSt := &syscall.Stat_t{}
+	if err := syscall.Stat(part.GetPath(), partSt); err != nil {
+		return false, fmt.Errorf("Failed to stat %s: %v", part.GetPath(), err)
+	}
+	st := &syscall.Stat_t{}
+	for {
+		err := syscall.Stat(path, st)
+		if err == nil {
+			break
+		}
+		if err != syscall.ENOENT || filepath.Dir(path) == path {
+			return false, fmt.Errorf("Failed to stat %s: %v", path, err)
+		}
+		path = filepath.Dir(path)
+	}
+	return uint64(st.Dev) == uint64(partSt.Rdev), nil
+}
+
+// The busy action from the config.
+func (p *Parted) busyAction() string {
+	if p.Config.Busy != nil && p.Config.Busy.Action == busyUnmount {
+		return busyUnmount
+	}
+	return busyRefuse
+}
+
+// Release makes sure none of the partitions are in use. Partitions held by a device-mapper device are always
+// refused, as tearing one down from under Android isn't safe. Mounts and swap are refused too unless the config
+// says to unmount them, which happens in the configured order, then deepest mount point first.
+func (p *Parted) Release(parts []*Partition) error {
+	uses := make([]*Use, 0)
+	for i := 0; i < len(parts); i++ {
+		partUses, err := parts[i].Uses()
+		if err != nil {
+			return err
+		}
+		uses = append(uses, partUses...)
+	}
+	if len(uses) == 0 {
+		return nil
+	}
+
+	refused := 0
+	for i := 0; i < len(uses); i++ {
+		if uses[i].Kind == "holder" || p.busyAction() == busyRefuse {
+			logAt(LevelError, "Partition %s is busy: %s %s", uses[i].Partition, uses[i].Kind, uses[i].What)
+			refused++
+		}
+	}
+	if refused > 0 {
+		return fmt.Errorf("%d use(s) of partitions that will change, unmount them first or set \"busy\" to unmount", refused)
+	}
+
+	order := make(map[string]int)
+	if p.Config.Busy != nil {
+		for i := 0; i < len(p.Config.Busy.Order); i++ {
+			order[p.Config.Busy.Order[i]] = i + 1
+		}
+	}
+	sort.SliceStable(uses, func(i, j int) bool {
+		oi, oj := order[uses[i].What], order[uses[j].What]
+		if oi != oj {
+			return oi != 0 && (oj == 0 || oi < oj)
+		}
+		return strings.Count(uses[i].What, "/") > strings.Count(uses[j].What, "/")
+	})
+	for i := 0; i < len(uses); i++ {
+		if err := uses[i].release(); err != nil {
+			return err
+		}
+	}
+
+	//Anything still there was mounted again behind our back, or couldn't be let go of
+	for i := 0; i < len(parts); i++ {
+		partUses, err := parts[i].Uses()
+		if err != nil {
+			return err
+		}
+		if len(partUses) > 0 {
+			return fmt.Errorf("Partition %s is still busy: %s %s", partUses[0].Partition, partUses[0].Kind, partUses[0].What)
+		}
+	}
+	return nil
+}
+
+// Find the processes with a file open, a working directory, a root or a mapping under the mount point, as
+// "pid (name)". Nothing is ever lazily detached, so these are what keep a forced unmount from going through.
+func mountHolders(mountPoint string) []string {
+	under := func(path string) bool {
+		path = strings.TrimSuffix(path, " (deleted)")
+		return path == mountPoint || strings.HasPrefix(path, strings.TrimSuffix(mountPoint, "/")+"/")
+	}
+	holders := make([]string, 0)
+	pids, err := os.ReadDir("/proc")
+	if err != nil {
+		return holders
+	}
+	for i := 0; i < len(pids); i++ {
+		pid := pids[i].Name()
+		if strings.Trim(pid, "0123456789") != "" || pid == fmt.Sprint(os.Getpid()) {
+			continue
+		}
+		dir := filepath.Join("/proc", pid)
+		links := []string{filepath.Join(dir, "cwd"), filepath.Join(dir, "root"), filepath.Join(dir, "exe")}
+		if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+			for j := 0; j < len(fds); j++ {
+				links = append(links, filepath.Join(dir, "fd", fds[j].Name()))
+			}
+		}
+		held := false
+		for j := 0; j < len(links) && !held; j++ {
+			target, err := os.Readlink(links[j])
+			held = err == nil && under(target)
+		}
+		if !held {
+			if maps, err := os.ReadFile(filepath.Join(dir, "maps")); err == nil {
+				lines := strings.Split(string(maps), "\n")
+				for j := 0; j < len(lines) && !held; j++ {
+					fields := strings.Fields(lines[j])
+					held = len(fields) >= 6 && under(strings.Join(fields[5:], " "))
+				}
+			}
+		}
+		if held {
+			comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+			holders = append(holders, fmt.Sprintf("%s (%s)", pid, strings.TrimSpace(string(comm))))
+		}
+	}
+	return holders
+}
+
+// Let go of a mount or swap, forcing the unmount if it's busy. A mount that's still busy after that is refused
+// rather than detached, as a detached filesystem stays live on the partition until whatever holds it lets go.
+func (use *Use) release() error {
+	if use.Kind == "swap" {
+		//There's no swapoff in the syscall package, but its number is
+		path, err := syscall.BytePtrFromString(use.What)
+		if err != nil {
+			return err
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_SWAPOFF, uintptr(unsafe.Pointer(path)), 0, 0); errno != 0 {
+			return fmt.Errorf("Failed to turn off swap %s on %s: %v", use.What, use.Partition, errno)
+		}
+		log("Turned off swap %s on %s", use.What, use.Partition)
+		return nil
+	}
+
+	err := syscall.Unmount(use.What, 0)
+	if err == syscall.EBUSY {
+		warn("%s is busy, forcing unmount", use.What)
+		err = syscall.Unmount(use.What, syscall.MNT_FORCE)
+		if err == syscall.EBUSY {
+			holders := mountHolders(use.What)
+			if len(holders) == 0 {
+				return fmt.Errorf("Failed to unmount %s from %s, it's still busy", use.What, use.Partition)
+			}
+			return fmt.Errorf("Failed to unmount %s from %s, it's still in use by %s", use.What, use.Partition, strings.Join(holders, ", "))
+		}
+	}
+	if err != nil && err != syscall.EINVAL { //EINVAL means it's already gone
+		return fmt.Errorf("Failed to unmount %s from %s: %v", use.What, use.Partition, err)
+	}
+	log("Unmounted %s from %s", use.What, use.Partition)
+	return nil
+}
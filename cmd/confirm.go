@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The answer that must be typed to go ahead.
+const confirmAnswer = "yes"
+
+// Whether to go ahead without asking, set by the --yes flag.
+var assumeYes = false
+
+// isTerminal reports whether the file is a terminal, by asking for its terminal attributes.
+func isTerminal(f *os.File) bool {
+	termios := &syscall.Termios{}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(termios)))
+	return errno == 0
+}
+
+// DescribePlan returns the disk as it is and what the plan will do to it, one line per change, with the data
+// that will be lost called out.
+func (dp *DiskPlan) DescribePlan() string {
+	p := dp.Parted
+	lines := make([]string, 0)
+	lines = append(lines, fmt.Sprintf("Disk %s: %s, %s, %s partition table", p.Config.Disk, p.DiskModel, bytes(p.DiskSize), p.PartitionTable))
+
+	changed := make(map[string]string)
+	for i := 0; i < len(dp.Plan.Shrink); i++ {
+		changed[dp.Plan.Shrink[i].Name] = fmt.Sprintf("shrink %s -> %s", bytes(dp.Plan.Shrink[i].From), bytes(dp.Plan.Shrink[i].To))
+	}
+	for i := 0; i < len(dp.Plan.Grow); i++ {
+		changed[dp.Plan.Grow[i].Name] = fmt.Sprintf("grow %s -> %s", bytes(dp.Plan.Grow[i].From), bytes(dp.Plan.Grow[i].To))
+	}
+
+	warnings := make([]string, 0)
+	for i := 0; i < len(dp.Placements); i++ {
+		pl := dp.Placements[i]
+		if pl.UserData {
+			continue
+		}
+		partReserved := pl.Config
+		name := pl.Name()
+		partActual := pl.Actual
+		change := changed[name]
+		switch {
+		case partActual == nil:
+			change = "create " + bytes(pl.Size)
+		case pl.Moves():
+			if change != "" {
+				change += ", "
+			}
+			change += "move"
+		}
+		if partReserved.Image != "" {
+			if change != "" {
+				change += ", "
+			}
+			change += "flash " + partReserved.Image
+		}
+		mark := "~"
+		if partReserved.Wipe {
+			mark = "!"
+			if change != "" {
+				change += ", "
+			}
+			change += "WIPE"
+			if partActual != nil {
+				lost := "all of " + bytes(partActual.GetSize())
+				if sb, err := partActual.Probe(); err == nil {
+					lost = fmt.Sprintf("%s of %s", bytes(sb.UsedSize()), sb.Type)
+				}
+				warnings = append(warnings, fmt.Sprintf("  All data on %s will be lost (%s)", name, lost))
+			}
+		} else if change == "" {
+			mark = "="
+			change = "unchanged"
+		}
+		if partReserved.slotKept {
+			change += " (not wiped or flashed, it's in the active slot)"
+		}
+		lines = append(lines, fmt.Sprintf("  %s %-16s %s", mark, name, change))
+	}
+
+	for i := 0; i < len(dp.Placements); i++ {
+		pl := dp.Placements[i]
+		if !pl.UserData {
+			continue
+		}
+		change := ""
+		if pl.Size != pl.Old.Length {
+			change = fmt.Sprintf("resize %s -> %s", bytes(pl.Old.Length), bytes(pl.Size))
+		}
+		if pl.Moves() {
+			if change != "" {
+				change += ", "
+			}
+			change += "move"
+		}
+		if change == "" {
+			change = "unchanged"
+		}
+		lines = append(lines, fmt.Sprintf("  ~ %-16s %s (userdata)", pl.Name(), change))
+	}
+	for i := 0; i < len(dp.Plan.Logical); i++ {
+		lines = append(lines, fmt.Sprintf("  ~ %-16s resize %s -> %s (inside super)", dp.Plan.Logical[i].Name, bytes(dp.Plan.Logical[i].From), bytes(dp.Plan.Logical[i].To)))
+	}
+	if dp.Plan.ActiveSlot != "" {
+		lines = append(lines, fmt.Sprintf("  Slot %s is kept, only the other slot is wiped or flashed", dp.Plan.ActiveSlot))
+	}
+
+	if p.Super != nil {
+		for i := 0; i < len(p.Super.Replaced); i++ {
+			warnings = append(warnings, fmt.Sprintf("  Metadata slot %d of %s differs and will be replaced by slot %d, losing any update in progress", p.Super.Replaced[i], p.Super.Part.GetName(), p.Super.Slot))
+		}
+	}
+
+	if len(warnings) > 0 {
+		lines = append(lines, "WARNING:")
+		lines = append(lines, warnings...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Confirm shows the summary and asks for confirmation on the terminal before anything is changed. Runs that
+// aren't on a terminal can't be asked, so they must pass --yes.
+func Confirm(summary string) error {
+	logToFile(LevelInfo, "Confirming:\n"+summary)
+	if assumeYes {
+		logToFile(LevelInfo, "Confirmed by --yes")
+		return nil
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stderr) {
+		return fmt.Errorf("Not running on a terminal, pass --yes to make changes without confirmation")
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%s\n\nType %q to make these changes, anything else cancels: ", summary, confirmAnswer)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Failed to read confirmation: %v", err)
+	}
+	answer = strings.TrimSpace(answer)
+	logToFile(LevelInfo, "Answered "+answer)
+	if answer != confirmAnswer {
+		return fmt.Errorf("Cancelled, nothing was changed")
+	}
+	return nil
+}
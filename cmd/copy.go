@@ -0,0 +1,432 @@
+package main
+
+import (
+	"github.com/JoshuaDoes/json"
+	"github.com/dustin/go-humanize"
+
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Block device ioctl from linux/fs.h to drop the buffer cache of a disk, so a verify pass reads the disk itself.
+const ioctlBLKFLSBUF = 0x1261
+
+// The alignment of copy buffers, enough for O_DIRECT on any disk reparted will see.
+const copyAlign = 4096
+
+// CopyConfig holds the options of the copy engine, set with "copy" in the config.
+type CopyConfig struct {
+	BufferSize string `json:"bufferSize"` //Size of each of the two copy buffers, such as "8MiB"
+	Direct     bool   `json:"direct"`     //Bypass the page cache with O_DIRECT where the disk allows it
+	Hash       bool   `json:"hash"`       //Hash every chunk as it's read
+	Verify     bool   `json:"verify"`     //Read the destination back after copying and compare it to the hashes
+	Journal    string `json:"journal"`    //Path to record how far a copy got, on a partition the plan doesn't change
+}
+
+// The copy options used when the config has none.
+var defaultCopyConfig = &CopyConfig{BufferSize: "8MiB", Direct: true, Hash: true, Verify: true}
+
+// A copyChunk is one buffer of data on its way from the reader to the writer.
+type copyChunk struct {
+	buf    []byte
+	index  int
+	offset int64 //Relative to the start of the range being copied
+	err    error
+}
+
+// A CopyJournal records how far a copy has got. Once a copy that overlaps itself has started, the source is no longer
+// whole, so a copy cut short by a crash or power loss has to carry on from the first chunk it hadn't finished, with
+// the extents it was reading, instead of starting over.
+type CopyJournal struct {
+	Disk      string   `json:"disk"`
+	Src       int64    `json:"src"`
+	Dst       int64    `json:"dst"`
+	Length    int64    `json:"length"`
+	ChunkSize int64    `json:"chunkSize"`
+	Extents   []Extent `json:"extents"`
+	Done      int      `json:"done"` //Chunks written to the destination and synced
+}
+
+// Save the journal, replacing the last one only once the new one is on disk.
+func (j *CopyJournal) write(path string) error {
+	data, err := json.Marshal(j, false)
+	if err != nil {
+		return fmt.Errorf("copy: Failed to encode journal: %v", err)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("copy: Failed to write journal %s: %v", tmp, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return fmt.Errorf("copy: Failed to write journal %s: %v", path, err)
+	}
+	return nil
+}
+
+// PendingCopy returns the copy an earlier run left unfinished on the disk, or nil if there isn't one.
+func (p *Parted) PendingCopy() (*CopyJournal, error) {
+	if p.Config.Copy == nil || p.Config.Copy.Journal == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(p.Config.Copy.Journal)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("copy: Failed to read journal %s: %v", p.Config.Copy.Journal, err)
+	}
+	j := &CopyJournal{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("copy: Failed to parse journal %s: %v", p.Config.Copy.Journal, err)
+	}
+	if j.Disk != p.Config.Disk {
+		return nil, nil
+	}
+	return j, nil
+}
+
+// FinishCopy forgets the disk's pending copy, once the partition it moved has been recreated at its destination.
+func (p *Parted) FinishCopy() error {
+	j, err := p.PendingCopy()
+	if j == nil || err != nil {
+		return err
+	}
+	if err := os.Remove(p.Config.Copy.Journal); err != nil {
+		return fmt.Errorf("copy: Failed to remove journal %s: %v", p.Config.Copy.Journal, err)
+	}
+	return nil
+}
+
+// Resuming reports whether the partition is the source of a copy an earlier run left unfinished, so it may already
+// be partly overwritten and can only be read again at its destination.
+func (part *Partition) Resuming() bool {
+	partActual := part.Parted.GetPartition(false, part)
+	if partActual == nil {
+		return false
+	}
+	j, err := part.Parted.PendingCopy()
+	return err == nil && j != nil && j.Src == *partActual.Start
+}
+
+// CheckJournal makes sure a copy an earlier run left unfinished is one the plan carries on with. If the partition
+// was already recreated at the destination, the copy is done and the journal is removed.
+func (dp *DiskPlan) CheckJournal() error {
+	j, err := dp.Parted.PendingCopy()
+	if j == nil || err != nil {
+		return err
+	}
+	for i := 0; i < len(dp.Placements); i++ {
+		pl := dp.Placements[i]
+		if pl.Actual != nil && pl.Old.Offset == j.Dst {
+			log("The copy of %s to %d finished before the last run stopped", pl.Name(), j.Dst)
+			return dp.Parted.FinishCopy()
+		}
+	}
+	for i := 0; i < len(dp.Move); i++ {
+		pl := dp.Move[i]
+		if pl.Moves() && !pl.Config.Wipe && pl.Old.Offset == j.Src && pl.Start == j.Dst && pl.Old.Length == j.Length {
+			log("Resuming the copy of %s to %d at chunk %d", pl.Name(), j.Dst, j.Done)
+			return nil
+		}
+	}
+	return fmt.Errorf("An unfinished copy of %s from %d to %d is in %s, but the plan doesn't carry it on", bytes(j.Length), j.Src, j.Dst, dp.Parted.Config.Copy.Journal)
+}
+
+// alignedBuffer returns a buffer of size bytes whose start is aligned to copyAlign.
+func alignedBuffer(size int64) []byte {
+	buf := make([]byte, size+copyAlign)
+	shift := int(copyAlign-uintptr(unsafe.Pointer(&buf[0]))%copyAlign) % copyAlign
+	return buf[shift : int64(shift)+size]
+}
+
+// Open the disk for copying, with O_DIRECT if asked for and supported, falling back to the page cache otherwise.
+func (p *Parted) openCopy(flag int, direct bool) (*os.File, bool, error) {
+	if direct {
+		f, err := os.OpenFile(p.Config.Disk, flag|syscall.O_DIRECT, 0)
+		if err == nil {
+			return f, true, nil
+		}
+		debug("copy: O_DIRECT not available on %s, using the page cache: %v", p.Config.Disk, err)
+	}
+	f, err := os.OpenFile(p.Config.Disk, flag, 0)
+	return f, false, err
+}
+
+// CopyDisk copies length bytes on the disk from src to dst. Ranges that overlap are handled by copying from the
+// end backwards when the destination is after the source, so nothing is overwritten before it has been read, and
+// with chunks no larger than the distance between them, so no chunk overwrites its own source.
+// The reader fills one buffer while the writer empties the other. If extents isn't nil, only those ranges
+// (relative to src) are copied and the rest of the destination is discarded, in the same order, so a copy
+// interrupted at any point has still never overwritten data it hasn't read. With a journal, how far the copy got is
+// recorded as it goes, and a copy of the same range that was cut short carries on from there. Progress is reported
+// to pr if it isn't nil.
+func (p *Parted) CopyDisk(src, dst, length int64, extents []Extent, pr *Progress) error {
+	cfg := p.Config.Copy
+	if cfg == nil {
+		cfg = defaultCopyConfig
+	}
+	chunkSize := int64(8 * 1024 * 1024)
+	if cfg.BufferSize != "" {
+		size, err := humanize.ParseBytes(cfg.BufferSize)
+		if err != nil {
+			return fmt.Errorf("copy: Invalid buffer size %s: %v", cfg.BufferSize, err)
+		}
+		chunkSize = int64(size) / copyAlign * copyAlign
+	}
+	if chunkSize < copyAlign {
+		chunkSize = copyAlign
+	}
+	//A chunk mustn't overwrite its own source, or a crash while it's written leaves a copy that can't be redone
+	distance := dst - src
+	if distance < 0 {
+		distance = -distance
+	}
+	if distance < length && distance < chunkSize {
+		chunkSize = distance / copyAlign * copyAlign
+		if chunkSize == 0 {
+			chunkSize = distance
+		}
+	}
+	if extents == nil {
+		extents = []Extent{{Offset: 0, Length: length}}
+	}
+	journal := &CopyJournal{Disk: p.Config.Disk, Src: src, Dst: dst, Length: length, ChunkSize: chunkSize, Extents: extents}
+	if cfg.Journal != "" {
+		pending, err := p.PendingCopy()
+		if err != nil {
+			return err
+		}
+		if pending != nil {
+			if pending.Src != src || pending.Dst != dst || pending.Length != length {
+				return fmt.Errorf("copy: An unfinished copy from %d to %d is in %s", pending.Src, pending.Dst, cfg.Journal)
+			}
+			journal = pending
+			chunkSize = pending.ChunkSize
+			extents = pending.Extents
+		}
+	}
+	resumed := journal.Done
+
+	//O_DIRECT needs every offset and length to be aligned to the logical sector size
+	direct := cfg.Direct && p.SectorSizeLogical > 0 && src%p.SectorSizeLogical == 0 && dst%p.SectorSizeLogical == 0 && chunkSize%p.SectorSizeLogical == 0
+	for i := 0; i < len(extents) && direct; i++ {
+		direct = extents[i].Offset%p.SectorSizeLogical == 0 && extents[i].Length%p.SectorSizeLogical == 0
+	}
+	if err := p.CheckWrite(dst, length); err != nil {
+		return fmt.Errorf("copy: %v", err)
+	}
+	reader, readDirect, err := p.openCopy(os.O_RDONLY, direct)
+	if err != nil {
+		return fmt.Errorf("copy: Failed to open %s for reading: %v", p.Config.Disk, err)
+	}
+	defer reader.Close()
+	writer, writeDirect, err := p.openCopy(os.O_RDWR, direct)
+	if err != nil {
+		return fmt.Errorf("copy: Failed to open %s for writing: %v", p.Config.Disk, err)
+	}
+	defer writer.Close()
+
+	//Split the extents into chunks, in the order they must be copied
+	backwards := dst > src && dst < src+length
+	chunks := make([]Extent, 0)
+	total := int64(0)
+	for i := 0; i < len(extents); i++ {
+		for offset := int64(0); offset < extents[i].Length; offset += chunkSize {
+			count := extents[i].Length - offset
+			if count > chunkSize {
+				count = chunkSize
+			}
+			chunks = append(chunks, Extent{Offset: extents[i].Offset + offset, Length: count})
+		}
+		total += extents[i].Length
+	}
+	if backwards {
+		for i, j := 0, len(chunks)-1; i < j; i, j = i+1, j-1 {
+			chunks[i], chunks[j] = chunks[j], chunks[i]
+		}
+	}
+	debug("copy: %s of %s from %d to %d in %d chunks (direct read: %v, direct write: %v)", bytes(total), bytes(length), src, dst, len(chunks), readDirect, writeDirect)
+	if resumed > len(chunks) {
+		return fmt.Errorf("copy: The journal has %d chunks done out of %d", resumed, len(chunks))
+	}
+	if resumed > 0 {
+		done := int64(0)
+		for i := 0; i < resumed; i++ {
+			done += chunks[i].Length
+		}
+		debug("copy: Skipping %d chunks (%s) the last run copied", resumed, bytes(done))
+		if pr != nil {
+			pr.Add(done)
+		}
+	}
+	if cfg.Journal != "" {
+		//The extents must be on record before anything at the destination is overwritten
+		if err := journal.write(cfg.Journal); err != nil {
+			return err
+		}
+	}
+
+	hashes := make([][sha256.Size]byte, len(chunks))
+	hash := cfg.Hash || cfg.Verify
+
+	free := make(chan []byte, 2)
+	free <- alignedBuffer(chunkSize)
+	free <- alignedBuffer(chunkSize)
+	full := make(chan *copyChunk, 2)
+	stop := make(chan bool)
+
+	go func() {
+		defer close(full)
+		for i := resumed; i < len(chunks); i++ {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-stop:
+				return
+			}
+			buf = buf[:chunks[i].Length]
+			if _, err := reader.ReadAt(buf, src+chunks[i].Offset); err != nil && err != io.EOF {
+				full <- &copyChunk{err: fmt.Errorf("copy: Failed to read %d bytes at offset %d: %v", len(buf), src+chunks[i].Offset, err)}
+				return
+			}
+			if hash {
+				hashes[i] = sha256.Sum256(buf)
+			}
+			full <- &copyChunk{buf: buf, index: i, offset: chunks[i].Offset}
+		}
+	}()
+
+	for chunk := range full {
+		if chunk.err != nil {
+			close(stop)
+			return chunk.err
+		}
+		if _, err := writer.WriteAt(chunk.buf, dst+chunk.offset); err != nil {
+			close(stop)
+			return fmt.Errorf("copy: Failed to write %d bytes at offset %d: %v", len(chunk.buf), dst+chunk.offset, err)
+		}
+		if cfg.Journal != "" {
+			if err := writer.Sync(); err != nil {
+				close(stop)
+				return fmt.Errorf("copy: Failed to sync %s: %v", p.Config.Disk, err)
+			}
+			journal.Done = chunk.index + 1
+			if err := journal.write(cfg.Journal); err != nil {
+				close(stop)
+				return err
+			}
+		}
+		if pr != nil {
+			pr.Add(int64(len(chunk.buf)))
+		}
+		free <- chunk.buf[:cap(chunk.buf)]
+	}
+	if err := writer.Sync(); err != nil {
+		return fmt.Errorf("copy: Failed to sync %s: %v", p.Config.Disk, err)
+	}
+
+	//Everything has been read now, so the free space at the destination can go
+	gap := int64(0)
+	for i := 0; i <= len(extents); i++ {
+		end := length
+		if i < len(extents) {
+			end = extents[i].Offset
+		}
+		if end > gap {
+			if err := p.Trim(dst+gap, end-gap); err != nil {
+				debug("copy: Failed to discard %d unused bytes at offset %d: %v", end-gap, dst+gap, err)
+			}
+		}
+		if i < len(extents) {
+			gap = extents[i].Offset + extents[i].Length
+		}
+	}
+
+	if cfg.Verify {
+		if !readDirect {
+			//Without O_DIRECT, the reads would come back from the page cache instead of the disk
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, reader.Fd(), ioctlBLKFLSBUF, 0); errno != 0 {
+				debug("copy: Failed to drop buffer cache of %s before verifying: %v", p.Config.Disk, errno)
+			}
+		}
+		//What the last run copied can't be checked, its source is gone
+		buf := alignedBuffer(chunkSize)
+		for i := resumed; i < len(chunks); i++ {
+			data := buf[:chunks[i].Length]
+			if _, err := reader.ReadAt(data, dst+chunks[i].Offset); err != nil && err != io.EOF {
+				return fmt.Errorf("copy: Failed to read back %d bytes at offset %d: %v", len(data), dst+chunks[i].Offset, err)
+			}
+			if sha256.Sum256(data) != hashes[i] {
+				return fmt.Errorf("copy: Verification failed, %d bytes at offset %d don't match the source at offset %d", len(data), dst+chunks[i].Offset, src+chunks[i].Offset)
+			}
+		}
+		debug("copy: Verified %d chunks at %d", len(chunks)-resumed, dst)
+	}
+
+	return nil
+}
+
+// Move copies the partition's data to a new start on the disk and recreates it there with the same size.
+func (part *Partition) Move(start int64) error {
+	if err := part.Unmount(); err != nil {
+		return fmt.Errorf("move: %v", err)
+	}
+	partActual := part.Parted.GetPartition(false, part)
+	if partActual == nil {
+		return fmt.Errorf("move: Actual partition %s not found", part.GetName())
+	}
+	size := partActual.GetSize()
+	oldStart := *partActual.Start
+
+	if !part.Wipe {
+		//Only copy what the filesystem uses, when we can tell, unless a copy cut short already knows what it was
+		var extents []Extent
+		pending, err := part.Parted.PendingCopy()
+		if err != nil {
+			return fmt.Errorf("move: %v", err)
+		}
+		if pending != nil && pending.Src == oldStart {
+			extents = pending.Extents
+		} else if extents, err = partActual.AllocatedExtents(); err != nil {
+			warn("move: Failed to read allocation map of %s, copying all of it: %v", part.GetName(), err)
+			extents = nil
+		}
+		total := size
+		if extents != nil {
+			total = 0
+			for i := 0; i < len(extents); i++ {
+				total += extents[i].Length
+			}
+			log("Copying %s of %s used by %s", bytes(total), bytes(size), part.GetName())
+		}
+		pr := NewProgress("move", part.GetName(), total, true)
+		if err := part.Parted.CopyDisk(oldStart, start, size, extents, pr); err != nil {
+			return fmt.Errorf("move: Failed to copy %s from %d to %d: %v", part.GetName(), oldStart, start, err)
+		}
+		pr.Finish()
+	}
+
+	partActual.superblock = nil
+	*partActual.Start = start
+	*partActual.End = start + size - 1
+	if _, err := part.Parted.ResizePart(*partActual.Number, *partActual.End); err != nil {
+		return fmt.Errorf("move: Failed to recreate %s at %d: %v", part.GetName(), start, err)
+	}
+	if err := part.Parted.FinishCopy(); err != nil {
+		return fmt.Errorf("move: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The discard modes that can be set with "discard" in the config.
+const (
+	discardOn     = "on"     //Discard freed space with BLKDISCARD, the default
+	discardSecure = "secure" //Discard freed space with BLKSECDISCARD, so the flash erases it too
+	discardOff    = "off"    //Leave freed space alone
+)
+
+// Set by --no-discard to leave freed space alone whatever the config says.
+var noDiscard = false
+
+// DiscardMode returns how freed space is discarded, from the config and --no-discard.
+func (p *Parted) DiscardMode() string {
+	if noDiscard {
+		return discardOff
+	}
+	switch p.Config.Discard {
+	case discardSecure, discardOff:
+		return p.Config.Discard
+	}
+	return discardOn
+}
+
+// DiscardGranularity returns the size in bytes that discards on the disk must be aligned to, read from sysfs.
+// 0 means the disk doesn't support discard at all.
+func (p *Parted) DiscardGranularity() int64 {
+	disk := p.Config.Disk
+	if resolved, err := filepath.EvalSymlinks(disk); err == nil {
+		disk = resolved
+	}
+	path := filepath.Join("/sys/block", filepath.Base(disk), "queue", "discard_granularity")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		debug("discard: Failed to read %s: %v", path, err)
+		return 0
+	}
+	granularity := int64(0)
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d", &granularity); err != nil {
+		return 0
+	}
+	return granularity
+}
+
+// Trim tells the disk a byte range no longer holds data. The range is shrunk to the discard granularity, as
+// the disk ignores anything smaller. Disks that don't support discard get the range zeroed instead, so old data
+// never reappears. Trim does nothing if discard is off.
+func (p *Parted) Trim(offset, length int64) error {
+	mode := p.DiscardMode()
+	if mode == discardOff || length <= 0 {
+		return nil
+	}
+
+	granularity := p.DiscardGranularity()
+	if granularity <= 0 {
+		debug("discard: %s doesn't support discard, zeroing %s at %d instead", p.Config.Disk, bytes(length), offset)
+		return p.ZeroDisk(offset, length)
+	}
+	start := (offset + granularity - 1) / granularity * granularity
+	end := (offset + length) / granularity * granularity
+	if end <= start {
+		return nil
+	}
+
+	err := p.DiscardDisk(start, end-start, mode == discardSecure)
+	if err != nil && mode == discardSecure {
+		warn("discard: Secure discard failed on %s, falling back to discard: %v", p.Config.Disk, err)
+		err = p.DiscardDisk(start, end-start, false)
+	}
+	if err != nil {
+		debug("discard: %v, zeroing instead", err)
+		return p.ZeroDisk(offset, length)
+	}
+	return nil
+}
+
+// UsedRanges returns the byte ranges of the disk that belong to partitions, in order.
+func (p *Parted) UsedRanges() []Extent {
+	used := make([]Extent, 0)
+	for i := 0; i < len(p.Partitions); i++ {
+		if *p.Partitions[i].Number == 0 {
+			continue
+		}
+		used = append(used, Extent{Offset: *p.Partitions[i].Start, Length: p.Partitions[i].GetSize()})
+	}
+	return mergeExtents(used)
+}
+
+// freedRanges returns the parts of the before ranges that aren't in the after ranges. Both must be merged.
+func freedRanges(before, after []Extent) []Extent {
+	freed := make([]Extent, 0)
+	for i := 0; i < len(before); i++ {
+		start := before[i].Offset
+		end := before[i].Offset + before[i].Length
+		for j := 0; j < len(after) && start < end; j++ {
+			afterStart := after[j].Offset
+			afterEnd := after[j].Offset + after[j].Length
+			if afterEnd <= start || afterStart >= end {
+				continue
+			}
+			if afterStart > start {
+				freed = append(freed, Extent{Offset: start, Length: afterStart - start})
+			}
+			start = afterEnd
+		}
+		if start < end {
+			freed = append(freed, Extent{Offset: start, Length: end - start})
+		}
+	}
+	return freed
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Filesystem knows how to inspect and change one type of filesystem on a partition.
+// Sizes are always in bytes.
+type Filesystem interface {
+	// Name returns the name of the filesystem, such as "ext4".
+	Name() string
+	// Detect returns true if the partition holds this filesystem.
+	Detect(part *Partition) bool
+	// Check checks the filesystem for errors, repairing them if repair is true and only reporting them otherwise.
+	Check(part *Partition, repair bool) error
+	// Shrink shrinks the filesystem to size, before the partition itself shrinks.
+	Shrink(part *Partition, size int64) error
+	// Grow grows the filesystem to size, after the partition itself grows.
+	Grow(part *Partition, size int64) error
+	// Format creates a new, empty filesystem filling the partition.
+	Format(part *Partition) error
+	// MinSize returns the smallest size the filesystem can be shrunk to without losing data.
+	MinSize(part *Partition) (int64, error)
+}
+
+// Every supported filesystem, in the order they are detected.
+var filesystems = []Filesystem{
+	&Ext4{},
+	&F2FS{},
+	&VFAT{},
+	&EROFS{},
+	&Swap{},
+}
+
+// The default path of every external tool the filesystem drivers use, overridable with "tools" in the config.
+var defaultTools = map[string]string{
+	"e2fsck":      "/sbin/e2fsck",
+	"resize2fs":   "/sbin/resize2fs",
+	"mke2fs":      "/sbin/mke2fs",
+	"dumpe2fs":    "/sbin/dumpe2fs",
+	"fsck.f2fs":   "/sbin/fsck.f2fs",
+	"resize.f2fs": "/sbin/resize.f2fs",
+	"mkfs.f2fs":   "/sbin/mkfs.f2fs",
+	"fsck.fat":    "/sbin/fsck.fat",
+	"fatresize":   "/sbin/fatresize",
+	"mkfs.fat":    "/sbin/mkfs.fat",
+	"fsck.erofs":  "/sbin/fsck.erofs",
+	"mkswap":      "/sbin/mkswap",
+}
+
+// GetFilesystem returns the driver for the filesystem on the partition, or nil if it has none we know of.
+// When parted doesn't recognise the filesystem, the partition's superblock is probed instead.
+func GetFilesystem(part *Partition) Filesystem {
+	for i := 0; i < len(filesystems); i++ {
+		if filesystems[i].Detect(part) {
+			return filesystems[i]
+		}
+	}
+	sb, err := part.Probe()
+	if err != nil {
+		return nil
+	}
+	switch sb.Type {
+	case "ext2", "ext3":
+		return GetFilesystemByName("ext4")
+	}
+	return GetFilesystemByName(sb.Type)
+}
+
+// GetFilesystemByName returns the driver for the named filesystem, such as the "fs" of a partition in the config.
+func GetFilesystemByName(name string) Filesystem {
+	for i := 0; i < len(filesystems); i++ {
+		if strings.EqualFold(filesystems[i].Name(), name) {
+			return filesystems[i]
+		}
+	}
+	return nil
+}
+
+// Tool returns the path to an external tool. The legacy "fsck" and "resize" commands in the config are still
+// honoured as the paths to e2fsck and resize2fs.
+func (p *Parted) Tool(name string) string {
+	if tool, ok := p.Config.Tools[name]; ok && tool != "" {
+		return tool
+	}
+	if name == "e2fsck" && isTool(p.Config.Fsck, name) {
+		return strings.Split(p.Config.Fsck, " ")[0]
+	}
+	if name == "resize2fs" && isTool(p.Config.Resize, name) {
+		return strings.Split(p.Config.Resize, " ")[0]
+	}
+	return defaultTools[name]
+}
+
+// Run a filesystem tool, treating any exit code above maxCode as a failure.
+func runTool(p *Parted, name, args string, maxCode int, watchOutput func([]byte), watchFD func([]byte)) (string, error) {
+	output, code, err := RunCode(p.Tool(name), args, watchOutput, watchFD)
+	if err != nil {
+		return output, fmt.Errorf("%s: %v", name, err)
+	}
+	if code > maxCode {
+		return output, fmt.Errorf("%s exited with code %d: %s", name, code, strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// Returns true if parted reported any of the given filesystem names for the partition.
+func partedFS(part *Partition, names ...string) bool {
+	if part.FS == nil {
+		return false
+	}
+	for i := 0; i < len(names); i++ {
+		if strings.HasPrefix(*part.FS, names[i]) {
+			return true
+		}
+	}
+	return false
+}
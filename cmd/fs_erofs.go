@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+)
+
+// EROFS is the driver for erofs. It is read-only, so it can only be checked, and must be recreated from an
+// image instead of being formatted. Its image never changes size, so resizing only has to keep all of it.
+type EROFS struct{}
+
+func (fs *EROFS) Name() string {
+	return "erofs"
+}
+
+func (fs *EROFS) Detect(part *Partition) bool {
+	return partedFS(part, "erofs")
+}
+
+func (fs *EROFS) Check(part *Partition, repair bool) error {
+	_, err := runTool(part.Parted, "fsck.erofs", part.GetPath(), 0, nil, nil)
+	return err
+}
+
+// Shrinking only has to leave room for the whole image.
+func (fs *EROFS) Shrink(part *Partition, size int64) error {
+	minSize, err := fs.MinSize(part)
+	if err != nil {
+		return err
+	}
+	if minSize > size {
+		return fmt.Errorf("erofs: %s holds an image of %s, which doesn't fit in %s", part.GetPath(), bytes(minSize), bytes(size))
+	}
+	return nil
+}
+
+// Growing leaves the image as it is, the extra space is there for the next one flashed.
+func (fs *EROFS) Grow(part *Partition, size int64) error {
+	return nil
+}
+
+func (fs *EROFS) Format(part *Partition) error {
+	return fmt.Errorf("erofs: %s is read-only and must be recreated from an image", part.GetPath())
+}
+
+func (fs *EROFS) MinSize(part *Partition) (int64, error) {
+	sb, err := part.Probe()
+	if err != nil {
+		return 0, err
+	}
+	if sb.Type != "erofs" {
+		return 0, fmt.Errorf("erofs: Found %s superblock on %s", sb.Type, part.GetPath())
+	}
+	return sb.MinSize, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ext4 is the driver for ext2, ext3 and ext4, using e2fsprogs.
+type Ext4 struct{}
+
+func (fs *Ext4) Name() string {
+	return "ext4"
+}
+
+func (fs *Ext4) Detect(part *Partition) bool {
+	return partedFS(part, "ext2", "ext3", "ext4")
+}
+
+func (fs *Ext4) Check(part *Partition, repair bool) error {
+	pr := NewProgress("fsck", part.GetName(), 0, false)
+	var err error
+	if repair {
+		//Exit codes 1 and 2 mean errors were corrected, and the legacy fsck command in the config carries its own flags
+		if isTool(part.Parted.Config.Fsck, "e2fsck") {
+			output, code, runErr := RunCode(part.Parted.Config.Fsck, "-C 3 "+part.GetPath(), nil, watchE2fsck(pr))
+			err = runErr
+			if err == nil && code > 2 {
+				err = fmt.Errorf("e2fsck exited with code %d: %s", code, strings.TrimSpace(output))
+			}
+		} else {
+			_, err = runTool(part.Parted, "e2fsck", "-p -f -C 3 "+part.GetPath(), 2, nil, watchE2fsck(pr))
+		}
+	} else {
+		_, err = runTool(part.Parted, "e2fsck", "-n -f -C 3 "+part.GetPath(), 0, nil, watchE2fsck(pr))
+	}
+	if err != nil {
+		return err
+	}
+	pr.Finish()
+	return nil
+}
+
+// Resize the filesystem with resize2fs, which both shrinks and grows.
+func (fs *Ext4) resize(part *Partition, size int64) error {
+	pr := NewProgress("resize", part.GetName(), 0, false)
+	output, err := runTool(part.Parted, "resize2fs", fmt.Sprintf("-p %s %dK", part.GetPath(), size/1024), 0, watchResize2fs(pr), nil)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(output, "blocks long") && !strings.Contains(output, "Nothing to do") {
+		return fmt.Errorf("resize2fs: Failed to confirm new size of %s: %s", part.GetPath(), strings.TrimSpace(output))
+	}
+	pr.Finish()
+	return nil
+}
+
+func (fs *Ext4) Shrink(part *Partition, size int64) error {
+	return fs.resize(part, size)
+}
+
+func (fs *Ext4) Grow(part *Partition, size int64) error {
+	return fs.resize(part, size)
+}
+
+func (fs *Ext4) Format(part *Partition) error {
+	_, err := runTool(part.Parted, "mke2fs", fmt.Sprintf("-F -q -t ext4 -L %s %s", part.GetName(), part.GetPath()), 0, nil, nil)
+	return err
+}
+
+// MinSize asks resize2fs for the estimated minimum size in filesystem blocks, and dumpe2fs for the block size.
+func (fs *Ext4) MinSize(part *Partition) (int64, error) {
+	output, err := runTool(part.Parted, "resize2fs", "-P "+part.GetPath(), 0, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	blocks := int64(-1)
+	lines := strings.Split(output, "\n")
+	for i := 0; i < len(lines); i++ {
+		if _, err := fmt.Sscanf(strings.TrimSpace(lines[i]), "Estimated minimum size of the filesystem: %d", &blocks); err == nil {
+			break
+		}
+	}
+	if blocks < 0 {
+		return 0, fmt.Errorf("resize2fs: Failed to scan minimum size of %s", part.GetPath())
+	}
+
+	blockSize := int64(0)
+	dump, err := runTool(part.Parted, "dumpe2fs", "-h "+part.GetPath(), 0, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	lines = strings.Split(dump, "\n")
+	for i := 0; i < len(lines); i++ {
+		if _, err := fmt.Sscanf(strings.TrimSpace(lines[i]), "Block size: %d", &blockSize); err == nil {
+			break
+		}
+	}
+	if blockSize <= 0 {
+		return 0, fmt.Errorf("dumpe2fs: Failed to scan block size of %s", part.GetPath())
+	}
+
+	return blocks * blockSize, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+)
+
+// F2FS is the driver for f2fs, using f2fs-tools.
+type F2FS struct{}
+
+func (fs *F2FS) Name() string {
+	return "f2fs"
+}
+
+func (fs *F2FS) Detect(part *Partition) bool {
+	return partedFS(part, "f2fs")
+}
+
+func (fs *F2FS) Check(part *Partition, repair bool) error {
+	args := "-f --dry-run "
+	if repair {
+		args = "-f -a "
+	}
+	_, err := runTool(part.Parted, "fsck.f2fs", args+part.GetPath(), 0, nil, nil)
+	return err
+}
+
+// Shrinking f2fs needs the safe resize flag, without it resize.f2fs refuses to shrink.
+func (fs *F2FS) Shrink(part *Partition, size int64) error {
+	_, err := runTool(part.Parted, "resize.f2fs", fmt.Sprintf("-s -t %d %s", size/512, part.GetPath()), 0, nil, nil)
+	return err
+}
+
+func (fs *F2FS) Grow(part *Partition, size int64) error {
+	_, err := runTool(part.Parted, "resize.f2fs", fmt.Sprintf("-t %d %s", size/512, part.GetPath()), 0, nil, nil)
+	return err
+}
+
+func (fs *F2FS) Format(part *Partition) error {
+	_, err := runTool(part.Parted, "mkfs.f2fs", fmt.Sprintf("-f -l %s %s", part.GetName(), part.GetPath()), 0, nil, nil)
+	return err
+}
+
+func (fs *F2FS) MinSize(part *Partition) (int64, error) {
+	sb, err := part.Probe()
+	if err != nil {
+		return 0, err
+	}
+	if sb.Type != "f2fs" {
+		return 0, fmt.Errorf("f2fs: Found %s superblock on %s", sb.Type, part.GetPath())
+	}
+	return sb.MinSize, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+)
+
+// The smallest swap area mkswap will create.
+const swapMinSize = 40 * 1024
+
+// Swap is the driver for Linux swap areas. Swap holds nothing worth keeping, so resizing recreates it.
+type Swap struct{}
+
+func (fs *Swap) Name() string {
+	return "swap"
+}
+
+func (fs *Swap) Detect(part *Partition) bool {
+	return partedFS(part, "linux-swap", "swap")
+}
+
+func (fs *Swap) Check(part *Partition, repair bool) error {
+	return nil
+}
+
+// Recreate the swap area with the given size, which mkswap takes in KiB.
+func (fs *Swap) mkswap(part *Partition, size int64) error {
+	_, err := runTool(part.Parted, "mkswap", fmt.Sprintf("-L %s %s %d", part.GetName(), part.GetPath(), size/1024), 0, nil, nil)
+	return err
+}
+
+func (fs *Swap) Shrink(part *Partition, size int64) error {
+	return fs.mkswap(part, size)
+}
+
+func (fs *Swap) Grow(part *Partition, size int64) error {
+	return fs.mkswap(part, size)
+}
+
+func (fs *Swap) Format(part *Partition) error {
+	return fs.mkswap(part, part.GetSize())
+}
+
+func (fs *Swap) MinSize(part *Partition) (int64, error) {
+	return swapMinSize, nil
+}
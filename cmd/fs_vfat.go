@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VFAT is the driver for FAT12, FAT16 and FAT32, using dosfstools and fatresize.
+type VFAT struct{}
+
+func (fs *VFAT) Name() string {
+	return "vfat"
+}
+
+func (fs *VFAT) Detect(part *Partition) bool {
+	return partedFS(part, "fat12", "fat16", "fat32", "vfat")
+}
+
+func (fs *VFAT) Check(part *Partition, repair bool) error {
+	args := "-n "
+	if repair {
+		args = "-a "
+	}
+	_, err := runTool(part.Parted, "fsck.fat", args+part.GetPath(), 0, nil, nil)
+	return err
+}
+
+// Resize the filesystem with fatresize, which works on the disk and partition number rather than the partition.
+func (fs *VFAT) resize(part *Partition, size int64) error {
+	_, err := runTool(part.Parted, "fatresize", fmt.Sprintf("-q -s %d -n %d %s", size, *part.Number, part.Parted.Config.Disk), 0, nil, nil)
+	return err
+}
+
+func (fs *VFAT) Shrink(part *Partition, size int64) error {
+	return fs.resize(part, size)
+}
+
+func (fs *VFAT) Grow(part *Partition, size int64) error {
+	return fs.resize(part, size)
+}
+
+// FAT labels are at most 11 characters.
+func (fs *VFAT) Format(part *Partition) error {
+	label := strings.ToUpper(part.GetName())
+	if len(label) > 11 {
+		label = label[:11]
+	}
+	_, err := runTool(part.Parted, "mkfs.fat", fmt.Sprintf("-F 32 -n %s %s", label, part.GetPath()), 0, nil, nil)
+	return err
+}
+
+func (fs *VFAT) MinSize(part *Partition) (int64, error) {
+	sb, err := part.Probe()
+	if err != nil {
+		return 0, err
+	}
+	if sb.Type != "vfat" {
+		return 0, fmt.Errorf("vfat: Found %s superblock on %s", sb.Type, part.GetPath())
+	}
+	return sb.MinSize, nil
+}
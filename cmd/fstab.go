@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// FstabConfig describes an existing fstab to read and the fstabs to generate from it for the new layout.
+type FstabConfig struct {
+	Input    string `json:"input"`    //Path to the device's existing fstab, such as /vendor/etc/fstab.qcom
+	Output   string `json:"output"`   //Path to write the rewritten fstab to
+	Recovery string `json:"recovery"` //Optional path to write a recovery.fstab to
+	TWRP     string `json:"twrp"`     //Optional path to write a twrp.fstab to
+}
+
+// An Fstab is an Android fstab, keeping every line so it can be written back with only the devices changed.
+type Fstab struct {
+	Lines   []string
+	Entries []*FstabEntry
+}
+
+// An FstabEntry is a single mount in an Android fstab: <src> <mnt_point> <type> <mnt_flags> <fs_mgr_flags>
+type FstabEntry struct {
+	Line       int // The index of the entry in Fstab.Lines
+	Device     string
+	MountPoint string
+	Type       string
+	MntFlags   string
+	FsMgrFlags string
+
+	changed bool
+}
+
+func ReadFstab(path string) (*Fstab, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read fstab %s: %v", path, err)
+	}
+
+	fstab := &Fstab{Lines: strings.Split(strings.TrimRight(string(data), "\n"), "\n"), Entries: make([]*FstabEntry, 0)}
+	for i := 0; i < len(fstab.Lines); i++ {
+		fields := strings.Fields(fstab.Lines[i])
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Invalid entry on line %d of fstab %s: %s", i+1, path, fstab.Lines[i])
+		}
+		entry := &FstabEntry{Line: i, Device: fields[0], MountPoint: fields[1], Type: fields[2]}
+		if len(fields) > 3 {
+			entry.MntFlags = fields[3]
+		}
+		if len(fields) > 4 {
+			entry.FsMgrFlags = fields[4]
+		}
+		fstab.Entries = append(fstab.Entries, entry)
+	}
+
+	return fstab, nil
+}
+
+// Rewrite updates the block device of every entry that refers to a partition by number, using the partition
+// numbers by name of each disk from before the changes (old) and after them (disks). Entries that refer to a
+// partition by name are kept, but a warning is logged if that name no longer exists on any disk.
+func (fstab *Fstab) Rewrite(disks []*Parted, old []map[string]int) error {
+	for i := 0; i < len(fstab.Entries); i++ {
+		entry := fstab.Entries[i]
+		if idx := strings.Index(entry.Device, "/by-name/"); idx >= 0 {
+			name := entry.Device[idx+len("/by-name/"):]
+			found := false
+			for j := 0; j < len(disks) && !found; j++ {
+				found = disks[j].GetPartitionByName(false, name) != nil
+			}
+			if !found {
+				warn("fstab: %s for %s refers to partition %s, which no longer exists", entry.Device, entry.MountPoint, name)
+			}
+			continue
+		}
+
+		for j := 0; j < len(disks); j++ {
+			if err := fstab.rewriteEntry(entry, disks[j], old[j]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Rewrite a single entry if it refers to a partition of p by number.
+func (fstab *Fstab) rewriteEntry(entry *FstabEntry, p *Parted, old map[string]int) error {
+	numbered := regexp.MustCompile("^" + regexp.QuoteMeta(p.Config.Disk) + "(p?)([0-9]+)$")
+	match := numbered.FindStringSubmatch(entry.Device)
+	if match == nil {
+		return nil
+	}
+	oldNames := make(map[int]string)
+	for name, num := range old {
+		oldNames[num] = name
+	}
+	oldNum := 0
+	fmt.Sscanf(match[2], "%d", &oldNum)
+	name, ok := oldNames[oldNum]
+	if !ok {
+		return fmt.Errorf("fstab: %s for %s is not a partition on %s", entry.Device, entry.MountPoint, p.Config.Disk)
+	}
+	part := p.GetPartitionByName(false, name)
+	if part == nil {
+		return fmt.Errorf("fstab: %s for %s was partition %s, which no longer exists", entry.Device, entry.MountPoint, name)
+	}
+	if *part.Number == oldNum {
+		return nil
+	}
+
+	device := fmt.Sprintf("%s%s%d", p.Config.Disk, match[1], *part.Number)
+	log("fstab: %s moved from %s to %s", entry.MountPoint, entry.Device, device)
+	entry.Device = device
+	entry.changed = true
+	return nil
+}
+
+// String returns the fstab with changed entries rewritten and everything else, including comments, untouched.
+func (fstab *Fstab) String() string {
+	lines := make([]string, len(fstab.Lines))
+	copy(lines, fstab.Lines)
+	for i := 0; i < len(fstab.Entries); i++ {
+		entry := fstab.Entries[i]
+		if entry.changed {
+			lines[entry.Line] = strings.TrimRight(strings.Join([]string{entry.Device, entry.MountPoint, entry.Type, entry.MntFlags, entry.FsMgrFlags}, "\t"), "\t")
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// RecoveryString returns the entries in the legacy recovery.fstab format: <mnt_point> <type> <device>
+func (fstab *Fstab) RecoveryString() string {
+	out := "# mount point\tfstype\tdevice\n"
+	for i := 0; i < len(fstab.Entries); i++ {
+		entry := fstab.Entries[i]
+		out += fmt.Sprintf("%s\t%s\t%s\n", entry.MountPoint, entry.Type, entry.Device)
+	}
+	return out
+}
+
+// TWRPString returns the entries in the twrp.fstab format, naming each mount after its mount point. Swap and
+// entries without a real mount point, such as voldmanaged "auto" ones, aren't anything TWRP can mount.
+func (fstab *Fstab) TWRPString() string {
+	out := "# mount point\tfstype\tdevice\tflags\n"
+	for i := 0; i < len(fstab.Entries); i++ {
+		entry := fstab.Entries[i]
+		if entry.Type == "swap" || !strings.HasPrefix(entry.MountPoint, "/") {
+			continue
+		}
+		display := strings.TrimPrefix(entry.MountPoint, "/")
+		if display == "" {
+			continue
+		}
+		display = strings.ToUpper(display[:1]) + display[1:]
+		out += fmt.Sprintf("%s\t%s\t%s\tflags=display=\"%s\"\n", entry.MountPoint, entry.Type, entry.Device, display)
+	}
+	return out
+}
+
+// Layout returns the partition numbers by name, to be given to Fstab.Rewrite after the partitions change.
+func (p *Parted) Layout() map[string]int {
+	layout := make(map[string]int)
+	for i := 0; i < len(p.Partitions); i++ {
+		if *p.Partitions[i].Number == 0 {
+			continue
+		}
+		layout[*p.Partitions[i].Name] = *p.Partitions[i].Number
+	}
+	return layout
+}
+
+// WriteFstabs reads the configured fstab, rewrites it for the current layout of every disk and writes every
+// configured output.
+func WriteFstabs(cfg *FstabConfig, disks []*Parted, old []map[string]int) error {
+	if cfg == nil || cfg.Input == "" {
+		return nil
+	}
+
+	fstab, err := ReadFstab(cfg.Input)
+	if err != nil {
+		return err
+	}
+	if err := fstab.Rewrite(disks, old); err != nil {
+		return err
+	}
+
+	outputs := []struct {
+		path string
+		data string
+	}{
+		{cfg.Output, fstab.String()},
+		{cfg.Recovery, fstab.RecoveryString()},
+		{cfg.TWRP, fstab.TWRPString()},
+	}
+	for i := 0; i < len(outputs); i++ {
+		if outputs[i].path == "" {
+			continue
+		}
+		if err := os.WriteFile(outputs[i].path, []byte(outputs[i].data), 0644); err != nil {
+			return fmt.Errorf("Failed to write fstab %s: %v", outputs[i].path, err)
+		}
+		log("Wrote fstab %s", outputs[i].path)
+	}
+
+	return nil
+}
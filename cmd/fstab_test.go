@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A disk with partitions numbered in the order of their names.
+func testFstabDisk(disk string, names ...string) *Parted {
+	p := &Parted{Config: &PartedConfig{Disk: disk}}
+	for i := 0; i < len(names); i++ {
+		p.Partitions = append(p.Partitions, NewPartition(p, i+1, 0, 0, "0B", "", names[i], ""))
+	}
+	return p
+}
+
+func readTestFstab(t *testing.T, data string) *Fstab {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fstab")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fstab, err := ReadFstab(path)
+	if err != nil {
+		t.Fatalf("ReadFstab: %v", err)
+	}
+	return fstab
+}
+
+func TestFstabRewrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		fstab string
+		disks []string
+		old   [][]string //Partition names of each disk before the changes, numbered from 1
+		new   [][]string //And after them
+		want  string     //Empty when Rewrite should fail
+		err   string
+	}{
+		{
+			"unchanged",
+			"/dev/block/mmcblk0p1\t/system\text4\tro\twait\n",
+			[]string{"/dev/block/mmcblk0"},
+			[][]string{{"system", "userdata"}},
+			[][]string{{"system", "userdata"}},
+			"/dev/block/mmcblk0p1\t/system\text4\tro\twait\n", "",
+		},
+		{
+			"renumbered",
+			"# Comments and blank lines stay\n\n/dev/block/mmcblk0p2  /data  ext4  noatime  wait,check\n/dev/block/mmcblk0p1 /cache ext4 nosuid wait\n",
+			[]string{"/dev/block/mmcblk0"},
+			[][]string{{"cache", "userdata"}},
+			[][]string{{"userdata", "cache"}},
+			"# Comments and blank lines stay\n\n/dev/block/mmcblk0p1\t/data\text4\tnoatime\twait,check\n/dev/block/mmcblk0p2\t/cache\text4\tnosuid\twait\n", "",
+		},
+		{
+			"without a p",
+			"/dev/block/sda3 /vendor ext4 ro\n",
+			[]string{"/dev/block/sda"},
+			[][]string{{"boot", "system", "vendor"}},
+			[][]string{{"vendor", "boot", "system"}},
+			"/dev/block/sda1\t/vendor\text4\tro\n", "",
+		},
+		{
+			"second disk",
+			"/dev/block/sda1 /system ext4 ro wait\n/dev/block/sdb2 /data f2fs rw wait\n",
+			[]string{"/dev/block/sda", "/dev/block/sdb"},
+			[][]string{{"system"}, {"misc", "userdata"}},
+			[][]string{{"system"}, {"userdata", "misc"}},
+			"/dev/block/sda1 /system ext4 ro wait\n/dev/block/sdb1\t/data\tf2fs\trw\twait\n", "",
+		},
+		{
+			"by name",
+			"/dev/block/by-name/system /system ext4 ro\n",
+			[]string{"/dev/block/mmcblk0"},
+			[][]string{{"system"}},
+			[][]string{{"vendor"}},
+			"/dev/block/by-name/system /system ext4 ro\n", "",
+		},
+		{
+			"other devices",
+			"/dev/block/zram0 none swap defaults zramsize=50%\n/devices/platform/sdcard* auto auto defaults voldmanaged=sdcard1:auto\n",
+			[]string{"/dev/block/mmcblk0"},
+			[][]string{{"system"}},
+			[][]string{{"system"}},
+			"/dev/block/zram0 none swap defaults zramsize=50%\n/devices/platform/sdcard* auto auto defaults voldmanaged=sdcard1:auto\n", "",
+		},
+		{
+			"removed partition",
+			"/dev/block/mmcblk0p2 /cache ext4 nosuid wait\n",
+			[]string{"/dev/block/mmcblk0"},
+			[][]string{{"system", "cache"}},
+			[][]string{{"system"}},
+			"", "which no longer exists",
+		},
+		{
+			"unknown number",
+			"/dev/block/mmcblk0p9 /persist ext4 nosuid wait\n",
+			[]string{"/dev/block/mmcblk0"},
+			[][]string{{"system"}},
+			[][]string{{"system"}},
+			"", "is not a partition",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fstab := readTestFstab(t, tt.fstab)
+			disks := make([]*Parted, len(tt.disks))
+			old := make([]map[string]int, len(tt.disks))
+			for i := 0; i < len(tt.disks); i++ {
+				old[i] = testFstabDisk(tt.disks[i], tt.old[i]...).Layout()
+				disks[i] = testFstabDisk(tt.disks[i], tt.new[i]...)
+			}
+
+			err := fstab.Rewrite(disks, old)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Rewrite: %v", err)
+			}
+			if got := fstab.String(); got != tt.want {
+				t.Errorf("got fstab\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFstabTWRPString(t *testing.T) {
+	fstab := readTestFstab(t, "/dev/block/mmcblk0p1 /system ext4 ro wait\n"+
+		"/dev/block/zram0 none swap defaults zramsize=50%\n"+
+		"/devices/platform/sdcard* auto auto defaults voldmanaged=sdcard1:auto\n"+
+		"/dev/block/mmcblk0p2 / ext4 ro wait\n"+
+		"/dev/block/mmcblk0p3 /data f2fs rw wait\n")
+	want := "# mount point\tfstype\tdevice\tflags\n" +
+		"/system\text4\t/dev/block/mmcblk0p1\tflags=display=\"System\"\n" +
+		"/data\tf2fs\t/dev/block/mmcblk0p3\tflags=display=\"Data\"\n"
+	if got := fstab.TWRPString(); got != want {
+		t.Errorf("got twrp.fstab\n%s\nwant\n%s", got, want)
+	}
+}
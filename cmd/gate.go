@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+)
+
+// AllowWrites approves the plan for the disk, letting reparted write to the given byte ranges and nowhere else.
+// Until it's called, the disk is only ever opened for reading.
+func (p *Parted) AllowWrites(ranges []Extent) {
+	allowed := make([]Extent, len(ranges))
+	copy(allowed, ranges)
+	p.allowed = mergeExtents(allowed)
+	for i := 0; i < len(p.allowed); i++ {
+		debug("Allowing writes to %s from %d to %d", p.Config.Disk, p.allowed[i].Offset, p.allowed[i].Offset+p.allowed[i].Length-1)
+	}
+}
+
+// CheckWrite returns an error unless a plan has been approved and the byte range lies inside one of the ranges
+// it allows. It's the safety net under every write reparted makes to the disk itself.
+func (p *Parted) CheckWrite(offset, length int64) error {
+	if p.allowed == nil {
+		return fmt.Errorf("Refusing to write %d bytes at offset %d of %s before the plan is approved", length, offset, p.Config.Disk)
+	}
+	for i := 0; i < len(p.allowed); i++ {
+		if offset >= p.allowed[i].Offset && offset+length <= p.allowed[i].Offset+p.allowed[i].Length {
+			return nil
+		}
+	}
+	return fmt.Errorf("Refusing to write %d bytes at offset %d of %s, outside anything the plan changes", length, offset, p.Config.Disk)
+}
+
+// WriteRanges returns the byte ranges the plan may write to: the partition tables saved in backup, every
+// reserved and userdata partition both where it is now and where it will be, and super.
+func (dp *DiskPlan) WriteRanges(backup *TableBackup) []Extent {
+	p := dp.Parted
+	ranges := make([]Extent, 0)
+	for i := 0; i < len(backup.Ranges); i++ {
+		ranges = append(ranges, Extent{Offset: backup.Ranges[i].Offset, Length: int64(len(backup.Ranges[i].Data))})
+	}
+	for i := 0; i < len(dp.Placements); i++ {
+		if dp.Placements[i].Actual != nil {
+			ranges = append(ranges, dp.Placements[i].Old)
+		}
+		ranges = append(ranges, dp.Placements[i].Extent())
+	}
+	if p.Super != nil {
+		ranges = append(ranges, Extent{Offset: *p.Super.Part.Start, Length: p.Super.Part.GetSize()})
+	}
+	return ranges
+}
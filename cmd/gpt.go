@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"unicode/utf16"
+)
+
+// A GPT is a GUID partition table header and its partition entries, as read from one of its two copies.
+type GPT struct {
+	HeaderLBA    int64
+	Header       []byte
+	EntriesLBA   int64
+	EntryCount   int64
+	EntrySize    int64
+	Entries      []byte
+	AlternateLBA int64
+}
+
+// Format a GUID as stored on disk, where the first three fields are little endian.
+func guidString(b []byte) string {
+	le := binary.LittleEndian
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X", le.Uint32(b[0:]), le.Uint16(b[4:]), le.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// Parse a GUID string back into its on-disk form.
+func guidBytes(s string) ([]byte, error) {
+	var a uint32
+	var b, c uint16
+	var d, e []byte
+	if _, err := fmt.Sscanf(s, "%08X-%04X-%04X-%4X-%12X", &a, &b, &c, &d, &e); err != nil || len(d) != 2 || len(e) != 6 {
+		return nil, fmt.Errorf("Invalid GUID %s", s)
+	}
+	guid := make([]byte, 16)
+	le := binary.LittleEndian
+	le.PutUint32(guid[0:], a)
+	le.PutUint16(guid[4:], b)
+	le.PutUint16(guid[6:], c)
+	copy(guid[8:], d)
+	copy(guid[10:], e)
+	return guid, nil
+}
+
+// ReadGPT reads the GPT header at the given LBA and its partition entries, checking both checksums.
+func (p *Parted) ReadGPT(lba int64) (*GPT, error) {
+	le := binary.LittleEndian
+	sector := p.SectorSizeLogical
+	header, err := p.ReadDisk(lba*sector, sector)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(header)) < sector || string(header[0:8]) != "EFI PART" {
+		return nil, fmt.Errorf("gpt: No GPT header at LBA %d", lba)
+	}
+	headerSize := int64(le.Uint32(header[12:]))
+	if headerSize < 92 || headerSize > sector {
+		return nil, fmt.Errorf("gpt: Invalid header size %d at LBA %d", headerSize, lba)
+	}
+	header = header[:headerSize]
+	check := make([]byte, headerSize)
+	copy(check, header)
+	le.PutUint32(check[16:], 0)
+	if crc32.ChecksumIEEE(check) != le.Uint32(header[16:]) {
+		return nil, fmt.Errorf("gpt: Header checksum mismatch at LBA %d", lba)
+	}
+
+	gpt := &GPT{
+		HeaderLBA:    lba,
+		Header:       header,
+		AlternateLBA: int64(le.Uint64(header[32:])),
+		EntriesLBA:   int64(le.Uint64(header[72:])),
+		EntryCount:   int64(le.Uint32(header[80:])),
+		EntrySize:    int64(le.Uint32(header[84:])),
+	}
+	if gpt.EntrySize < 128 || gpt.EntryCount <= 0 {
+		return nil, fmt.Errorf("gpt: Invalid partition entry array at LBA %d", lba)
+	}
+	gpt.Entries, err = p.ReadDisk(gpt.EntriesLBA*sector, gpt.EntryCount*gpt.EntrySize)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(gpt.Entries) != le.Uint32(header[88:]) {
+		return nil, fmt.Errorf("gpt: Partition entry checksum mismatch for header at LBA %d", lba)
+	}
+	return gpt, nil
+}
+
+// Entry returns the partition entry for a partition number, which starts at 1.
+func (gpt *GPT) Entry(num int) []byte {
+	if num < 1 || int64(num) > gpt.EntryCount {
+		return nil
+	}
+	return gpt.Entries[int64(num-1)*gpt.EntrySize : int64(num)*gpt.EntrySize]
+}
+
+// gptEntryName returns the name of a partition entry, stored as UTF-16.
+func gptEntryName(entry []byte) string {
+	le := binary.LittleEndian
+	name := make([]uint16, 0, 36)
+	for i := 56; i+1 < 128; i += 2 {
+		c := le.Uint16(entry[i:])
+		if c == 0 {
+			break
+		}
+		name = append(name, c)
+	}
+	return string(utf16.Decode(name))
+}
+
+// Write the header and entries back to disk with fresh checksums.
+func (p *Parted) writeGPT(gpt *GPT) error {
+	le := binary.LittleEndian
+	le.PutUint32(gpt.Header[88:], crc32.ChecksumIEEE(gpt.Entries))
+	le.PutUint32(gpt.Header[16:], 0)
+	le.PutUint32(gpt.Header[16:], crc32.ChecksumIEEE(gpt.Header))
+
+	if err := p.WriteDisk(gpt.EntriesLBA*p.SectorSizeLogical, gpt.Entries); err != nil {
+		return err
+	}
+	return p.WriteDisk(gpt.HeaderLBA*p.SectorSizeLogical, gpt.Header)
+}
+
+// LoadGPT fills in the type GUID, unique GUID and attributes of every partition from the primary GPT.
+func (p *Parted) LoadGPT() error {
+	if p.PartitionTable != "GPT" {
+		return nil
+	}
+	gpt, err := p.ReadGPT(1)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(p.Partitions); i++ {
+		part := p.Partitions[i]
+		entry := gpt.Entry(*part.Number)
+		if *part.Number == 0 || entry == nil {
+			continue
+		}
+		typeGUID := guidString(entry[0:16])
+		uniqueGUID := guidString(entry[16:32])
+		attributes := binary.LittleEndian.Uint64(entry[48:])
+		part.TypeGUID = &typeGUID
+		part.UniqueGUID = &uniqueGUID
+		part.Attributes = &attributes
+		if name := gptEntryName(entry); name != *part.Name {
+			debug("gpt: Partition %d is named %s in the GPT but %s by parted", *part.Number, name, *part.Name)
+		}
+	}
+	return nil
+}
+
+// RestoreGPTEntry writes a partition's type GUID, unique GUID and attributes back into both copies of the GPT,
+// after parted recreated it with new ones.
+func (p *Parted) RestoreGPTEntry(part *Partition) error {
+	if p.PartitionTable != "GPT" || part.TypeGUID == nil || part.UniqueGUID == nil || part.Attributes == nil {
+		return nil
+	}
+	typeGUID, err := guidBytes(*part.TypeGUID)
+	if err != nil {
+		return fmt.Errorf("gpt: %v", err)
+	}
+	uniqueGUID, err := guidBytes(*part.UniqueGUID)
+	if err != nil {
+		return fmt.Errorf("gpt: %v", err)
+	}
+
+	primary, err := p.ReadGPT(1)
+	if err != nil {
+		return err
+	}
+	backup, err := p.ReadGPT(primary.AlternateLBA)
+	if err != nil {
+		return err
+	}
+	for _, gpt := range []*GPT{primary, backup} {
+		entry := gpt.Entry(*part.Number)
+		if entry == nil {
+			return fmt.Errorf("gpt: No entry for partition %d", *part.Number)
+		}
+		copy(entry[0:16], typeGUID)
+		copy(entry[16:32], uniqueGUID)
+		binary.LittleEndian.PutUint64(entry[48:], *part.Attributes)
+	}
+	//The backup goes first, so a failure part way leaves a primary that parted and the kernel still trust
+	if err := p.writeGPT(backup); err != nil {
+		return fmt.Errorf("gpt: Failed to write backup GPT: %v", err)
+	}
+	if err := p.writeGPT(primary); err != nil {
+		return fmt.Errorf("gpt: Failed to write primary GPT: %v", err)
+	}
+	if err := p.WriteFile.Sync(); err != nil {
+		return fmt.Errorf("gpt: Failed to sync disk: %v", err)
+	}
+
+	//The kernel only needs the boundaries, which haven't changed, so a busy disk refusing this is fine
+	if err := p.RereadPartitions(); err != nil {
+		debug("gpt: Kernel didn't reread partition table of %s: %v", p.Config.Disk, err)
+	}
+	return nil
+}
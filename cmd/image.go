@@ -0,0 +1,416 @@
+package main
+
+import (
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compression of partition images, detected from their magic when flashing.
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+var (
+	imageSparse   = false // Dump partitions as sparse images, set by the --sparse flag
+	imageCompress = ""    // Compression of dumped images, set by the --compress flag, from the extension if empty
+	imageZip      = ""    // The zip being flashed, which relative image paths in the config are read from
+)
+
+// The compression an image file name asks for by its extension.
+func imageCompression(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return compressGzip
+	case strings.HasSuffix(path, ".zst"):
+		return compressZstd
+	}
+	return compressNone
+}
+
+// An Image is a partition image being read, with its compression undone.
+type Image struct {
+	Compression string
+	Sparse      bool
+
+	r       *bufio.Reader
+	size    int64       //The size of the file itself
+	closers []io.Closer //Closed last first
+}
+
+// OpenImage opens a partition image for reading, detecting gzip and zstd compression and sparse images. When
+// flashing a zip, relative paths are read from inside it as they're written, so images never have to fit in RAM.
+func OpenImage(path string) (*Image, error) {
+	img := &Image{Compression: compressNone, closers: make([]io.Closer, 0)}
+	if imageZip != "" && !filepath.IsAbs(path) {
+		z, err := zip.OpenReader(imageZip)
+		if err != nil {
+			return nil, fmt.Errorf("image: Failed to open zip %s: %v", imageZip, err)
+		}
+		img.closers = append(img.closers, z)
+		f, err := z.Open(filepath.ToSlash(filepath.Clean(path)))
+		if err != nil {
+			img.Close()
+			return nil, fmt.Errorf("image: Failed to find %s in %s: %v", path, imageZip, err)
+		}
+		img.closers = append(img.closers, f)
+		info, err := f.Stat()
+		if err != nil {
+			img.Close()
+			return nil, fmt.Errorf("image: Failed to stat %s in %s: %v", path, imageZip, err)
+		}
+		img.size = info.Size()
+		img.r = bufio.NewReader(f)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("image: Failed to open %s: %v", path, err)
+		}
+		img.closers = append(img.closers, f)
+		info, err := f.Stat()
+		if err != nil {
+			img.Close()
+			return nil, fmt.Errorf("image: Failed to stat %s: %v", path, err)
+		}
+		img.size = info.Size()
+		img.r = bufio.NewReader(f)
+	}
+
+	magic, _ := img.r.Peek(4)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(img.r)
+		if err != nil {
+			img.Close()
+			return nil, fmt.Errorf("image: Failed to read gzip header of %s: %v", path, err)
+		}
+		img.Compression = compressGzip
+		img.closers = append(img.closers, gz)
+		img.r = bufio.NewReader(gz)
+	case len(magic) >= 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		zr, err := zstd.NewReader(img.r)
+		if err != nil {
+			img.Close()
+			return nil, fmt.Errorf("image: Failed to read zstd header of %s: %v", path, err)
+		}
+		img.Compression = compressZstd
+		img.closers = append(img.closers, zr.IOReadCloser())
+		img.r = bufio.NewReader(zr)
+	}
+	magic, _ = img.r.Peek(4)
+	img.Sparse = isSparse(magic)
+	return img, nil
+}
+
+func (img *Image) Read(data []byte) (int, error) {
+	return img.r.Read(data)
+}
+
+func (img *Image) Close() error {
+	var err error
+	for i := len(img.closers) - 1; i >= 0; i-- {
+		if closeErr := img.closers[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	img.closers = nil
+	return err
+}
+
+// ImageSize returns the size of a partition image once it's expanded. Sparse images say so in their header and
+// raw ones have the size of their file, but compressed raw images have to be read through to find out.
+func ImageSize(path string) (int64, error) {
+	img, err := OpenImage(path)
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+	if img.Sparse {
+		sr, err := NewSparseReader(img)
+		if err != nil {
+			return 0, err
+		}
+		return sr.Header.Size(), nil
+	}
+	if img.Compression == compressNone {
+		return img.size, nil
+	}
+	size, err := io.Copy(io.Discard, img)
+	if err != nil {
+		return 0, fmt.Errorf("image: Failed to decompress %s: %v", path, err)
+	}
+	return size, nil
+}
+
+// Write length bytes read from r to the partition, starting at offset within it.
+func (part *Partition) writeFrom(r io.Reader, offset, length int64, pr *Progress) error {
+	p := part.Parted
+	buf := make([]byte, hashChunk)
+	for done := int64(0); done < length; {
+		count := length - done
+		if count > hashChunk {
+			count = hashChunk
+		}
+		read, err := io.ReadFull(r, buf[:count])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return fmt.Errorf("Failed to read image at offset %d: %v", offset+done, err)
+		}
+		if read == 0 {
+			return fmt.Errorf("Image ended at offset %d, %d bytes short", offset+done, length-done)
+		}
+		if err := p.WriteDisk(*part.Start+offset+done, buf[:read]); err != nil {
+			return err
+		}
+		done += int64(read)
+		if pr != nil {
+			pr.Add(int64(read))
+		}
+	}
+	return nil
+}
+
+// Write length bytes of a repeated 4 byte pattern to the partition, starting at offset within it.
+func (part *Partition) writeFill(fill [4]byte, offset, length int64, pr *Progress) error {
+	buf := make([]byte, hashChunk)
+	for i := 0; i < len(buf); i += 4 {
+		copy(buf[i:], fill[:])
+	}
+	for done := int64(0); done < length; {
+		count := length - done
+		if count > hashChunk {
+			count = hashChunk
+		}
+		if err := part.Parted.WriteDisk(*part.Start+offset+done, buf[:count]); err != nil {
+			return err
+		}
+		done += count
+		if pr != nil {
+			pr.Add(count)
+		}
+	}
+	return nil
+}
+
+// Flash writes an image to the partition, which must be big enough for it. Sparse images only write the blocks
+// they hold, leaving the rest of the partition as it was. The disk must already allow writes to the partition.
+func (part *Partition) Flash(path string) error {
+	size, err := ImageSize(path)
+	if err != nil {
+		return fmt.Errorf("flash: %v", err)
+	}
+	if size > part.GetSize() {
+		return fmt.Errorf("flash: Image %s of %s doesn't fit in %s of %s", path, bytes(size), part.GetName(), bytes(part.GetSize()))
+	}
+
+	img, err := OpenImage(path)
+	if err != nil {
+		return fmt.Errorf("flash: %v", err)
+	}
+	defer img.Close()
+	kind := "raw"
+	if img.Sparse {
+		kind = "sparse"
+	}
+	debug("flash: %s is a %s image of %s (compression: %s)", path, kind, bytes(size), img.Compression)
+
+	pr := NewProgress("flash", part.GetName(), size, true)
+	if img.Sparse {
+		sr, err := NewSparseReader(img)
+		if err != nil {
+			return fmt.Errorf("flash: %v", err)
+		}
+		for {
+			chunk, err := sr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("flash: %v", err)
+			}
+			switch chunk.Type {
+			case sparseChunkRaw:
+				err = part.writeFrom(chunk.Data, chunk.Offset, chunk.Length, pr)
+			case sparseChunkFill:
+				err = part.writeFill(chunk.Fill, chunk.Offset, chunk.Length, pr)
+			case sparseChunkDontCare:
+				pr.Add(chunk.Length)
+			}
+			if err != nil {
+				return fmt.Errorf("flash: %v", err)
+			}
+		}
+	} else if err := part.writeFrom(img, 0, size, pr); err != nil {
+		return fmt.Errorf("flash: %v", err)
+	}
+
+	if p := part.Parted; p.WriteFile != nil {
+		if err := p.WriteFile.Sync(); err != nil {
+			return fmt.Errorf("flash: Failed to sync %s: %v", p.Config.Disk, err)
+		}
+	}
+	pr.Finish()
+	return nil
+}
+
+// Dump saves the contents of the partition to an image, compressed with gzip or zstd or not at all. Sparse images
+// leave out the space the partition's filesystem doesn't use, if it can tell.
+func (part *Partition) Dump(path string, sparse bool, compression string) error {
+	size := part.GetSize()
+	extents := []Extent{{Offset: 0, Length: size}}
+	blockSize := int64(4096)
+	if sparse {
+		if size%blockSize != 0 {
+			blockSize = 512
+		}
+		if size%blockSize != 0 {
+			return fmt.Errorf("dump: %s of %d bytes isn't a whole number of blocks", part.GetName(), size)
+		}
+		allocated, err := part.AllocatedExtents()
+		if err != nil {
+			warn("dump: Failed to read allocation map of %s, dumping all of it: %v", part.GetName(), err)
+		} else if allocated != nil {
+			extents = alignExtents(allocated, blockSize, size)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("dump: Failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	var compressor io.WriteCloser
+	switch compression {
+	case compressGzip:
+		compressor = gzip.NewWriter(f)
+	case compressZstd:
+		compressor, err = zstd.NewWriter(f)
+		if err != nil {
+			return fmt.Errorf("dump: Failed to start zstd: %v", err)
+		}
+	case compressNone, "":
+	default:
+		return fmt.Errorf("dump: Unknown compression %s", compression)
+	}
+	if compressor != nil {
+		w = compressor
+	}
+
+	total := int64(0)
+	for i := 0; i < len(extents); i++ {
+		total += extents[i].Length
+	}
+	pr := NewProgress("dump", part.GetName(), total, true)
+	src := io.NewSectionReader(part.Parted.File, *part.Start, size)
+	if sparse {
+		err = writeSparseImage(w, src, size, blockSize, extents, pr)
+	} else {
+		_, err = io.Copy(w, io.TeeReader(src, progressWriter{pr}))
+	}
+	if err != nil {
+		return fmt.Errorf("dump: Failed to write %s: %v", path, err)
+	}
+
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return fmt.Errorf("dump: Failed to finish %s compression of %s: %v", compression, path, err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("dump: Failed to sync %s: %v", path, err)
+	}
+	pr.Finish()
+	return nil
+}
+
+// A progressWriter counts the bytes written through it as progress.
+type progressWriter struct {
+	pr *Progress
+}
+
+func (pw progressWriter) Write(data []byte) (int, error) {
+	pw.pr.Add(int64(len(data)))
+	return len(data), nil
+}
+
+// Grow extents out to whole blocks, without going past size, and join any that then touch.
+func alignExtents(extents []Extent, blockSize, size int64) []Extent {
+	aligned := make([]Extent, len(extents))
+	for i := 0; i < len(extents); i++ {
+		start := extents[i].Offset / blockSize * blockSize
+		end := (extents[i].Offset + extents[i].Length + blockSize - 1) / blockSize * blockSize
+		if end > size {
+			end = size
+		}
+		aligned[i] = Extent{Offset: start, Length: end - start}
+	}
+	return mergeExtents(aligned)
+}
+
+// The largest raw chunk written to sparse images, well under the 4GiB a chunk header can describe.
+const sparseMaxRaw = 64 * 1024 * 1024
+
+// Write a sparse image of size bytes read from src, with raw chunks for the extents and don't care chunks between.
+func writeSparseImage(w io.Writer, src io.ReaderAt, size, blockSize int64, extents []Extent, pr *Progress) error {
+	split := make([]Extent, 0, len(extents))
+	for i := 0; i < len(extents); i++ {
+		for offset := int64(0); offset < extents[i].Length; offset += sparseMaxRaw {
+			length := extents[i].Length - offset
+			if length > sparseMaxRaw {
+				length = sparseMaxRaw
+			}
+			split = append(split, Extent{Offset: extents[i].Offset + offset, Length: length})
+		}
+	}
+	extents = split
+
+	chunks := 0
+	pos := int64(0)
+	for i := 0; i <= len(extents); i++ {
+		end := size
+		if i < len(extents) {
+			end = extents[i].Offset
+		}
+		if end > pos {
+			chunks++
+		}
+		if i < len(extents) {
+			chunks++
+			pos = extents[i].Offset + extents[i].Length
+		}
+	}
+
+	sw, err := NewSparseWriter(w, blockSize, size/blockSize, chunks)
+	if err != nil {
+		return err
+	}
+	pos = 0
+	for i := 0; i <= len(extents); i++ {
+		end := size
+		if i < len(extents) {
+			end = extents[i].Offset
+		}
+		if end > pos {
+			if err := sw.DontCare(end - pos); err != nil {
+				return err
+			}
+		}
+		if i < len(extents) {
+			r := io.NewSectionReader(src, extents[i].Offset, extents[i].Length)
+			if err := sw.Raw(io.TeeReader(r, progressWriter{pr}), extents[i].Length); err != nil {
+				return err
+			}
+			pos = extents[i].Offset + extents[i].Length
+		}
+	}
+	return sw.Close()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A Placement is where the layout puts a reserved or userdata partition, next to where it is now.
+type Placement struct {
+	Config   *Partition //The partition in the config
+	Actual   *Partition //The partition on the disk, nil if it will be created
+	Old      Extent     //Where the partition is now, empty if it will be created
+	Start    int64
+	Size     int64
+	UserData bool
+}
+
+// Name returns the name of the partition.
+func (pl *Placement) Name() string {
+	return pl.Config.GetName()
+}
+
+// Moves reports whether the partition starts somewhere else than it does now.
+func (pl *Placement) Moves() bool {
+	return pl.Actual != nil && pl.Start != pl.Old.Offset
+}
+
+// Changes reports whether the partition on the disk moves or changes size.
+func (pl *Placement) Changes() bool {
+	return pl.Actual != nil && (pl.Moves() || pl.Size != pl.Old.Length)
+}
+
+// Extent returns where the partition will be.
+func (pl *Placement) Extent() Extent {
+	return Extent{Offset: pl.Start, Length: pl.Size}
+}
+
+// Whether the partition is, or will be created as, a logical partition of an MBR, which needs room for its EBR.
+func (pl *Placement) logical() bool {
+	if pl.Actual != nil && pl.Actual.Kind != nil {
+		return *pl.Actual.Kind == kindLogical
+	}
+	return pl.Config.Kind != nil && *pl.Config.Kind == kindLogical
+}
+
+// Whether two extents share any bytes.
+func extentsOverlap(a, b Extent) bool {
+	return a.Offset < b.Offset+b.Length && b.Offset < a.Offset+a.Length
+}
+
+func alignUp(offset, align int64) int64 {
+	return (offset + align - 1) / align * align
+}
+
+func alignDown(offset, align int64) int64 {
+	return offset / align * align
+}
+
+// PlanLayout works out where every reserved and userdata partition goes. The reserved partitions are laid out in
+// their configured order, which for slotted partitions is the order ExpandSlots put them in, and the userdata
+// partitions stay on the side of them they're on now. They share the space they take up now along with any free
+// space next to it, and nothing outside that space is touched. Earlier userdata partitions keep their size and the
+// last one takes whatever is left, so it makes up for every other partition that grows, shrinks or is created.
+//
+// Partitions stay where they are when they can, and only close up gaps when userdata would otherwise have to give
+// up more than it needs to.
+func (dp *DiskPlan) PlanLayout() error {
+	p := dp.Parted
+	align := p.SectorSizePhysical
+	if p.SectorSizeLogical > align {
+		align = p.SectorSizeLogical
+	}
+	if align <= 0 {
+		align = 512
+	}
+
+	reserved := make([]*Placement, 0)
+	userData := make([]*Placement, 0)
+	involved := make(map[*Partition]bool)
+	for i := 0; i < len(dp.Reserved); i++ {
+		pl := &Placement{Config: dp.Reserved[i], Actual: p.GetPartition(false, dp.Reserved[i]), Size: dp.Reserved[i].GetSize()}
+		reserved = append(reserved, pl)
+	}
+	for i := 0; i < len(dp.UserData); i++ {
+		pl := &Placement{Config: p.Config.UserData[i], Actual: dp.UserData[i], Size: dp.UserData[i].GetSize(), UserData: true}
+		userData = append(userData, pl)
+	}
+	placements := append(append(make([]*Placement, 0), reserved...), userData...)
+	for i := 0; i < len(placements); i++ {
+		if placements[i].Actual != nil {
+			placements[i].Old = Extent{Offset: *placements[i].Actual.Start, Length: placements[i].Actual.GetSize()}
+			involved[placements[i].Actual] = true
+		}
+	}
+
+	//The space to lay out is everything from the first to the last partition involved, and free space either side
+	entries := make([]*Partition, len(p.Partitions))
+	copy(entries, p.Partitions)
+	sort.SliceStable(entries, func(i, j int) bool { return *entries[i].Start < *entries[j].Start })
+	free := func(part *Partition) bool {
+		return *part.Number == 0 && *part.FS == "Free Space"
+	}
+	first, last := -1, -1
+	for i := 0; i < len(entries); i++ {
+		if involved[entries[i]] {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return fmt.Errorf("None of the reserved or userdata partitions are on the disk, so there's nowhere to put them")
+	}
+	for first > 0 && free(entries[first-1]) {
+		first--
+	}
+	for last < len(entries)-1 && free(entries[last+1]) {
+		last++
+	}
+	for i := first; i <= last; i++ {
+		part := entries[i]
+		if involved[part] || free(part) || *part.Number == 0 || (part.Kind != nil && *part.Kind == kindExtended) {
+			continue
+		}
+		return fmt.Errorf("Partition %s (%d) lies between the partitions the plan changes, which must all be next to each other", part.GetName(), *part.Number)
+	}
+	regionStart := *entries[first].Start
+	regionEnd := *entries[last].End + 1
+	debug("Laying out %d partitions from %d to %d, aligned to %d bytes", len(placements), regionStart, regionEnd-1, align)
+
+	//Userdata goes after the reserved partitions, unless it's in front of them now
+	items := append(append(make([]*Placement, 0), reserved...), userData...)
+	flexible := -1
+	if len(userData) > 0 {
+		flexible = len(items) - 1
+		userDataFirst := false
+		for i := 0; i < len(reserved); i++ {
+			if reserved[i].Actual != nil {
+				userDataFirst = userData[0].Old.Offset < reserved[i].Old.Offset
+				break
+			}
+		}
+		if userDataFirst {
+			items = append(append(make([]*Placement, 0), userData...), reserved...)
+			flexible = len(userData) - 1
+		}
+	}
+
+	//Lay out the partitions in front of the flexible one forwards from the start, and the rest backwards from the
+	//end, then give the flexible one what's between them
+	layout := func(sticky bool) ([]int64, int64, error) {
+		starts := make([]int64, len(items))
+		cursor := regionStart
+		forward := len(items)
+		if flexible >= 0 {
+			forward = flexible
+		}
+		for i := 0; i < forward; i++ {
+			if items[i].logical() {
+				cursor += p.SectorSizeLogical //Room for its EBR
+			}
+			starts[i] = alignUp(cursor, align)
+			if sticky && items[i].Actual != nil && items[i].Old.Offset >= cursor {
+				starts[i] = items[i].Old.Offset
+			}
+			cursor = starts[i] + items[i].Size
+		}
+		if flexible < 0 {
+			if cursor > regionEnd {
+				return nil, 0, fmt.Errorf("The reserved partitions need %s more than the %s they can have", bytes(cursor-regionEnd), bytes(regionEnd-regionStart))
+			}
+			return starts, 0, nil
+		}
+
+		end := regionEnd
+		for i := len(items) - 1; i > flexible; i-- {
+			starts[i] = alignDown(end-items[i].Size, align)
+			if sticky && items[i].Actual != nil && items[i].Old.Offset+items[i].Size <= end {
+				starts[i] = items[i].Old.Offset
+			}
+			end = starts[i]
+			if items[i].logical() {
+				end -= p.SectorSizeLogical
+			}
+		}
+		if items[flexible].logical() {
+			cursor += p.SectorSizeLogical
+		}
+		starts[flexible] = alignUp(cursor, align)
+		if sticky && items[flexible].Old.Offset >= cursor {
+			starts[flexible] = items[flexible].Old.Offset
+		}
+		size := alignDown(end-starts[flexible], p.SectorSizeLogical)
+		if size <= 0 {
+			return nil, 0, fmt.Errorf("Userdata partition %s would be left with no space, the other partitions need %s more than there is", items[flexible].Name(), bytes(-size))
+		}
+		return starts, size, nil
+	}
+
+	//Closing up the gaps moves partitions, so only do it when staying put would cost userdata space it needs
+	starts, flexSize, err := layout(true)
+	packedStarts, packedSize, packedErr := layout(false)
+	if packedErr != nil {
+		return packedErr
+	}
+	if err != nil || (flexible >= 0 && flexSize < packedSize && flexSize < items[flexible].Old.Length) {
+		starts, flexSize = packedStarts, packedSize
+	}
+	for i := 0; i < len(items); i++ {
+		items[i].Start = starts[i]
+	}
+	if flexible >= 0 {
+		items[flexible].Size = flexSize
+	}
+
+	for i := 0; i < len(placements); i++ {
+		pl := placements[i]
+		if pl.Config.Start != nil && *pl.Config.Start != pl.Start {
+			return fmt.Errorf("Partition %s is configured to start at %d, but the layout puts it at %d", pl.Name(), *pl.Config.Start, pl.Start)
+		}
+		debug("Layout: %s at %d, %s", pl.Name(), pl.Start, bytes(pl.Size))
+	}
+	dp.Placements = placements
+	return nil
+}
+
+// ScheduleMoves works out an order for the partitions that move or grow, after every partition that shrinks has
+// done so in place, in which each one only ever lands on space no other partition holds by then. There's no such
+// order when partitions swap places, so the plan fails instead of overwriting anything.
+func (dp *DiskPlan) ScheduleMoves() error {
+	current := make(map[*Placement]Extent)
+	pending := make([]*Placement, 0)
+	for i := 0; i < len(dp.Placements); i++ {
+		pl := dp.Placements[i]
+		if pl.Actual == nil {
+			continue
+		}
+		now := pl.Old
+		if pl.Size < now.Length {
+			now.Length = pl.Size
+		}
+		current[pl] = now
+		if pl.Moves() || pl.Size > pl.Old.Length {
+			pending = append(pending, pl)
+		}
+	}
+
+	//Find what's in the way of a partition, other than itself, as things are at this point
+	blocker := func(pl *Placement, dest Extent) *Placement {
+		for i := 0; i < len(dp.Placements); i++ {
+			other := dp.Placements[i]
+			if other == pl {
+				continue
+			}
+			if now, ok := current[other]; ok && extentsOverlap(now, dest) {
+				return other
+			}
+		}
+		return nil
+	}
+
+	dp.Move = make([]*Placement, 0)
+	for len(pending) > 0 {
+		moved := false
+		for i := 0; i < len(pending); i++ {
+			pl := pending[i]
+			if blocker(pl, pl.Extent()) != nil {
+				continue
+			}
+			current[pl] = pl.Extent()
+			dp.Move = append(dp.Move, pl)
+			pending = append(pending[:i], pending[i+1:]...)
+			i--
+			moved = true
+		}
+		if !moved {
+			return fmt.Errorf("No order of moves gets %s to %d without overwriting %s first", pending[0].Name(), pending[0].Start, blocker(pending[0], pending[0].Extent()).Name())
+		}
+	}
+
+	for i := 0; i < len(dp.Create); i++ {
+		if other := blocker(dp.Create[i], dp.Create[i].Extent()); other != nil {
+			return fmt.Errorf("Partition %s can't be created at %d, %s is still there", dp.Create[i].Name(), dp.Create[i].Start, other.Name())
+		}
+	}
+	return nil
+}
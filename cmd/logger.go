@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "unknown"
+	}
+	return levelNames[level]
+}
+
+// ParseLogLevel returns the log level with the given name, such as "warn".
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i := 0; i < len(levelNames); i++ {
+		if strings.EqualFold(levelNames[i], name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %s", name)
+}
+
+var (
+	logLevel = LevelInfo // The minimum level printed to the console, the log file always receives everything
+	logRun = false // Whether to write full Run transcripts to the log file
+	logFile *os.File // The persistent log file, if any
+	logBacklog = make([]string, 0) // Lines logged before the log file was opened
+)
+
+// Open the persistent log file in append mode, creating its directory if needed.
+// Anything logged before the file was opened is written to it first.
+func openLog(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Failed to create log directory for %s: %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open log file %s: %v", path, err)
+	}
+	logFile = f
+	for i := 0; i < len(logBacklog); i++ {
+		logFile.WriteString(logBacklog[i])
+	}
+	logBacklog = nil
+	return nil
+}
+
+// Flush the log file to disk, so it survives a reboot straight after reparted exits.
+func syncLog() {
+	if logFile != nil {
+		logFile.Sync()
+	}
+}
+
+func closeLog() {
+	if logFile != nil {
+		logFile.Sync()
+		logFile.Close()
+		logFile = nil
+	}
+}
+
+// Write a line to the log file with a timestamp and level, or keep it until the log file is opened.
+func logToFile(level LogLevel, msg string) {
+	line := fmt.Sprintf("%s %-5s %s\n", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), strings.ToUpper(level.String()), msg)
+	if logFile != nil {
+		logFile.WriteString(line)
+	} else if logBacklog != nil {
+		logBacklog = append(logBacklog, line)
+	}
+}
+
+// Log a message at the given level to the console and the log file.
+func logAt(level LogLevel, msg ...interface{}) {
+	if len(msg) == 0 {
+		return
+	}
+	logMsg := msg[0].(string)
+	if len(msg) > 1 {
+		logMsg = fmt.Sprintf(logMsg, msg[1:]...)
+	}
+	logMsg = strings.TrimRight(logMsg, "\n")
+
+	logToFile(level, logMsg)
+	if level < logLevel {
+		return
+	}
+	recoveryPrint(logMsg)
+	if outputMode == outputJSON {
+		emit(&Event{Type: "log", Time: time.Now(), Level: level.String(), Message: logMsg})
+		return
+	}
+	if level != LevelInfo {
+		logMsg = "[" + strings.ToUpper(level.String()) + "] " + logMsg
+	}
+	fmt.Println(logPrefix + logMsg)
+}
+
+// Print a debug message, hidden from the console unless --log-level is debug.
+func debug(msg ...interface{}) {
+	logAt(LevelDebug, msg...)
+}
+
+// Print a warning message.
+func warn(msg ...interface{}) {
+	logAt(LevelWarn, msg...)
+}
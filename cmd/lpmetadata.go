@@ -0,0 +1,734 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The layout of Android dynamic partition (LP) metadata at the start of the super partition, from liblp's
+// metadata_format.h. Every size and offset inside the metadata is in 512 byte sectors.
+const (
+	lpReservedBytes  = 4096
+	lpGeometrySize   = 4096
+	lpGeometryMagic  = 0x616c4467
+	lpHeaderMagic    = 0x414c5030
+	lpMajorVersion   = 10
+	lpSectorSize     = 512
+	lpTargetLinear   = 0
+	lpTargetZero     = 1
+	lpHeaderSizeV1_0 = 128
+)
+
+// The sizes of the table entries reparted writes for new entries. Existing entries keep the size they had.
+const (
+	lpPartitionEntrySize   = 52
+	lpExtentEntrySize      = 24
+	lpGroupEntrySize       = 48
+	lpBlockDeviceEntrySize = 64
+)
+
+// SuperConfig describes the dynamic partitions to resize inside super, set with "super" in the config.
+type SuperConfig struct {
+	Name       string       `json:"name"`       //Name of the partition holding the metadata, "super" if not set
+	Partitions []*Partition `json:"partitions"` //Logical partitions to resize, by name, with "wipe" to allow losing their data
+}
+
+// LpGeometry is the fixed part of the metadata, saying where the metadata slots are and how big they can be.
+type LpGeometry struct {
+	MetadataMaxSize   int64
+	MetadataSlotCount int64
+	LogicalBlockSize  int64
+}
+
+// LpMetadata is one copy of the metadata. The raw bytes of every entry are kept, so fields reparted doesn't know
+// about survive being written back.
+type LpMetadata struct {
+	Geometry     *LpGeometry
+	Header       []byte
+	Partitions   []*LpPartition
+	Groups       []*LpGroup
+	BlockDevices []*LpBlockDevice
+}
+
+// An LpPartition is a logical partition and the extents it's made of, in order.
+type LpPartition struct {
+	Name       string
+	Attributes uint32
+	Group      uint32
+	Extents    []*LpExtent
+	raw        []byte
+}
+
+// An LpExtent maps a run of sectors of a logical partition to sectors of a block device, or to zeroes.
+type LpExtent struct {
+	NumSectors   uint64
+	TargetType   uint32
+	TargetData   uint64 //The first sector on the block device for linear extents
+	TargetSource uint32 //The index of the block device
+	raw          []byte
+}
+
+// An LpGroup limits the total size of the logical partitions in it.
+type LpGroup struct {
+	Name        string
+	Flags       uint32
+	MaximumSize uint64 //0 for no limit
+	raw         []byte
+}
+
+// An LpBlockDevice is a partition logical partitions are allocated from, normally just super itself.
+type LpBlockDevice struct {
+	FirstLogicalSector uint64
+	Alignment          uint32
+	AlignmentOffset    uint32
+	Size               uint64
+	PartitionName      string
+	Flags              uint32
+	raw                []byte
+}
+
+// LpSuper is the super partition and the metadata planned for it.
+type LpSuper struct {
+	Part     *Partition   //The actual super partition
+	Slot     int          //The metadata slot that was read
+	Metadata *LpMetadata  //The metadata as it will be written
+	Logical  []*Partition //The logical partitions as they are now, readable through their old extents
+	Size     int64        //The size super will have
+	Replaced []int        //Other metadata slots that differ from Slot, which writing the metadata replaces
+}
+
+// Return a NUL padded string field as a string.
+func lpString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Check the SHA-256 checksum at offset sum of a structure, which is computed with the checksum zeroed.
+func lpChecksum(data []byte, sum int) [sha256.Size]byte {
+	check := make([]byte, len(data))
+	copy(check, data)
+	for i := 0; i < sha256.Size; i++ {
+		check[sum+i] = 0
+	}
+	return sha256.Sum256(check)
+}
+
+// Read the geometry from its primary copy, falling back to the backup.
+func readLpGeometry(super *Partition) (*LpGeometry, error) {
+	var lastErr error
+	for _, offset := range []int64{lpReservedBytes, lpReservedBytes + lpGeometrySize} {
+		data, err := readExact(super, offset, 52)
+		if err != nil {
+			return nil, err
+		}
+		le := binary.LittleEndian
+		if data == nil || le.Uint32(data[0:]) != lpGeometryMagic {
+			lastErr = fmt.Errorf("lp: No metadata geometry on %s at offset %d", super.GetName(), offset)
+			continue
+		}
+		size := le.Uint32(data[4:])
+		if size != 52 {
+			lastErr = fmt.Errorf("lp: Unsupported geometry size %d on %s", size, super.GetName())
+			continue
+		}
+		sum := lpChecksum(data, 8)
+		if string(sum[:]) != string(data[8:40]) {
+			lastErr = fmt.Errorf("lp: Geometry checksum mismatch on %s at offset %d", super.GetName(), offset)
+			continue
+		}
+		return &LpGeometry{
+			MetadataMaxSize:   int64(le.Uint32(data[40:])),
+			MetadataSlotCount: int64(le.Uint32(data[44:])),
+			LogicalBlockSize:  int64(le.Uint32(data[48:])),
+		}, nil
+	}
+	return nil, lastErr
+}
+
+// The offsets of the primary and backup copies of a metadata slot within super.
+func (geo *LpGeometry) slotOffsets(slot int) (int64, int64) {
+	primary := int64(lpReservedBytes+lpGeometrySize*2) + int64(slot)*geo.MetadataMaxSize
+	backup := int64(lpReservedBytes+lpGeometrySize*2) + geo.MetadataMaxSize*geo.MetadataSlotCount + int64(slot)*geo.MetadataMaxSize
+	return primary, backup
+}
+
+// Find the metadata slots that don't hold the same metadata as the one being kept. The new metadata is written to
+// all of them, so whatever they held instead, such as a Virtual A/B update in progress, is lost.
+func (super *Partition) differingLpSlots(m *LpMetadata, slot int) ([]int, error) {
+	differ := make([]int, 0)
+	want, err := m.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	for other := 0; other < int(m.Geometry.MetadataSlotCount); other++ {
+		if other == slot {
+			continue
+		}
+		om, err := super.ReadLpMetadata(other)
+		if err != nil {
+			debug("lp: Metadata slot %d of %s can't be read: %v", other, super.GetName(), err)
+			differ = append(differ, other)
+			continue
+		}
+		got, err := om.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		if string(got) != string(want) {
+			differ = append(differ, other)
+		}
+	}
+	return differ, nil
+}
+
+// ReadLpMetadata reads a metadata slot from a super partition, from its primary copy or, if that's damaged, its
+// backup.
+func (super *Partition) ReadLpMetadata(slot int) (*LpMetadata, error) {
+	geo, err := readLpGeometry(super)
+	if err != nil {
+		return nil, err
+	}
+	if int64(slot) >= geo.MetadataSlotCount {
+		return nil, fmt.Errorf("lp: Metadata slot %d doesn't exist, %s has %d", slot, super.GetName(), geo.MetadataSlotCount)
+	}
+	primary, backup := geo.slotOffsets(slot)
+	m, err := readLpMetadataAt(super, geo, primary)
+	if err != nil {
+		warn("lp: %v, trying backup", err)
+		m, err = readLpMetadataAt(super, geo, backup)
+	}
+	return m, err
+}
+
+func readLpMetadataAt(super *Partition, geo *LpGeometry, offset int64) (*LpMetadata, error) {
+	le := binary.LittleEndian
+	header, err := readExact(super, offset, lpHeaderSizeV1_0)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil || le.Uint32(header[0:]) != lpHeaderMagic {
+		return nil, fmt.Errorf("No metadata header on %s at offset %d", super.GetName(), offset)
+	}
+	if le.Uint16(header[4:]) != lpMajorVersion {
+		return nil, fmt.Errorf("Unsupported metadata version %d.%d on %s", le.Uint16(header[4:]), le.Uint16(header[6:]), super.GetName())
+	}
+	headerSize := int64(le.Uint32(header[8:]))
+	tablesSize := int64(le.Uint32(header[44:]))
+	if headerSize < lpHeaderSizeV1_0 || headerSize+tablesSize > geo.MetadataMaxSize {
+		return nil, fmt.Errorf("Invalid metadata sizes on %s at offset %d", super.GetName(), offset)
+	}
+	if headerSize > lpHeaderSizeV1_0 {
+		if header, err = readExact(super, offset, headerSize); header == nil || err != nil {
+			return nil, fmt.Errorf("Failed to read metadata header on %s at offset %d: %v", super.GetName(), offset, err)
+		}
+	}
+	sum := lpChecksum(header, 12)
+	if string(sum[:]) != string(header[12:44]) {
+		return nil, fmt.Errorf("Metadata header checksum mismatch on %s at offset %d", super.GetName(), offset)
+	}
+	tables, err := readExact(super, offset+headerSize, tablesSize)
+	if tables == nil || err != nil {
+		return nil, fmt.Errorf("Failed to read metadata tables on %s at offset %d: %v", super.GetName(), offset, err)
+	}
+	sum = sha256.Sum256(tables)
+	if string(sum[:]) != string(header[48:80]) {
+		return nil, fmt.Errorf("Metadata tables checksum mismatch on %s at offset %d", super.GetName(), offset)
+	}
+
+	//Each table descriptor is an offset into the tables, an entry count and an entry size
+	table := func(desc int, minSize int) ([][]byte, error) {
+		tableOffset := int64(le.Uint32(header[desc:]))
+		count := int64(le.Uint32(header[desc+4:]))
+		size := int64(le.Uint32(header[desc+8:]))
+		if size < int64(minSize) || tableOffset+count*size > tablesSize {
+			return nil, fmt.Errorf("Invalid metadata table at header offset %d on %s", desc, super.GetName())
+		}
+		entries := make([][]byte, count)
+		for i := int64(0); i < count; i++ {
+			entries[i] = tables[tableOffset+i*size : tableOffset+(i+1)*size]
+		}
+		return entries, nil
+	}
+	partitions, err := table(80, lpPartitionEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	extents, err := table(92, lpExtentEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := table(104, lpGroupEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	blockDevices, err := table(116, lpBlockDeviceEntrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &LpMetadata{Geometry: geo, Header: header}
+	allExtents := make([]*LpExtent, len(extents))
+	for i := 0; i < len(extents); i++ {
+		e := extents[i]
+		allExtents[i] = &LpExtent{NumSectors: le.Uint64(e[0:]), TargetType: le.Uint32(e[8:]), TargetData: le.Uint64(e[12:]), TargetSource: le.Uint32(e[20:]), raw: e}
+	}
+	for i := 0; i < len(partitions); i++ {
+		e := partitions[i]
+		part := &LpPartition{Name: lpString(e[0:36]), Attributes: le.Uint32(e[36:]), Group: le.Uint32(e[48:]), raw: e}
+		first := int(le.Uint32(e[40:]))
+		count := int(le.Uint32(e[44:]))
+		if first+count > len(allExtents) {
+			return nil, fmt.Errorf("Logical partition %s has extents beyond the extent table on %s", part.Name, super.GetName())
+		}
+		part.Extents = append(part.Extents, allExtents[first:first+count]...)
+		m.Partitions = append(m.Partitions, part)
+	}
+	for i := 0; i < len(groups); i++ {
+		e := groups[i]
+		m.Groups = append(m.Groups, &LpGroup{Name: lpString(e[0:36]), Flags: le.Uint32(e[36:]), MaximumSize: le.Uint64(e[40:]), raw: e})
+	}
+	for i := 0; i < len(blockDevices); i++ {
+		e := blockDevices[i]
+		m.BlockDevices = append(m.BlockDevices, &LpBlockDevice{
+			FirstLogicalSector: le.Uint64(e[0:]),
+			Alignment:          le.Uint32(e[8:]),
+			AlignmentOffset:    le.Uint32(e[12:]),
+			Size:               le.Uint64(e[16:]),
+			PartitionName:      lpString(e[24:60]),
+			Flags:              le.Uint32(e[60:]),
+			raw:                e,
+		})
+	}
+	return m, nil
+}
+
+// Partition returns the logical partition with the given name, or nil.
+func (m *LpMetadata) Partition(name string) *LpPartition {
+	for i := 0; i < len(m.Partitions); i++ {
+		if m.Partitions[i].Name == name {
+			return m.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// Size returns the size of a logical partition in bytes.
+func (lp *LpPartition) Size() int64 {
+	size := int64(0)
+	for i := 0; i < len(lp.Extents); i++ {
+		size += int64(lp.Extents[i].NumSectors) * lpSectorSize
+	}
+	return size
+}
+
+// Return a copy of the extents, which stay as they are when the metadata is changed.
+func (lp *LpPartition) copyExtents() []*LpExtent {
+	extents := make([]*LpExtent, len(lp.Extents))
+	for i := 0; i < len(lp.Extents); i++ {
+		extent := *lp.Extents[i]
+		extents[i] = &extent
+	}
+	return extents
+}
+
+// MinSize returns the smallest size super can have without cutting off the metadata or any extent.
+func (m *LpMetadata) MinSize() int64 {
+	minSize := int64(m.BlockDevices[0].FirstLogicalSector) * lpSectorSize
+	for i := 0; i < len(m.Partitions); i++ {
+		for _, e := range m.Partitions[i].Extents {
+			end := int64(e.TargetData+e.NumSectors) * lpSectorSize
+			if e.TargetType == lpTargetLinear && e.TargetSource == 0 && end > minSize {
+				minSize = end
+			}
+		}
+	}
+	return minSize
+}
+
+// Return the free sector ranges of the first block device, aligned the way liblp aligns new extents.
+func (m *LpMetadata) freeExtents() []Extent {
+	dev := m.BlockDevices[0]
+	used := make([]Extent, 0)
+	for i := 0; i < len(m.Partitions); i++ {
+		for _, e := range m.Partitions[i].Extents {
+			if e.TargetType == lpTargetLinear && e.TargetSource == 0 {
+				used = append(used, Extent{Offset: int64(e.TargetData), Length: int64(e.NumSectors)})
+			}
+		}
+	}
+	used = mergeExtents(used)
+
+	align := int64(dev.Alignment) / lpSectorSize
+	alignOffset := int64(dev.AlignmentOffset) / lpSectorSize
+	alignUp := func(sector int64) int64 {
+		if align <= 1 {
+			return sector
+		}
+		return (sector-alignOffset+align-1)/align*align + alignOffset
+	}
+	free := make([]Extent, 0)
+	start := int64(dev.FirstLogicalSector)
+	end := int64(dev.Size) / lpSectorSize
+	for i := 0; i <= len(used); i++ {
+		gapEnd := end
+		if i < len(used) {
+			gapEnd = used[i].Offset
+		}
+		if gapStart := alignUp(start); gapEnd > gapStart {
+			free = append(free, Extent{Offset: gapStart, Length: gapEnd - gapStart})
+		}
+		if i < len(used) {
+			start = used[i].Offset + used[i].Length
+		}
+	}
+	return free
+}
+
+// ResizePartition changes the size of a logical partition, dropping sectors from its end when it shrinks and
+// allocating free space of super when it grows. Data isn't moved and filesystems aren't resized, so a partition
+// that isn't wiped can only lose space its filesystem doesn't cover, which Preflight checks.
+func (m *LpMetadata) ResizePartition(name string, size int64) error {
+	lp := m.Partition(name)
+	if lp == nil {
+		return fmt.Errorf("lp: Logical partition %s not found", name)
+	}
+	if size%m.Geometry.LogicalBlockSize != 0 {
+		return fmt.Errorf("lp: Size %d of %s is not a multiple of the logical block size %d", size, name, m.Geometry.LogicalBlockSize)
+	}
+	sectors := uint64(size / lpSectorSize)
+	current := uint64(lp.Size() / lpSectorSize)
+
+	if sectors < current {
+		drop := current - sectors
+		for len(lp.Extents) > 0 && drop > 0 {
+			last := lp.Extents[len(lp.Extents)-1]
+			if last.NumSectors > drop {
+				last.NumSectors -= drop
+				break
+			}
+			drop -= last.NumSectors
+			lp.Extents = lp.Extents[:len(lp.Extents)-1]
+		}
+		return nil
+	}
+
+	if int(lp.Group) < len(m.Groups) && m.Groups[lp.Group].MaximumSize > 0 {
+		groupSize := uint64(0)
+		for i := 0; i < len(m.Partitions); i++ {
+			if m.Partitions[i].Group == lp.Group && m.Partitions[i] != lp {
+				groupSize += uint64(m.Partitions[i].Size())
+			}
+		}
+		if groupSize+uint64(size) > m.Groups[lp.Group].MaximumSize {
+			return fmt.Errorf("lp: %s would be %s larger than the limit of group %s", name, bytes(int64(groupSize+uint64(size)-m.Groups[lp.Group].MaximumSize)), m.Groups[lp.Group].Name)
+		}
+	}
+	need := sectors - current
+	free := m.freeExtents()
+	for i := 0; i < len(free) && need > 0; i++ {
+		count := uint64(free[i].Length)
+		if count > need {
+			count = need
+		}
+		//Extend the last extent when the free space follows it directly
+		if n := len(lp.Extents); n > 0 {
+			last := lp.Extents[n-1]
+			if last.TargetType == lpTargetLinear && last.TargetSource == 0 && last.TargetData+last.NumSectors == uint64(free[i].Offset) {
+				last.NumSectors += count
+				need -= count
+				continue
+			}
+		}
+		lp.Extents = append(lp.Extents, &LpExtent{NumSectors: count, TargetType: lpTargetLinear, TargetData: uint64(free[i].Offset)})
+		need -= count
+	}
+	if need > 0 {
+		return fmt.Errorf("lp: Not enough free space in super to grow %s, %s missing", name, bytes(int64(need)*lpSectorSize))
+	}
+	return nil
+}
+
+// ResizeSuper changes the size of the block device the metadata describes, after checking every extent fits.
+func (m *LpMetadata) ResizeSuper(size int64) error {
+	if len(m.BlockDevices) != 1 {
+		return fmt.Errorf("lp: Resizing super spread over %d block devices isn't supported", len(m.BlockDevices))
+	}
+	if minSize := m.MinSize(); size < minSize {
+		return fmt.Errorf("lp: Super can't shrink to %s, logical partitions use %s of it", bytes(size), bytes(minSize))
+	}
+	m.BlockDevices[0].Size = uint64(size)
+	return nil
+}
+
+// Return the raw bytes of an entry to write back, a zeroed entry of the default size for new ones.
+func lpEntry(raw []byte, size int) []byte {
+	entry := make([]byte, size)
+	if raw != nil {
+		entry = make([]byte, len(raw))
+		copy(entry, raw)
+	}
+	return entry
+}
+
+// Bytes serializes the metadata with fresh checksums, laying out the tables the same way liblp does.
+func (m *LpMetadata) Bytes() ([]byte, error) {
+	le := binary.LittleEndian
+	partitions := make([][]byte, 0)
+	extents := make([][]byte, 0)
+	for i := 0; i < len(m.Partitions); i++ {
+		lp := m.Partitions[i]
+		e := lpEntry(lp.raw, lpPartitionEntrySize)
+		le.PutUint32(e[36:], lp.Attributes)
+		le.PutUint32(e[40:], uint32(len(extents)))
+		le.PutUint32(e[44:], uint32(len(lp.Extents)))
+		le.PutUint32(e[48:], lp.Group)
+		partitions = append(partitions, e)
+		for _, extent := range lp.Extents {
+			x := lpEntry(extent.raw, lpExtentEntrySize)
+			le.PutUint64(x[0:], extent.NumSectors)
+			le.PutUint32(x[8:], extent.TargetType)
+			le.PutUint64(x[12:], extent.TargetData)
+			le.PutUint32(x[20:], extent.TargetSource)
+			extents = append(extents, x)
+		}
+	}
+	groups := make([][]byte, 0)
+	for i := 0; i < len(m.Groups); i++ {
+		e := lpEntry(m.Groups[i].raw, lpGroupEntrySize)
+		le.PutUint64(e[40:], m.Groups[i].MaximumSize)
+		groups = append(groups, e)
+	}
+	blockDevices := make([][]byte, 0)
+	for i := 0; i < len(m.BlockDevices); i++ {
+		e := lpEntry(m.BlockDevices[i].raw, lpBlockDeviceEntrySize)
+		le.PutUint64(e[16:], m.BlockDevices[i].Size)
+		blockDevices = append(blockDevices, e)
+	}
+
+	header := make([]byte, len(m.Header))
+	copy(header, m.Header)
+	tables := make([]byte, 0)
+	for i, table := range [][][]byte{partitions, extents, groups, blockDevices} {
+		desc := 80 + i*12
+		size := int(le.Uint32(header[desc+8:]))
+		if len(table) > 0 {
+			size = len(table[0])
+		}
+		le.PutUint32(header[desc:], uint32(len(tables)))
+		le.PutUint32(header[desc+4:], uint32(len(table)))
+		le.PutUint32(header[desc+8:], uint32(size))
+		for j := 0; j < len(table); j++ {
+			if len(table[j]) != size {
+				return nil, fmt.Errorf("lp: Table %d mixes entry sizes %d and %d", i, size, len(table[j]))
+			}
+			tables = append(tables, table[j]...)
+		}
+	}
+	le.PutUint32(header[44:], uint32(len(tables)))
+	sum := sha256.Sum256(tables)
+	copy(header[48:80], sum[:])
+	sum = lpChecksum(header, 12)
+	copy(header[12:44], sum[:])
+
+	data := append(header, tables...)
+	if int64(len(data)) > m.Geometry.MetadataMaxSize {
+		return nil, fmt.Errorf("lp: Metadata needs %d bytes, more than the %d each slot holds", len(data), m.Geometry.MetadataMaxSize)
+	}
+	return data, nil
+}
+
+// An lpReader reads a logical partition through its extents on super.
+type lpReader struct {
+	super   *Partition
+	extents []*LpExtent
+}
+
+func (r *lpReader) ReadAt(buf []byte, offset int64) (int, error) {
+	read := 0
+	pos := int64(0)
+	for i := 0; i < len(r.extents) && read < len(buf); i++ {
+		e := r.extents[i]
+		length := int64(e.NumSectors) * lpSectorSize
+		if offset+int64(read) >= pos+length {
+			pos += length
+			continue
+		}
+		rel := offset + int64(read) - pos
+		count := length - rel
+		if count > int64(len(buf)-read) {
+			count = int64(len(buf) - read)
+		}
+		if e.TargetType == lpTargetLinear {
+			data, err := r.super.Read(int64(e.TargetData)*lpSectorSize+rel, count)
+			if err != nil {
+				return read, err
+			}
+			copy(buf[read:], data)
+			if int64(len(data)) < count {
+				return read + len(data), io.EOF
+			}
+		} else {
+			for j := int64(0); j < count; j++ {
+				buf[read+int(j)] = 0
+			}
+		}
+		read += int(count)
+		pos += length
+	}
+	if read < len(buf) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// PlanSuper reads the metadata of the super partition and applies the logical partition sizes from the config
+// to it, along with the new size of super itself if it's reserved, without writing anything yet.
+func (p *Parted) PlanSuper(slot int) (*LpSuper, error) {
+	cfg := p.Config.Super
+	name := cfg.Name
+	if name == "" {
+		name = "super"
+	}
+	superActual := p.GetPartitionByName(false, name)
+	if superActual == nil {
+		return nil, fmt.Errorf("lp: Super partition %s not found", name)
+	}
+	m, err := superActual.ReadLpMetadata(slot)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.BlockDevices) != 1 {
+		return nil, fmt.Errorf("lp: Super spread over %d block devices isn't supported", len(m.BlockDevices))
+	}
+	super := &LpSuper{Part: superActual, Slot: slot, Metadata: m, Size: superActual.GetSize(), Logical: make([]*Partition, 0)}
+	if super.Replaced, err = superActual.differingLpSlots(m, slot); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(super.Replaced); i++ {
+		logAt(LevelError, "lp: Metadata slot %d of %s differs from slot %d and will be replaced by it, an update in progress will be lost", super.Replaced[i], name, slot)
+	}
+
+	for i := 0; i < len(m.Partitions); i++ {
+		lp := m.Partitions[i]
+		logical := NewPartition(p, 0, 0, lp.Size()-1, fmt.Sprintf("%dB", lp.Size()), "", lp.Name, "")
+		logical.reader = &lpReader{super: superActual, extents: lp.copyExtents()}
+		super.Logical = append(super.Logical, logical)
+	}
+	for i := 0; i < len(cfg.Partitions); i++ {
+		part := cfg.Partitions[i]
+		lp := m.Partition(part.GetName())
+		if lp == nil {
+			return nil, fmt.Errorf("lp: Logical partition %s not found in %s", part.GetName(), name)
+		}
+		super.GetLogical(lp.Name).Wipe = part.Wipe
+		if size := part.GetSize(); size < lp.Size() {
+			if err := m.ResizePartition(lp.Name, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+	//Super grows before the logical partitions do, so they can use the space it gains, and only shrinks once they
+	//have, so it can be checked against what they use in the end
+	size := super.Size
+	if superReserved := p.GetPartition(true, superActual); superReserved != nil {
+		size = superReserved.GetSize()
+	}
+	if size > super.Size {
+		super.Size = size
+		if err := m.ResizeSuper(super.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	//Grow after everything has shrunk, so the space given up can be reused
+	for i := 0; i < len(cfg.Partitions); i++ {
+		part := cfg.Partitions[i]
+		if size := part.GetSize(); size > m.Partition(part.GetName()).Size() {
+			if err := m.ResizePartition(part.GetName(), size); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if size < super.Size {
+		super.Size = size
+		if err := m.ResizeSuper(super.Size); err != nil {
+			return nil, err
+		}
+	}
+	return super, nil
+}
+
+// GetLogical returns a logical partition as it was before any changes, or nil.
+func (super *LpSuper) GetLogical(name string) *Partition {
+	for i := 0; i < len(super.Logical); i++ {
+		if super.Logical[i].GetName() == name {
+			return super.Logical[i]
+		}
+	}
+	return nil
+}
+
+// Write writes the planned metadata to every metadata slot, backups first, then wipes the logical partitions
+// marked with "wipe".
+func (super *LpSuper) Write() error {
+	p := super.Part.Parted
+	data, err := super.Metadata.Bytes()
+	if err != nil {
+		return err
+	}
+	start := *super.Part.Start
+	geo := super.Metadata.Geometry
+	for _, backup := range []bool{true, false} {
+		for slot := 0; slot < int(geo.MetadataSlotCount); slot++ {
+			primaryOffset, backupOffset := geo.slotOffsets(slot)
+			offset := primaryOffset
+			if backup {
+				offset = backupOffset
+			}
+			if err := p.WriteDisk(start+offset, data); err != nil {
+				return fmt.Errorf("lp: Failed to write metadata slot %d: %v", slot, err)
+			}
+		}
+	}
+	if err := p.WriteFile.Sync(); err != nil {
+		return fmt.Errorf("lp: Failed to sync disk: %v", err)
+	}
+	debug("lp: Wrote %d bytes of metadata to %d slots", len(data), geo.MetadataSlotCount)
+
+	for i := 0; i < len(p.Config.Super.Partitions); i++ {
+		part := p.Config.Super.Partitions[i]
+		if !part.Wipe {
+			continue
+		}
+		lp := super.Metadata.Partition(part.GetName())
+		zeroed := int64(0)
+		for _, e := range lp.Extents {
+			if e.TargetType != lpTargetLinear {
+				continue
+			}
+			offset := start + int64(e.TargetData)*lpSectorSize
+			length := int64(e.NumSectors) * lpSectorSize
+			if err := p.Trim(offset, length); err != nil {
+				return fmt.Errorf("lp: Failed to discard %s: %v", lp.Name, err)
+			}
+			if zeroed < wipeHeaderSize {
+				count := length
+				if count > wipeHeaderSize-zeroed {
+					count = wipeHeaderSize - zeroed
+				}
+				if err := p.ZeroDisk(offset, count); err != nil {
+					return fmt.Errorf("lp: Failed to zero start of %s: %v", lp.Name, err)
+				}
+				zeroed += count
+			}
+		}
+		log("Wiped logical partition %s", lp.Name)
+	}
+	return nil
+}
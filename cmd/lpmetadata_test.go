@@ -0,0 +1,348 @@
+package main
+
+import (
+	stdbytes "bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// The metadata slots of test super images are small, and there are two of them like on A/B devices.
+const (
+	testLpMaxSize = 4096
+	testLpSlots   = 2
+)
+
+// Encode metadata the way liblp lays it out, independently of LpMetadata.Bytes.
+func encodeLpMetadata(headerSize int, partitions []*LpPartition, groups []*LpGroup, devices []*LpBlockDevice) []byte {
+	le := binary.LittleEndian
+	name := func(entry []byte, s string) { copy(entry, s) }
+
+	partitionTable := make([]byte, 0)
+	extentTable := make([]byte, 0)
+	extents := 0
+	for _, lp := range partitions {
+		e := make([]byte, lpPartitionEntrySize)
+		name(e[0:36], lp.Name)
+		le.PutUint32(e[36:], lp.Attributes)
+		le.PutUint32(e[40:], uint32(extents))
+		le.PutUint32(e[44:], uint32(len(lp.Extents)))
+		le.PutUint32(e[48:], lp.Group)
+		partitionTable = append(partitionTable, e...)
+		for _, extent := range lp.Extents {
+			x := make([]byte, lpExtentEntrySize)
+			le.PutUint64(x[0:], extent.NumSectors)
+			le.PutUint32(x[8:], extent.TargetType)
+			le.PutUint64(x[12:], extent.TargetData)
+			le.PutUint32(x[20:], extent.TargetSource)
+			extentTable = append(extentTable, x...)
+			extents++
+		}
+	}
+	groupTable := make([]byte, 0)
+	for _, group := range groups {
+		e := make([]byte, lpGroupEntrySize)
+		name(e[0:36], group.Name)
+		le.PutUint32(e[36:], group.Flags)
+		le.PutUint64(e[40:], group.MaximumSize)
+		groupTable = append(groupTable, e...)
+	}
+	deviceTable := make([]byte, 0)
+	for _, dev := range devices {
+		e := make([]byte, lpBlockDeviceEntrySize)
+		le.PutUint64(e[0:], dev.FirstLogicalSector)
+		le.PutUint32(e[8:], dev.Alignment)
+		le.PutUint32(e[12:], dev.AlignmentOffset)
+		le.PutUint64(e[16:], dev.Size)
+		name(e[24:60], dev.PartitionName)
+		le.PutUint32(e[60:], dev.Flags)
+		deviceTable = append(deviceTable, e...)
+	}
+
+	header := make([]byte, headerSize)
+	le.PutUint32(header[0:], lpHeaderMagic)
+	le.PutUint16(header[4:], lpMajorVersion)
+	le.PutUint16(header[6:], 2)
+	le.PutUint32(header[8:], uint32(headerSize))
+	tables := make([]byte, 0)
+	counts := []int{len(partitions), extents, len(groups), len(devices)}
+	sizes := []int{lpPartitionEntrySize, lpExtentEntrySize, lpGroupEntrySize, lpBlockDeviceEntrySize}
+	for i, table := range [][]byte{partitionTable, extentTable, groupTable, deviceTable} {
+		le.PutUint32(header[80+i*12:], uint32(len(tables)))
+		le.PutUint32(header[84+i*12:], uint32(counts[i]))
+		le.PutUint32(header[88+i*12:], uint32(sizes[i]))
+		tables = append(tables, table...)
+	}
+	if headerSize > lpHeaderSizeV1_0 {
+		le.PutUint32(header[lpHeaderSizeV1_0:], 0x5a5a5a5a) //Header flags reparted doesn't know about
+	}
+	le.PutUint32(header[44:], uint32(len(tables)))
+	sum := sha256.Sum256(tables)
+	copy(header[48:80], sum[:])
+	sum = sha256.Sum256(header)
+	copy(header[12:44], sum[:])
+	return append(header, tables...)
+}
+
+// Build the start of a super partition holding the geometry and the given metadata in each slot, both copies.
+func buildLpSuper(slots [][]byte) []byte {
+	le := binary.LittleEndian
+	geo := &LpGeometry{MetadataMaxSize: testLpMaxSize, MetadataSlotCount: testLpSlots}
+	image := make([]byte, lpReservedBytes+2*lpGeometrySize+2*testLpSlots*testLpMaxSize)
+	geometry := make([]byte, 52)
+	le.PutUint32(geometry[0:], lpGeometryMagic)
+	le.PutUint32(geometry[4:], 52)
+	le.PutUint32(geometry[40:], testLpMaxSize)
+	le.PutUint32(geometry[44:], testLpSlots)
+	le.PutUint32(geometry[48:], 4096)
+	sum := sha256.Sum256(geometry)
+	copy(geometry[8:40], sum[:])
+	copy(image[lpReservedBytes:], geometry)
+	copy(image[lpReservedBytes+lpGeometrySize:], geometry)
+	for slot := 0; slot < len(slots); slot++ {
+		primary, backup := geo.slotOffsets(slot)
+		copy(image[primary:], slots[slot])
+		copy(image[backup:], slots[slot])
+	}
+	return image
+}
+
+// A super partition read from memory.
+func testLpPartition(image []byte) *Partition {
+	name := "super"
+	return &Partition{Name: &name, reader: stdbytes.NewReader(image)}
+}
+
+func testLpDevice() *LpBlockDevice {
+	return &LpBlockDevice{FirstLogicalSector: 2048, Alignment: 1024 * 1024, Size: 16 * 1024 * 1024, PartitionName: "super"}
+}
+
+func TestLpMetadataRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerSize int
+		partitions []*LpPartition
+		groups     []*LpGroup
+	}{
+		{"empty", lpHeaderSizeV1_0, nil, []*LpGroup{{Name: "default"}}},
+		{"one partition", lpHeaderSizeV1_0,
+			[]*LpPartition{{Name: "system_a", Attributes: 1, Extents: []*LpExtent{{NumSectors: 2048, TargetData: 2048}}}},
+			[]*LpGroup{{Name: "default"}}},
+		{"groups and extents", lpHeaderSizeV1_0,
+			[]*LpPartition{
+				{Name: "system_a", Attributes: 1, Group: 1, Extents: []*LpExtent{{NumSectors: 2048, TargetData: 2048}, {NumSectors: 1024, TargetData: 8192}}},
+				{Name: "vendor_a", Group: 1, Extents: []*LpExtent{{NumSectors: 4096, TargetData: 4096}}},
+				{Name: "system_b", Group: 2},
+				{Name: "zeroes", Extents: []*LpExtent{{NumSectors: 8, TargetType: lpTargetZero}}},
+			},
+			[]*LpGroup{{Name: "default"}, {Name: "main_a", MaximumSize: 8 * 1024 * 1024}, {Name: "main_b", Flags: 1, MaximumSize: 8 * 1024 * 1024}}},
+		{"larger header", 256,
+			[]*LpPartition{{Name: "product_a", Extents: []*LpExtent{{NumSectors: 2048, TargetData: 2048}}}},
+			[]*LpGroup{{Name: "default"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices := []*LpBlockDevice{testLpDevice()}
+			data := encodeLpMetadata(tt.headerSize, tt.partitions, tt.groups, devices)
+			super := testLpPartition(buildLpSuper([][]byte{data, data}))
+
+			m, err := super.ReadLpMetadata(0)
+			if err != nil {
+				t.Fatalf("ReadLpMetadata: %v", err)
+			}
+			if m.Geometry.MetadataMaxSize != testLpMaxSize || m.Geometry.MetadataSlotCount != testLpSlots || m.Geometry.LogicalBlockSize != 4096 {
+				t.Errorf("got geometry %+v", *m.Geometry)
+			}
+			if len(m.Partitions) != len(tt.partitions) {
+				t.Fatalf("got %d partitions, want %d", len(m.Partitions), len(tt.partitions))
+			}
+			for i, want := range tt.partitions {
+				got := m.Partitions[i]
+				if got.Name != want.Name || got.Attributes != want.Attributes || got.Group != want.Group || len(got.Extents) != len(want.Extents) {
+					t.Fatalf("got partition %+v, want %+v", *got, *want)
+				}
+				for j := 0; j < len(want.Extents); j++ {
+					g, w := got.Extents[j], want.Extents[j]
+					if g.NumSectors != w.NumSectors || g.TargetType != w.TargetType || g.TargetData != w.TargetData || g.TargetSource != w.TargetSource {
+						t.Errorf("partition %s extent %d is %+v, want %+v", want.Name, j, *g, *w)
+					}
+				}
+			}
+			if len(m.Groups) != len(tt.groups) {
+				t.Fatalf("got %d groups, want %d", len(m.Groups), len(tt.groups))
+			}
+			for i, want := range tt.groups {
+				if got := m.Groups[i]; got.Name != want.Name || got.Flags != want.Flags || got.MaximumSize != want.MaximumSize {
+					t.Errorf("got group %+v, want %+v", *got, *want)
+				}
+			}
+			if len(m.BlockDevices) != 1 {
+				t.Fatalf("got %d block devices, want 1", len(m.BlockDevices))
+			}
+			if got, want := m.BlockDevices[0], devices[0]; got.FirstLogicalSector != want.FirstLogicalSector || got.Alignment != want.Alignment || got.Size != want.Size || got.PartitionName != want.PartitionName {
+				t.Errorf("got block device %+v, want %+v", *got, *want)
+			}
+
+			out, err := m.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes: %v", err)
+			}
+			if !stdbytes.Equal(out, data) {
+				t.Errorf("Bytes doesn't give back the metadata that was read")
+			}
+		})
+	}
+}
+
+func TestLpMetadataChecksums(t *testing.T) {
+	partitions := []*LpPartition{{Name: "system_a", Extents: []*LpExtent{{NumSectors: 2048, TargetData: 2048}}}}
+	data := encodeLpMetadata(lpHeaderSizeV1_0, partitions, []*LpGroup{{Name: "default"}}, []*LpBlockDevice{testLpDevice()})
+	geo := &LpGeometry{MetadataMaxSize: testLpMaxSize, MetadataSlotCount: testLpSlots}
+	primary, backup := geo.slotOffsets(0)
+
+	tests := []struct {
+		name    string
+		slot    int
+		corrupt func(image []byte)
+		err     string //Empty when the metadata can still be read
+	}{
+		{"intact", 0, func(image []byte) {}, ""},
+		{"primary geometry", 0, func(image []byte) { image[lpReservedBytes+40] ^= 1 }, ""},
+		{"both geometries", 0, func(image []byte) {
+			image[lpReservedBytes+40] ^= 1
+			image[lpReservedBytes+lpGeometrySize+40] ^= 1
+		}, "Geometry checksum mismatch"},
+		{"primary header", 0, func(image []byte) { image[primary+84] ^= 1 }, ""},
+		{"both headers", 0, func(image []byte) {
+			image[primary+84] ^= 1
+			image[backup+84] ^= 1
+		}, "header checksum mismatch"},
+		{"primary tables", 0, func(image []byte) { image[primary+lpHeaderSizeV1_0+40] ^= 1 }, ""},
+		{"both tables", 0, func(image []byte) {
+			image[primary+lpHeaderSizeV1_0+40] ^= 1
+			image[backup+lpHeaderSizeV1_0+40] ^= 1
+		}, "tables checksum mismatch"},
+		{"missing slot", testLpSlots, func(image []byte) {}, "doesn't exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := buildLpSuper([][]byte{data, data})
+			tt.corrupt(image)
+			m, err := testLpPartition(image).ReadLpMetadata(tt.slot)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadLpMetadata: %v", err)
+			}
+			if out, err := m.Bytes(); err != nil || !stdbytes.Equal(out, data) {
+				t.Errorf("Bytes doesn't give back the metadata that was written, error %v", err)
+			}
+		})
+	}
+}
+
+func TestLpMetadataResize(t *testing.T) {
+	tests := []struct {
+		name    string
+		resize  string
+		size    int64
+		extents []LpExtent //The extents of the resized partition afterwards
+		err     string
+	}{
+		{"shrink within an extent", "system_a", 512 * 1024, []LpExtent{{NumSectors: 1024, TargetData: 2048}}, ""},
+		{"shrink dropping an extent", "vendor_a", 1024 * 1024, []LpExtent{{NumSectors: 2048, TargetData: 6144}}, ""},
+		{"grow into the gap after it", "system_a", 2 * 1024 * 1024, []LpExtent{{NumSectors: 4096, TargetData: 2048}}, ""},
+		{"grow past the gap", "system_a", 3 * 1024 * 1024, []LpExtent{{NumSectors: 4096, TargetData: 2048}, {NumSectors: 2048, TargetData: 10240}}, ""},
+		{"group limit", "vendor_a", 8 * 1024 * 1024, nil, "larger than the limit"},
+		{"out of space", "system_a", 16 * 1024 * 1024, nil, "Not enough free space"},
+		{"unaligned", "system_a", 1000, nil, "not a multiple"},
+		{"unknown", "odm_a", 4096, nil, "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partitions := []*LpPartition{
+				{Name: "system_a", Extents: []*LpExtent{{NumSectors: 2048, TargetData: 2048}}},
+				{Name: "vendor_a", Group: 1, Extents: []*LpExtent{{NumSectors: 4096, TargetData: 6144}, {NumSectors: 2048, TargetData: 12288}}},
+			}
+			groups := []*LpGroup{{Name: "default"}, {Name: "main_a", MaximumSize: 4 * 1024 * 1024}}
+			data := encodeLpMetadata(lpHeaderSizeV1_0, partitions, groups, []*LpBlockDevice{testLpDevice()})
+			m, err := testLpPartition(buildLpSuper([][]byte{data, data})).ReadLpMetadata(0)
+			if err != nil {
+				t.Fatalf("ReadLpMetadata: %v", err)
+			}
+
+			err = m.ResizePartition(tt.resize, tt.size)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResizePartition: %v", err)
+			}
+
+			//The resized metadata is read back through its new checksums
+			out, err := m.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes: %v", err)
+			}
+			m, err = testLpPartition(buildLpSuper([][]byte{out, out})).ReadLpMetadata(1)
+			if err != nil {
+				t.Fatalf("ReadLpMetadata after resizing: %v", err)
+			}
+			lp := m.Partition(tt.resize)
+			if lp.Size() != tt.size || len(lp.Extents) != len(tt.extents) {
+				t.Fatalf("%s is %d bytes in %d extents, want %d bytes in %d", tt.resize, lp.Size(), len(lp.Extents), tt.size, len(tt.extents))
+			}
+			for i := 0; i < len(tt.extents); i++ {
+				if got := lp.Extents[i]; got.NumSectors != tt.extents[i].NumSectors || got.TargetData != tt.extents[i].TargetData {
+					t.Errorf("extent %d is %+v, want %+v", i, *got, tt.extents[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDifferingLpSlots(t *testing.T) {
+	devices := []*LpBlockDevice{testLpDevice()}
+	groups := []*LpGroup{{Name: "default"}}
+	kept := encodeLpMetadata(lpHeaderSizeV1_0, []*LpPartition{{Name: "system_a", Extents: []*LpExtent{{NumSectors: 2048, TargetData: 2048}}}}, groups, devices)
+	other := encodeLpMetadata(lpHeaderSizeV1_0, []*LpPartition{{Name: "system_a", Extents: []*LpExtent{{NumSectors: 4096, TargetData: 2048}}}}, groups, devices)
+
+	tests := []struct {
+		name  string
+		slots [][]byte
+		want  []int
+	}{
+		{"same", [][]byte{kept, kept}, []int{}},
+		{"different", [][]byte{kept, other}, []int{1}},
+		{"unreadable", [][]byte{kept, nil}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			super := testLpPartition(buildLpSuper(tt.slots))
+			m, err := super.ReadLpMetadata(0)
+			if err != nil {
+				t.Fatalf("ReadLpMetadata: %v", err)
+			}
+			got, err := super.differingLpSlots(m, 0)
+			if err != nil {
+				t.Fatalf("differingLpSlots: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got slots %v, want %v", got, tt.want)
+			}
+			for i := 0; i < len(got); i++ {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got slots %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/JoshuaDoes/json"
+
+	"fmt"
+	"os"
+)
+
+// How the contents of a partition were hashed for the manifest.
+const (
+	hashUsed  = "used"  //The blocks its filesystem has allocated
+	hashImage = "image" //The raw partition, as much of it as survives a resize
+)
+
+// A Manifest is the content hashes of every partition reparted keeps while moving or resizing it, written before
+// anything changes so the same bytes can be shown to be there afterwards, even by a later verify.
+type Manifest struct {
+	Disks []*ManifestDisk `json:"disks"`
+}
+
+// A ManifestDisk is the content hashes of the kept partitions on one disk.
+type ManifestDisk struct {
+	Disk       string         `json:"disk"`
+	Partitions []*ContentHash `json:"partitions"`
+}
+
+// HashPreserved hashes every reserved partition the plan moves or resizes without wiping it. Filesystems are hashed
+// over the blocks they use, raw partitions over their whole image, or the part of it a shrink keeps. A partition
+// whose copy an earlier run left unfinished can't be hashed where it is, so it keeps its hash from that run.
+func (dp *DiskPlan) HashPreserved(previous *ManifestDisk) (*ManifestDisk, error) {
+	p := dp.Parted
+	md := &ManifestDisk{Disk: p.Config.Disk, Partitions: make([]*ContentHash, 0)}
+	for i := 0; i < len(dp.Placements); i++ {
+		pl := dp.Placements[i]
+		if pl.UserData || pl.Config.Wipe || !pl.Changes() {
+			continue
+		}
+		partActual := pl.Actual
+		if partActual.Resuming() {
+			if hash, ok := previous.Hashes()[partActual.GetName()]; ok {
+				md.Partitions = append(md.Partitions, hash)
+			} else {
+				warn("manifest: %s is partly copied and the last run's manifest has no hash of it", partActual.GetName())
+			}
+			continue
+		}
+		oldSize := pl.Old.Length
+		newSize := pl.Size
+
+		mode := hashImage
+		extents, err := partActual.AllocatedExtents()
+		if err != nil {
+			debug("manifest: Hashing all of %s, its allocation map can't be read: %v", partActual.GetName(), err)
+			extents = nil
+		}
+		if extents != nil {
+			mode = hashUsed
+		} else {
+			keep := oldSize
+			if newSize < keep {
+				keep = newSize
+			}
+			extents = []Extent{{Offset: 0, Length: keep}}
+		}
+
+		hash, err := partActual.HashContent(extents)
+		if err != nil {
+			return nil, err
+		}
+		hash.Mode = mode
+		hash.Resized = newSize != oldSize && (mode == hashUsed || GetFilesystem(partActual) != nil)
+		debug("manifest: %s hashes to %s (%s)", hash.Name, hash.Sum, hash.Mode)
+		md.Partitions = append(md.Partitions, hash)
+	}
+	return md, nil
+}
+
+// Hashes returns the content hashes of the disk by partition name, as Verify takes them.
+func (md *ManifestDisk) Hashes() map[string]*ContentHash {
+	hashes := make(map[string]*ContentHash)
+	if md == nil {
+		return hashes
+	}
+	for i := 0; i < len(md.Partitions); i++ {
+		hashes[md.Partitions[i].Name] = md.Partitions[i]
+	}
+	return hashes
+}
+
+// Disk returns the hashes of the disk at path, or nil if the manifest has none.
+func (m *Manifest) Disk(path string) *ManifestDisk {
+	for i := 0; i < len(m.Disks); i++ {
+		if m.Disks[i].Disk == path {
+			return m.Disks[i]
+		}
+	}
+	return nil
+}
+
+// OpenManifest opens the manifest at path for writing, creating it if needed but leaving what's there alone until
+// Write replaces it. Opening it before partitions are released means a manifest that can't be written stops the run
+// before anything changes.
+func OpenManifest(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: Failed to open %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// Write saves the manifest as JSON to a file from OpenManifest, replacing what it held.
+func (m *Manifest) Write(f *os.File) error {
+	data, err := json.Marshal(m, true)
+	if err != nil {
+		return fmt.Errorf("manifest: Failed to encode: %v", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("manifest: Failed to write %s: %v", f.Name(), err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("manifest: Failed to write %s: %v", f.Name(), err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("manifest: Failed to sync %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// ReadManifest loads a manifest written by an earlier run.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: Failed to read %s: %v", path, err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("manifest: Failed to parse %s: %v", path, err)
+	}
+	return m, nil
+}
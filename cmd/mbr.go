@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The partition kinds of an MBR, as parted names them.
+const (
+	kindPrimary  = "primary"
+	kindExtended = "extended"
+	kindLogical  = "logical"
+)
+
+// The MBR holds at most this many primary partitions, counting the extended partition.
+const mbrMaxPrimary = 4
+
+// The first logical partition number, as Linux and parted count them.
+const mbrFirstLogical = 5
+
+// An MBREntry is one 16 byte partition entry, and the sector of the MBR or EBR it lives in.
+type MBREntry struct {
+	Sector int64 //The LBA of the boot record holding the entry
+	Offset int   //The byte offset of the entry within that sector
+	Status byte  //0x80 if bootable
+	Type   byte
+	Start  int64 //The first LBA of the partition, from the start of the disk
+	Count  int64 //The number of sectors
+}
+
+// Whether a partition type byte marks an extended partition.
+func mbrExtended(typ byte) bool {
+	return typ == 0x05 || typ == 0x0f || typ == 0x85
+}
+
+// Parse the entry at the given index of a boot record, with its start relative to base.
+func parseMBREntry(record []byte, sector, base int64, index int) *MBREntry {
+	le := binary.LittleEndian
+	offset := 446 + index*16
+	e := record[offset : offset+16]
+	return &MBREntry{
+		Sector: sector,
+		Offset: offset,
+		Status: e[0],
+		Type:   e[4],
+		Start:  base + int64(le.Uint32(e[8:])),
+		Count:  int64(le.Uint32(e[12:])),
+	}
+}
+
+// Read the boot record at the given LBA, checking its signature.
+func (p *Parted) readBootRecord(lba int64) ([]byte, error) {
+	record, err := p.ReadDisk(lba*p.SectorSizeLogical, 512)
+	if err != nil {
+		return nil, err
+	}
+	if len(record) < 512 || record[510] != 0x55 || record[511] != 0xaa {
+		return nil, fmt.Errorf("mbr: No boot record signature at LBA %d", lba)
+	}
+	return record, nil
+}
+
+// ReadMBR returns the partition entries of the MBR by partition number: 1 to 4 for primary partitions and the
+// extended partition, and 5 onwards for logical partitions, following the EBR chain.
+func (p *Parted) ReadMBR() (map[int]*MBREntry, error) {
+	mbr, err := p.readBootRecord(0)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[int]*MBREntry)
+	var extended *MBREntry
+	for i := 0; i < mbrMaxPrimary; i++ {
+		e := parseMBREntry(mbr, 0, 0, i)
+		if e.Type == 0 {
+			continue
+		}
+		entries[i+1] = e
+		if mbrExtended(e.Type) {
+			extended = e
+		}
+	}
+	if extended == nil {
+		return entries, nil
+	}
+
+	//Each EBR holds one logical partition relative to itself, and a link to the next EBR relative to the extended partition
+	num := mbrFirstLogical
+	seen := make(map[int64]bool)
+	for ebr := extended.Start; ebr != 0; num++ {
+		if seen[ebr] || ebr < extended.Start || ebr >= extended.Start+extended.Count {
+			return nil, fmt.Errorf("mbr: EBR chain is broken at LBA %d", ebr)
+		}
+		seen[ebr] = true
+		record, err := p.readBootRecord(ebr)
+		if err != nil {
+			return nil, err
+		}
+		logical := parseMBREntry(record, ebr, ebr, 0)
+		if logical.Type == 0 {
+			break
+		}
+		entries[num] = logical
+		next := parseMBREntry(record, ebr, extended.Start, 1)
+		if next.Type == 0 {
+			break
+		}
+		ebr = next.Start
+	}
+	return entries, nil
+}
+
+// LoadMBR fills in the kind, type byte and boot flag of every partition from the MBR and the EBR chain.
+func (p *Parted) LoadMBR() error {
+	if p.PartitionTable != "MSDOS" {
+		return nil
+	}
+	entries, err := p.ReadMBR()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(p.Partitions); i++ {
+		part := p.Partitions[i]
+		e := entries[*part.Number]
+		if *part.Number == 0 || e == nil {
+			continue
+		}
+		kind := kindPrimary
+		if *part.Number >= mbrFirstLogical {
+			kind = kindLogical
+		} else if mbrExtended(e.Type) {
+			kind = kindExtended
+		}
+		if part.Kind != nil && *part.Kind != kind {
+			debug("mbr: Partition %d is %s in the MBR but %s by parted", *part.Number, kind, *part.Kind)
+		}
+		typ := e.Type
+		boot := e.Status&0x80 != 0
+		part.Kind = &kind
+		part.MBRType = &typ
+		part.Boot = &boot
+	}
+	return nil
+}
+
+// RestoreMBREntry writes a partition's type byte and boot flag back into its MBR or EBR entry, after parted
+// recreated it with its own defaults.
+func (p *Parted) RestoreMBREntry(part *Partition) error {
+	if p.PartitionTable != "MSDOS" || part.MBRType == nil || part.Boot == nil {
+		return nil
+	}
+	entries, err := p.ReadMBR()
+	if err != nil {
+		return err
+	}
+	e := entries[*part.Number]
+	if e == nil {
+		return fmt.Errorf("mbr: No entry for partition %d", *part.Number)
+	}
+	record, err := p.readBootRecord(e.Sector)
+	if err != nil {
+		return err
+	}
+	record[e.Offset+4] = *part.MBRType
+	record[e.Offset] = 0
+	if *part.Boot {
+		record[e.Offset] = 0x80
+	}
+	if err := p.WriteDisk(e.Sector*p.SectorSizeLogical, record); err != nil {
+		return fmt.Errorf("mbr: Failed to write boot record at LBA %d: %v", e.Sector, err)
+	}
+	if err := p.WriteFile.Sync(); err != nil {
+		return fmt.Errorf("mbr: Failed to sync disk: %v", err)
+	}
+	return nil
+}
+
+// The extended partition on the disk, or nil.
+func (p *Parted) extendedPartition() *Partition {
+	for i := 0; i < len(p.Partitions); i++ {
+		if p.Partitions[i].Kind != nil && *p.Partitions[i].Kind == kindExtended {
+			return p.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// AssignMBRKinds checks that the partitions to create fit in an MBR, with no more than four primary partitions
+// counting the extended one. Created partitions without a "kind" are made primary while there's room, and logical
+// after that. It does nothing for other partition tables.
+func (p *Parted) AssignMBRKinds(create []*Partition) error {
+	if p.PartitionTable != "MSDOS" {
+		return nil
+	}
+	extended := p.extendedPartition()
+	primaries := 0
+	for i := 0; i < len(p.Partitions); i++ {
+		if p.Partitions[i].Kind != nil && *p.Partitions[i].Kind != kindLogical {
+			primaries++
+		}
+	}
+
+	for i := 0; i < len(create); i++ {
+		kind := ""
+		if create[i].Kind != nil {
+			kind = *create[i].Kind
+		}
+		switch kind {
+		case "":
+			kind = kindPrimary
+			if primaries >= mbrMaxPrimary {
+				kind = kindLogical
+			}
+			create[i].Kind = &kind
+		case kindPrimary, kindLogical:
+		case kindExtended:
+			if extended != nil {
+				return fmt.Errorf("mbr: Can't create %s, the disk already has an extended partition", create[i].GetName())
+			}
+		default:
+			return fmt.Errorf("mbr: Unknown partition kind %s for %s", kind, create[i].GetName())
+		}
+		if kind == kindLogical && extended == nil {
+			return fmt.Errorf("mbr: Can't create logical partition %s without an extended partition", create[i].GetName())
+		}
+		if kind != kindLogical {
+			primaries++
+		}
+		log("Partition %s will be created as %s", create[i].GetName(), kind)
+	}
+	if primaries > mbrMaxPrimary {
+		return fmt.Errorf("mbr: Plan needs %d primary partitions, an MBR holds %d", primaries, mbrMaxPrimary)
+	}
+	return nil
+}
+
+// CheckMBR checks that the layout fits the MBR: every logical partition inside the extended partition with room
+// for its EBR before it, and no primary partition running into the extended one. It does nothing for other
+// partition tables.
+func (p *Parted) CheckMBR(placements []*Placement) error {
+	if p.PartitionTable != "MSDOS" {
+		return nil
+	}
+	extended := p.extendedPartition()
+	if extended == nil {
+		return nil
+	}
+	extStart := *extended.Start
+	extEnd := *extended.End
+	for i := 0; i < len(placements); i++ {
+		pl := placements[i]
+		kind := pl.Config.Kind
+		if pl.Actual != nil {
+			kind = pl.Actual.Kind
+		}
+		if kind == nil || *kind == kindExtended {
+			continue
+		}
+		start := pl.Start
+		end := start + pl.Size - 1
+		if *kind == kindLogical {
+			//Every logical partition is preceded by its EBR, at least one sector before it
+			if start < extStart+p.SectorSizeLogical || end > extEnd {
+				return fmt.Errorf("mbr: Logical partition %s (%d-%d) wouldn't fit inside the extended partition (%d-%d)", pl.Name(), start, end, extStart, extEnd)
+			}
+		} else if start <= extEnd && end >= extStart {
+			return fmt.Errorf("mbr: Primary partition %s (%d-%d) would overlap the extended partition (%d-%d)", pl.Name(), start, end, extStart, extEnd)
+		}
+	}
+	return nil
+}
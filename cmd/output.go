@@ -0,0 +1,189 @@
+package main
+
+import (
+	"github.com/JoshuaDoes/json"
+
+	"fmt"
+	"os"
+	"time"
+)
+
+// The schema of the JSON result document. Tools should refuse any schema they don't know, and this must be
+// bumped whenever a field is renamed, removed or changes meaning. Adding new fields does not require a bump.
+const resultSchema = "reparted/result/v1"
+
+const (
+	outputText = "text" // Free text log lines prefixed with logPrefix
+	outputJSON = "json" // One JSON event per line, finishing with a result event
+)
+
+var (
+	outputMode = outputText // The output mode selected with --output
+	result = &Result{Schema: resultSchema, Status: "running", Disks: make([]*DiskInfo, 0), Plans: make([]*Plan, 0), Steps: make([]*Step, 0), Errors: make([]string, 0)}
+)
+
+// An Event is a single line of JSON output.
+type Event struct {
+	Type string `json:"type"` //log, step, progress or result
+	Time time.Time `json:"time"`
+	Level string `json:"level,omitempty"` //Only set for log events
+	Message string `json:"msg,omitempty"`
+	Step *Step `json:"step,omitempty"`
+	Progress *ProgressInfo `json:"progress,omitempty"`
+	Result *Result `json:"result,omitempty"`
+}
+
+// A Result is the final document describing everything reparted saw, planned and did.
+type Result struct {
+	Schema string `json:"schema"`
+	Status string `json:"status"` //running, ok or failed
+	Disk *DiskInfo `json:"disk,omitempty"` //The first disk, also in Disks
+	Plan *Plan `json:"plan,omitempty"` //The plan for the first disk, also in Plans
+	Disks []*DiskInfo `json:"disks"`
+	Plans []*Plan `json:"plans"`
+	Preflight []*PreflightCheck `json:"preflight,omitempty"`
+	Verify []*VerifyCheck `json:"verify,omitempty"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+	Steps []*Step `json:"steps"`
+	Errors []string `json:"errors"`
+}
+
+// DiskInfo describes the disk as parted reported it before any changes were made.
+type DiskInfo struct {
+	Path string `json:"path"`
+	Model string `json:"model"`
+	Flags string `json:"flags"`
+	PartitionTable string `json:"partitionTable"`
+	Size int64 `json:"size"`
+	SectorSizeLogical int64 `json:"sectorSizeLogical"`
+	SectorSizePhysical int64 `json:"sectorSizePhysical"`
+	TableSize int64 `json:"tableSize"`
+	PartsSize int64 `json:"partsSize"`
+	Partitions []*PartitionInfo `json:"partitions"`
+}
+
+// PartitionInfo describes a single partition or free space region, with all sizes in bytes.
+type PartitionInfo struct {
+	Number int `json:"num"` //0 for free space
+	Name string `json:"name"`
+	Start int64 `json:"start"`
+	End int64 `json:"end"`
+	Size int64 `json:"size"`
+	FS string `json:"fs"`
+	Flags string `json:"flags"`
+	TypeGUID string `json:"typeGuid,omitempty"`
+	UniqueGUID string `json:"guid,omitempty"`
+	Attributes uint64 `json:"attributes"`
+	Kind string `json:"kind,omitempty"` //MBR only: primary, extended or logical
+	MBRType int `json:"mbrType,omitempty"` //MBR only: the partition type byte
+	Wipe bool `json:"wipe"`
+}
+
+// A Plan describes the changes reparted intends to make.
+type Plan struct {
+	Disk string `json:"disk"`
+	Reserve int64 `json:"reserve"` //Positive is taken from userdata, negative is awarded to userdata
+	UserDataSize int64 `json:"userdataSize"`
+	Create []string `json:"create"`
+	Shrink []*PlanResize `json:"shrink"`
+	Grow []*PlanResize `json:"grow"`
+	Move []string `json:"move"`
+	Logical []*PlanResize `json:"logical"` //Logical partitions inside super that change size
+	SlotLayout string `json:"slotLayout"` //adjacent or interleaved
+	ActiveSlot string `json:"activeSlot,omitempty"` //Set by --slot, only the other slot is wiped or flashed
+}
+
+// A PlanResize describes a partition changing from one size to another, in bytes.
+type PlanResize struct {
+	Name string `json:"name"`
+	From int64 `json:"from"`
+	To int64 `json:"to"`
+}
+
+// A Step is a single operation reparted has attempted.
+type Step struct {
+	Action string `json:"action"` //fsck, shrink, etc
+	Target string `json:"target"` //The partition the step acts on
+	Status string `json:"status"` //running, ok, skipped or failed
+	Error string `json:"error,omitempty"`
+}
+
+// NewDiskInfo describes the disk and its partitions as they are now.
+func NewDiskInfo(p *Parted) *DiskInfo {
+	info := &DiskInfo{
+		Path: p.Config.Disk,
+		Model: p.DiskModel,
+		Flags: p.DiskFlags,
+		PartitionTable: p.PartitionTable,
+		Size: p.DiskSize,
+		SectorSizeLogical: p.SectorSizeLogical,
+		SectorSizePhysical: p.SectorSizePhysical,
+		TableSize: p.TableSize,
+		PartsSize: p.PartsSize,
+		Partitions: make([]*PartitionInfo, 0),
+	}
+	for i := 0; i < len(p.Partitions); i++ {
+		info.Partitions = append(info.Partitions, p.Partitions[i].Info())
+	}
+	return info
+}
+
+// NewPlan returns an empty plan, with empty lists instead of nulls in the JSON output.
+func NewPlan() *Plan {
+	return &Plan{Create: make([]string, 0), Shrink: make([]*PlanResize, 0), Grow: make([]*PlanResize, 0), Move: make([]string, 0), Logical: make([]*PlanResize, 0)}
+}
+
+// stepBegin records the start of a step and returns it so it can be finished later.
+func stepBegin(action, target string) *Step {
+	step := &Step{Action: action, Target: target, Status: "running"}
+	result.Steps = append(result.Steps, step)
+	emit(&Event{Type: "step", Step: step})
+	return step
+}
+
+// Done finishes a step as ok, or as failed if err is not nil.
+func (step *Step) Done(err error) {
+	step.Status = "ok"
+	if err != nil {
+		step.Status = "failed"
+		step.Error = err.Error()
+	}
+	emit(&Event{Type: "step", Step: step})
+	recoveryStepDone()
+}
+
+// Skip finishes a step without having done anything.
+func (step *Step) Skip() {
+	step.Status = "skipped"
+	emit(&Event{Type: "step", Step: step})
+	recoveryStepDone()
+}
+
+// finish emits the final result document. A failed result carries the error that stopped reparted.
+func finish(err error) {
+	result.Status = "ok"
+	if err != nil {
+		result.Status = "failed"
+		result.Errors = append(result.Errors, err.Error())
+	} else {
+		recoveryStepsDone = recoverySteps //Fill the bar, even if some of the expected steps weren't needed
+		recoverySetProgress(0)
+	}
+	emit(&Event{Type: "result", Result: result})
+}
+
+// emit writes an event to stdout when JSON output is enabled, and does nothing otherwise.
+func emit(ev *Event) {
+	if outputMode != outputJSON {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	evJSON, err := json.Marshal(ev, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode %s event: %v\n", ev.Type, err)
+		return
+	}
+	fmt.Println(string(evJSON))
+}
@@ -33,19 +33,68 @@ type Parted struct {
 
 	// The file descriptor for the disk.
 	File *os.File
+	// The read-write file descriptor for the disk, opened on the first write once the plan is approved.
+	WriteFile *os.File
+	// The byte ranges the approved plan may write to, nil until it's approved.
+	allowed []Extent
 	// A map containing the sizes of various table headers from parted for table parsing.
 	HeaderSizes map[string]int
 	Partitions []*Partition
+	// The planned dynamic partition metadata of super, if the config has "super".
+	Super *LpSuper
 }
 
 type PartedConfig struct {
 	Parted string `json:"parted"` //Path to parted executable
 	Fsck   string `json:"fsck"`   //Path to fsck executable (such as e2fsck)
 	Resize string `json:"resize"` //Path to resize executable (such as resize2fs)
+	Tools map[string]string `json:"tools"` //Paths to filesystem tools by name, such as "resize.f2fs"
+	Copy *CopyConfig `json:"copy"` //Options for copying partitions when they move
+	Discard string `json:"discard"` //How to discard freed space: on, secure or off
+	Busy *BusyConfig `json:"busy"` //What to do with partitions that are mounted or otherwise in use
 
 	Disk string `json:"disk"`               //Path to raw disk device
 	Reserved []*Partition `json:"reserved"` //Partitions that must shrink/expand to fit new definitions
 	UserData []*Partition `json:"userdata"` //Partitions that should dynamically readjust to leftover space
+
+	Super *SuperConfig `json:"super"` //Dynamic partitions inside super to resize
+	Fstab *FstabConfig `json:"fstab"` //Fstabs to rewrite for the new layout
+
+	LogFile string `json:"logFile"` //Path to a persistent log file, on a partition the plan doesn't change
+	LogRun bool `json:"logRun"`      //Write the full output of every command to the log file
+	Manifest string `json:"manifest"` //Path to save the content hashes of kept partitions to, and verify them from
+
+	Disks []*PartedConfig `json:"disks"` //Disks changed together, such as UFS LUNs, each inheriting what it doesn't set from here
+}
+
+// Fill in everything a disk in "disks" doesn't set with the top level config. The disk, its partitions and super
+// always belong to the disk, and fstab, logging and the manifest always belong to the top level.
+func (cfg *PartedConfig) inherit(parent *PartedConfig) {
+	if cfg.Parted == "" {
+		cfg.Parted = parent.Parted
+	}
+	if cfg.Fsck == "" {
+		cfg.Fsck = parent.Fsck
+	}
+	if cfg.Resize == "" {
+		cfg.Resize = parent.Resize
+	}
+	if cfg.Tools == nil {
+		cfg.Tools = parent.Tools
+	}
+	if cfg.Copy == nil {
+		cfg.Copy = parent.Copy
+	}
+	if cfg.Discard == "" {
+		cfg.Discard = parent.Discard
+	}
+	if cfg.Busy == nil {
+		cfg.Busy = parent.Busy
+	}
+	cfg.Fstab = parent.Fstab
+	cfg.LogFile = parent.LogFile
+	cfg.LogRun = parent.LogRun
+	cfg.Manifest = parent.Manifest
 }
 
 func (p *Parted) Run(args string) (string, error) {
@@ -63,6 +112,11 @@ func (p *Parted) Close() {
 	}
 
 	p.File.Close()
+	if p.WriteFile != nil {
+		p.WriteFile.Sync()
+		p.WriteFile.Close()
+		p.WriteFile = nil
+	}
 }
 
 func (p *Parted) ReadDisk(offset int64, count int64) ([]byte, error) {
@@ -79,17 +133,42 @@ func (p *Parted) ReadDisk(offset int64, count int64) ([]byte, error) {
 }
 
 func (p *Parted) WriteDisk(offset int64, data []byte) error {
-	if _, err := p.File.Seek(offset, io.SeekStart); err != nil {
-		return fmt.Errorf("WriteDisk: Failed to seek to offset %d: %v", offset, err)
+	if err := p.CheckWrite(offset, int64(len(data))); err != nil {
+		return fmt.Errorf("WriteDisk: %v", err)
+	}
+	if err := p.OpenWrite(); err != nil {
+		return fmt.Errorf("WriteDisk: %v", err)
 	}
-	if _, err := p.File.Write(data); err != nil {
+	if _, err := p.WriteFile.WriteAt(data, offset); err != nil {
 		return fmt.Errorf("WriteDisk: Failed to write bytes at offset %d: %v", offset, err)
 	}
 	return nil
 }
 
+// OpenWrite opens the disk for writing, as File is only ever opened for reading. It fails until the plan is
+// approved with AllowWrites.
+func (p *Parted) OpenWrite() error {
+	if p.WriteFile != nil {
+		return nil
+	}
+	if p.allowed == nil {
+		return fmt.Errorf("Refusing to open disk %s for writing before the plan is approved", p.Config.Disk)
+	}
+	raw, err := os.OpenFile(p.Config.Disk, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open disk %s for writing: %v", p.Config.Disk, err)
+	}
+	p.WriteFile = raw
+	return nil
+}
+
+// HasNames reports whether the partition table stores partition names, which MBR doesn't.
+func (p *Parted) HasNames() bool {
+	return p.PartitionTable != "MSDOS"
+}
+
 func (p *Parted) GetPartition(reserved bool, match *Partition) *Partition {
-	if match.Name != nil {
+	if match.Name != nil && (p.HasNames() || match.Number == nil) {
 		return p.GetPartitionByName(reserved, *match.Name)
 	}
 	if match.Number != nil {
@@ -135,54 +214,114 @@ func (p *Parted) GetUserDataPartitions(reserved bool) []*Partition {
 	}
 	userData := make([]*Partition, 0)
 	for i := 0; i < len(p.Config.UserData); i++ {
-		if p.Config.UserData[i].Name != nil {
-			part := p.GetPartitionByName(false, *p.Config.UserData[i].Name)
-			if part != nil {
-				userData = append(userData, part)
-			}
-		} else if p.Config.UserData[i].Number != nil {
-			part := p.GetPartitionByNum(false, *p.Config.UserData[i].Number)
-			if part != nil {
-				userData = append(userData, part)
-			}
+		part := p.GetPartition(false, p.Config.UserData[i])
+		if part != nil {
+			userData = append(userData, part)
 		}
 	}
 	return userData
 }
 
-func NewParted(pathJSON string) (*Parted, error) {
+// NewDisks loads the configuration from a JSON file and opens every disk it describes.
+func NewDisks(pathJSON string) ([]*Parted, error) {
 	partedJSON, err := os.ReadFile(pathJSON)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open JSON for reading from %s: %v", pathJSON, err)
 	}
+	return NewDisksJSON(partedJSON, pathJSON)
+}
 
+// NewDisksJSON is like NewDisks, but takes the JSON configuration itself. The source is only used for errors.
+// A config without "disks" describes a single disk at the top level.
+func NewDisksJSON(partedJSON []byte, pathJSON string) ([]*Parted, error) {
 	partedCfg := &PartedConfig{}
 	if err := json.Unmarshal(partedJSON, &partedCfg); err != nil {
 		return nil, fmt.Errorf("Failed to load JSON from %s: %v", pathJSON, err)
 	}
 
+	diskCfgs := []*PartedConfig{partedCfg}
+	if len(partedCfg.Disks) > 0 {
+		if partedCfg.Disk != "" || len(partedCfg.Reserved) > 0 || len(partedCfg.UserData) > 0 {
+			return nil, fmt.Errorf("Disk and partitions must be given either at the top level or in disks, not both")
+		}
+		diskCfgs = partedCfg.Disks
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < len(diskCfgs); i++ {
+		if diskCfgs[i] != partedCfg {
+			diskCfgs[i].inherit(partedCfg)
+		}
+		if err := diskCfgs[i].validate(); err != nil {
+			return nil, err
+		}
+		if seen[diskCfgs[i].Disk] {
+			return nil, fmt.Errorf("Disk %s is listed more than once", diskCfgs[i].Disk)
+		}
+		seen[diskCfgs[i].Disk] = true
+	}
+
+	disks := make([]*Parted, 0)
+	for i := 0; i < len(diskCfgs); i++ {
+		p, err := NewPartedConfig(diskCfgs[i])
+		if err != nil {
+			for j := 0; j < len(disks); j++ {
+				disks[j].Close()
+			}
+			return nil, fmt.Errorf("%s: %v", diskCfgs[i].Disk, err)
+		}
+		disks = append(disks, p)
+	}
+	return disks, nil
+}
+
+// Check the configuration of a single disk.
+func (partedCfg *PartedConfig) validate() error {
 	if partedCfg.Disk == "" {
-		return nil, fmt.Errorf("No disk specified")
+		return fmt.Errorf("No disk specified")
 	}
 	if partedCfg.Parted == "" {
-		return nil, fmt.Errorf("No parted executable specified")
+		return fmt.Errorf("No parted executable specified")
 	}
 	for i := 0; i < len(partedCfg.Reserved); i++ {
 		if partedCfg.Reserved[i].GetSize() <= 0 {
-			return nil, fmt.Errorf("Invalid size specified for reserved partition %d", i+1)
+			return fmt.Errorf("Invalid size specified for reserved partition %d", i+1)
 		}
 		if *partedCfg.Reserved[i].Name == "" {
-			return nil, fmt.Errorf("Must specify name for reserved partition %d", i+1)
+			return fmt.Errorf("Must specify name for reserved partition %d", i+1)
+		}
+		if partedCfg.Reserved[i].Slotted && partedCfg.Reserved[i].Number != nil {
+			return fmt.Errorf("Slotted reserved partition %d can't specify a number, both slots are matched by name", i+1)
+		}
+		if partedCfg.Reserved[i].Image != "" && !partedCfg.Reserved[i].Wipe {
+			return fmt.Errorf("Reserved partition %s has an image, so it must also be wiped", *partedCfg.Reserved[i].Name)
+		}
+	}
+	if partedCfg.Super != nil {
+		for i := 0; i < len(partedCfg.Super.Partitions); i++ {
+			if partedCfg.Super.Partitions[i].Name == nil || *partedCfg.Super.Partitions[i].Name == "" {
+				return fmt.Errorf("Must specify name for logical partition %d", i+1)
+			}
+			if partedCfg.Super.Partitions[i].GetSize() <= 0 {
+				return fmt.Errorf("Invalid size specified for logical partition %s", *partedCfg.Super.Partitions[i].Name)
+			}
 		}
 	}
 	for i := 0; i < len(partedCfg.UserData); i++ {
 		if *partedCfg.UserData[i].Name == "" {
-			return nil, fmt.Errorf("Must specify name for userdata partition %d", i+1)
+			return fmt.Errorf("Must specify name for userdata partition %d", i+1)
 		}
 	}
 
+	return nil
+}
+
+// NewPartedConfig opens the disk described by an already validated configuration and reads its partition table.
+func NewPartedConfig(partedCfg *PartedConfig) (*Parted, error) {
 	p := &Parted{Config: partedCfg, Partitions: make([]*Partition, 0), HeaderSizes: make(map[string]int)}
 
+	if err := lockDisk(p.Config.Disk); err != nil {
+		return nil, err
+	}
 	raw, err := os.Open(p.Config.Disk)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open disk %s: %v", p.Config.Disk, err)
@@ -256,6 +395,7 @@ func NewParted(pathJSON string) (*Parted, error) {
 			partFS := ""
 			partName := ""
 			partFlags := ""
+			partKind := ""
 
 			counter := 0
 			_, err := fmt.Sscanf(line[0:p.HeaderSizes["Number"]], "%d", &partNum)
@@ -270,6 +410,12 @@ func NewParted(pathJSON string) (*Parted, error) {
 			_, err = fmt.Sscanf(line[counter:counter+p.HeaderSizes["Size"]], "%s", &partSize)
 			if err != nil && err != io.EOF { return nil, fmt.Errorf("Failed to scan partition size: %v", err) }
 			counter += p.HeaderSizes["Size"]
+			if p.HeaderSizes["Type"] > 0 {
+				//MBR tables have a Type column instead of names
+				_, err = fmt.Sscanf(line[counter:counter+p.HeaderSizes["Type"]], "%s", &partKind)
+				if err != nil && err != io.EOF { return nil, fmt.Errorf("Failed to scan partition type: %v", err) }
+				counter += p.HeaderSizes["Type"]
+			}
 			if counter+p.HeaderSizes["File system"] >= len(line) {
 				partFS = string(line[counter:])
 			} else {
@@ -288,6 +434,9 @@ func NewParted(pathJSON string) (*Parted, error) {
 			}
 
 			part := NewPartition(p, partNum, partStart, partEnd, partSize, partFS, partName, partFlags)
+			if partKind != "" {
+				part.Kind = &partKind
+			}
 			realSize := part.GetSize()
 			if realSize < 0 {
 				return nil, fmt.Errorf("Failed to parse partiton size %s", partSize)
@@ -302,11 +451,19 @@ func NewParted(pathJSON string) (*Parted, error) {
 		p.Partitions[i].CheckValidOrPanic()
 	}
 
+	if err := p.LoadGPT(); err != nil {
+		warn("Failed to read GPT of %s, partition GUIDs and attributes won't survive a resize: %v", p.Config.Disk, err)
+	}
+	if err := p.LoadMBR(); err != nil {
+		warn("Failed to read MBR of %s, partition types and boot flags won't survive a resize: %v", p.Config.Disk, err)
+	}
+
 	p.TableSize = p.DiskSize - p.PartsSize
 	if p.TableSize < 0 {
 		return nil, fmt.Errorf("Parsed disk size, %d, is %d bytes less than counted partition sizes, %d - parted must be out of touch", p.DiskSize, p.TableSize * -1, p.PartsSize)
 	}
 
+	p.ExpandSlots()
 	for i := 0; i < len(p.Config.Reserved); i++ {
 		p.Config.Reserved[i].Parted = p
 		partActual := p.GetPartition(false, p.Config.Reserved[i])
@@ -320,12 +477,40 @@ func NewParted(pathJSON string) (*Parted, error) {
 	return p, nil
 }
 
+// Reload closes the disk and reads its partition table again from scratch, returning the new state.
+func (p *Parted) Reload() (*Parted, error) {
+	p.Close()
+	reloaded, err := NewPartedConfig(p.Config)
+	if err != nil {
+		return nil, err
+	}
+	reloaded.allowed = p.allowed //The plan stays approved
+	return reloaded, nil
+}
+
 func (p *Parted) Help() (string, error) {
 	return p.Run("--help")
 }
 
-func (p *Parted) MkPart(start, end int64) (string, error) {
-	return p.Run(fmt.Sprintf("mkpart primary %d %d", start, end))
+// MkPart creates a partition of the given kind, which parted takes as the name on tables other than MBR.
+func (p *Parted) MkPart(kind string, start, end int64) (string, error) {
+	return p.Run(fmt.Sprintf("mkpart %s %d %d", kind, start, end))
+}
+
+// CreatePartition creates the configured partition at start, size bytes long. Tables with names get its name straight
+// away, MBR partitions are made as the kind AssignMBRKinds gave them.
+func (p *Parted) CreatePartition(part *Partition, start, size int64) error {
+	kind := kindPrimary
+	if part.Kind != nil {
+		kind = *part.Kind
+	}
+	if p.HasNames() {
+		kind = part.GetName()
+	}
+	if _, err := p.MkPart(kind, start, start+size-1); err != nil {
+		return fmt.Errorf("parted: CreatePartition: failed to create partition %s: %v", part.GetName(), err)
+	}
+	return nil
 }
 
 func (p *Parted) Name(num int, name string) (string, error) {
@@ -352,17 +537,32 @@ func (p *Parted) ResizePart(num int, end int64) (string, error) {
 	if err != nil {
 		return output, fmt.Errorf("parted: ResizePart: failed to delete partition %d: %v", num, err)
 	}
-	output, err = p.MkPart(*actualPart.Start, *actualPart.End)
+	kind := kindPrimary
+	if actualPart.Kind != nil {
+		kind = *actualPart.Kind
+	}
+	output, err = p.MkPart(kind, *actualPart.Start, *actualPart.End)
 	if err != nil {
 		return output, fmt.Errorf("parted: ResizePart: failed to create partition %d: %v", num, err)
 	}
-	output, err = p.Name(num, *actualPart.Name)
-	if err != nil {
-		return output, fmt.Errorf("parted: ResizePart: failed to name partition %d: %v", num, err)
+	if p.HasNames() {
+		output, err = p.Name(num, *actualPart.Name)
+		if err != nil {
+			return output, fmt.Errorf("parted: ResizePart: failed to name partition %d: %v", num, err)
+		}
 	}
-	output, err = p.Set(num, *actualPart.Flags, true)
-	if err != nil {
-		return output, fmt.Errorf("parted: ResizePart: failed to set flags for partition %d: %v", num, err)
+	if *actualPart.Flags != "" {
+		output, err = p.Set(num, *actualPart.Flags, true)
+		if err != nil {
+			return output, fmt.Errorf("parted: ResizePart: failed to set flags for partition %d: %v", num, err)
+		}
+	}
+	//mkpart gives the partition a new unique GUID and parted's default type, and drops any attribute bits
+	if err := p.RestoreGPTEntry(actualPart); err != nil {
+		return "", fmt.Errorf("parted: ResizePart: failed to restore GPT entry for partition %d: %v", num, err)
+	}
+	if err := p.RestoreMBREntry(actualPart); err != nil {
+		return "", fmt.Errorf("parted: ResizePart: failed to restore MBR entry for partition %d: %v", num, err)
 	}
 
 	return "", nil
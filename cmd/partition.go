@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"strings"
 )
 
 type Partition struct {
@@ -18,9 +17,20 @@ type Partition struct {
 	FS *string `json:"fs,omitempty"`
 	Name *string `json:"name,omitempty"`
 	Flags *string `json:"flags,omitempty"`
+	TypeGUID *string `json:"typeGuid,omitempty"` //Read from the GPT, restored after parted recreates the partition
+	UniqueGUID *string `json:"guid,omitempty"`
+	Attributes *uint64 `json:"attributes,omitempty"` //Raw GPT attribute bits, including vendor bits such as A/B slot flags
+	Kind *string `json:"kind,omitempty"` //MBR only: primary, extended or logical
+	MBRType *uint8 `json:"mbrType,omitempty"` //MBR only: the partition type byte, restored after parted recreates the partition
+	Boot *bool `json:"boot,omitempty"` //MBR only: the boot flag
 	File *os.File `json:"-"`
+	superblock *Superblock //Cached by Probe
+	reader io.ReaderAt //Reads the partition instead of its device, for logical partitions inside super
+	slotKept bool //Not wiped or flashed, as it belongs to the slot --slot keeps
 
-	Wipe bool `json:"wipe"` //Prevents running fsck and resize operations
+	Wipe bool `json:"wipe"` //Discards the contents instead of running fsck and resize operations, then formats with FS if set
+	Slotted bool `json:"slotted"` //Expands into name_a and name_b with identical sizes, for A/B devices
+	Image string `json:"image,omitempty"` //Image flashed after wiping, raw or sparse and optionally compressed, from the zip when flashed from one
 }
 
 func NewPartition(parted *Parted, num int, start, end int64, size, fs, name, flags string) *Partition {
@@ -36,59 +46,66 @@ func NewPartition(parted *Parted, num int, start, end int64, size, fs, name, fla
 	}
 }
 
-func (part *Partition) Unmount() {
+// Unmount makes sure nothing is using the partition before it's changed, unmounting it if the config allows.
+func (part *Partition) Unmount() error {
 	partActual := part.Parted.GetPartition(false, part)
 	if partActual == nil {
-		return
+		return nil
 	}
-	_, _ = Run("umount", partActual.GetPath())
+	return part.Parted.Release([]*Partition{partActual})
 }
 
-func (part *Partition) Resize() error {
-	part.Unmount()
-	if !part.Wipe {
-		return nil
+// ResizeTo resizes the partition to newSize where it starts now, along with its filesystem unless it's wiped.
+func (part *Partition) ResizeTo(newSize int64) error {
+	if err := part.Unmount(); err != nil {
+		return fmt.Errorf("resize: %v", err)
 	}
 
 	partActual := part.Parted.GetPartition(false, part)
 	if partActual == nil {
 		return fmt.Errorf("resize: Actual partition %s not found", part.GetName())
 	}
-	output, err := Run(part.Parted.Config.Resize, fmt.Sprintf("%s %d", partActual.GetPath(), part.GetSizeBlocks512()))
-	if err != nil {
-		return fmt.Errorf("resize %s: %v", partActual.GetPath(), err)
+	oldSize := partActual.GetSize()
+	fs := GetFilesystem(partActual)
+	if part.Wipe {
+		fs = nil //The contents will be wiped, so there's no filesystem to keep
+	} else if fs == nil {
+		debug("resize: No filesystem driver for %s (%s), resizing the partition only", part.GetName(), *partActual.FS)
 	}
 
-	outputSplit := strings.Split(output, " ")
-	newBlocks := int64(0)
-	for i := 0; i < len(outputSplit); i++ {
-		outputTest := strings.Join(outputSplit[i:], " ")
-		_, err = fmt.Sscanf(outputTest, "%d blocks", &newBlocks)
-		if err == nil {
-			break
+	//Filesystems shrink before their partition does
+	if fs != nil && newSize < oldSize {
+		if err := fs.Shrink(partActual, newSize); err != nil {
+			return fmt.Errorf("resize: Failed to shrink %s on %s: %v", fs.Name(), partActual.GetPath(), err)
 		}
 	}
-	if newBlocks == 0 {
-		return fmt.Errorf("resize: Failed to scan new block count")
-	}
 
 	//Update the partition info in memory
-	newSize := newBlocks * part.Parted.SectorSizeLogical
+	partActual.superblock = nil
 	*partActual.Size = fmt.Sprintf("%dB", newSize)
-	*partActual.End = *partActual.Start + newSize
+	*partActual.End = *partActual.Start + newSize - 1
 
 	//Resize the actual partition using parted
-	_, err = part.Parted.ResizePart(*partActual.Number, *partActual.End)
+	_, err := part.Parted.ResizePart(*partActual.Number, *partActual.End)
 	if err != nil {
 		return fmt.Errorf("resize: Failed to call ResizePart: %v", err)
 	}
 
+	//Filesystems grow after their partition does
+	if fs != nil && newSize > oldSize {
+		if err := fs.Grow(partActual, newSize); err != nil {
+			return fmt.Errorf("resize: Failed to grow %s on %s: %v", fs.Name(), partActual.GetPath(), err)
+		}
+	}
+
 	return nil
 }
 
 func (part *Partition) Fsck() error {
-	part.Unmount()
-	if !part.Wipe {
+	if err := part.Unmount(); err != nil {
+		return fmt.Errorf("fsck: %v", err)
+	}
+	if part.Wipe {
 		return nil
 	}
 
@@ -96,8 +113,12 @@ func (part *Partition) Fsck() error {
 	if partActual == nil {
 		return fmt.Errorf("fsck: Actual partition %s not found", part.GetName())
 	}
-	_, err := Run(part.Parted.Config.Fsck, partActual.GetPath())
-	if err != nil {
+	fs := GetFilesystem(partActual)
+	if fs == nil {
+		debug("fsck: No filesystem driver for %s (%s), skipping", part.GetName(), *partActual.FS)
+		return nil
+	}
+	if err := fs.Check(partActual, true); err != nil {
 		return fmt.Errorf("fsck %s: %v", partActual.GetPath(), err)
 	}
 	return nil
@@ -127,15 +148,11 @@ func (part *Partition) GetSizeBlocks512() int64 {
 
 func (part *Partition) GetSizeHuman() string {
 	if part.Size == nil {
-		size := humanize.Bytes(0)
-		return size
+		return bytes(0)
 	}
 
-	//Rewrite the human size into the largest byte size
-	size := part.GetSize()
-	sizeHuman := humanize.Bytes(uint64(size))
-
-	return sizeHuman
+	//Rewrite the human size into the selected units
+	return bytes(part.GetSize())
 }
 
 //CheckValidOrPanic checks if the partition is valid, otherwise it panics
@@ -197,13 +214,17 @@ func (part *Partition) Close() error {
 }
 
 func (part *Partition) Read(offset int64, count int64) ([]byte, error) {
-	if err := part.Open(); err != nil {
-		return nil, err
+	reader := part.reader
+	if reader == nil {
+		if err := part.Open(); err != nil {
+			return nil, err
+		}
+		defer part.Close()
+		reader = part.File
 	}
-	defer part.Close()
 
 	data := make([]byte, count)
-	read, err := part.File.ReadAt(data, offset)
+	read, err := reader.ReadAt(data, offset)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
@@ -212,4 +233,45 @@ func (part *Partition) Read(offset int64, count int64) ([]byte, error) {
 	}
 
 	return data, nil
-}
\ No newline at end of file
+}
+//Info returns a description of the partition for reports
+func (part *Partition) Info() *PartitionInfo {
+	info := &PartitionInfo{Wipe: part.Wipe}
+	if part.Number != nil {
+		info.Number = *part.Number
+	}
+	if part.Name != nil {
+		info.Name = *part.Name
+	}
+	if part.Start != nil {
+		info.Start = *part.Start
+	}
+	if part.End != nil {
+		info.End = *part.End
+	}
+	if part.Size != nil {
+		info.Size = part.GetSize()
+	}
+	if part.FS != nil {
+		info.FS = *part.FS
+	}
+	if part.TypeGUID != nil {
+		info.TypeGUID = *part.TypeGUID
+	}
+	if part.UniqueGUID != nil {
+		info.UniqueGUID = *part.UniqueGUID
+	}
+	if part.Attributes != nil {
+		info.Attributes = *part.Attributes
+	}
+	if part.Flags != nil {
+		info.Flags = *part.Flags
+	}
+	if part.Kind != nil {
+		info.Kind = *part.Kind
+	}
+	if part.MBRType != nil {
+		info.MBRType = int(*part.MBRType)
+	}
+	return info
+}
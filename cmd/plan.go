@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// A DiskPlan is everything reparted will do to one disk, worked out before anything is modified.
+type DiskPlan struct {
+	Parted     *Parted
+	Plan       *Plan
+	Layout     map[string]int //Partition numbers by name before the changes, for fstab
+	Used       []Extent       //Byte ranges used by partitions before the changes, to discard what's freed
+	Reserved   []*Partition
+	UserData   []*Partition //The actual userdata partitions
+	Placements []*Placement //Where every reserved and userdata partition goes
+	Create     []*Placement
+	Shrink     []*Placement
+	Move       []*Placement //Partitions that move or grow, in the order it's safe to do it in
+	Backup     *TableBackup //The partition tables saved before Apply, if any
+}
+
+// PlanDisk works out how the reserved and userdata partitions of the disk must change to match the config,
+// checking that the result fits the partition table and, for dynamic partitions, super.
+func (p *Parted) PlanDisk() (*DiskPlan, error) {
+	plan := NewPlan()
+	plan.Disk = p.Config.Disk
+	plan.SlotLayout = p.SlotLayout()
+	dp := &DiskPlan{
+		Parted:   p,
+		Plan:     plan,
+		Layout:   p.Layout(),
+		Used:     p.UsedRanges(),
+		Reserved: make([]*Partition, 0),
+		Create:   make([]*Placement, 0),
+		Shrink:   make([]*Placement, 0),
+		Move:     make([]*Placement, 0),
+	}
+	if activeSlot != "" {
+		plan.ActiveSlot = activeSlot
+		p.LimitWipeToSlot(activeSlot)
+	}
+
+	// Store the reserved partitions, noting the ones that aren't on the disk yet.
+	create := make([]*Partition, 0)
+	for i := 0; i < len(p.Config.Reserved); i++ {
+		partReserved := p.Config.Reserved[i]
+		if p.GetPartition(false, partReserved) == nil {
+			log("Reserved partition %s could not be matched to disk, adding to create list", partReserved.GetName())
+			create = append(create, partReserved)
+			plan.Create = append(plan.Create, partReserved.GetName())
+		}
+		dp.Reserved = append(dp.Reserved, partReserved)
+	}
+
+	partsReservedUserData := p.GetUserDataPartitions(true)
+	dp.UserData = p.GetUserDataPartitions(false)
+	if len(dp.UserData) != len(partsReservedUserData) {
+		return nil, fmt.Errorf("Actual count of userdata partitions (%d) does not match count in config (%d), too risky", len(dp.UserData), len(partsReservedUserData))
+	}
+
+	sizeUserData := int64(0)
+	for i := 0; i < len(dp.UserData); i++ {
+		sb, err := dp.UserData[i].Probe()
+		if err != nil && dp.UserData[i].Resuming() {
+			warn("Userdata partition %d is partly copied to where it's moving, carrying on without its superblock", *dp.UserData[i].Number)
+		} else if *dp.UserData[i].FS == "" {
+			//parted doesn't know every filesystem, but the superblock does
+			if err != nil {
+				return nil, fmt.Errorf("Unknown filesystem on userdata partition %d: %v", *dp.UserData[i].Number, err)
+			}
+			*dp.UserData[i].FS = sb.Type
+		}
+		log("Actual userdata partition %d: %s", *dp.UserData[i].Number, *dp.UserData[i].FS)
+		if err == nil {
+			log("Userdata partition %d uses %s of %s (at least %s needed)", *dp.UserData[i].Number, bytes(sb.UsedSize()), bytes(sb.Size()), bytes(sb.MinSize))
+		}
+		sizeUserData += dp.UserData[i].GetSize()
+	}
+	plan.UserDataSize = sizeUserData
+
+	// MBR disks can only hold so many primary partitions, and the kind of a new one decides where it can go.
+	if err := p.AssignMBRKinds(create); err != nil {
+		return nil, fmt.Errorf("Plan doesn't fit the MBR: %v", err)
+	}
+
+	// Lay the partitions out, with userdata making up the difference.
+	if err := dp.PlanLayout(); err != nil {
+		return nil, fmt.Errorf("Failed to lay out partitions: %v", err)
+	}
+	reserve := sizeUserData
+	for i := 0; i < len(dp.Placements); i++ {
+		if dp.Placements[i].UserData {
+			reserve -= dp.Placements[i].Size
+		}
+	}
+	plan.Reserve = reserve
+
+	// A positive reserve size is the size that will be taken from userdata.
+	// A negative reserve size is the size that will be awarded to userdata.
+	if reserve > 0 {
+		log("Need to reserve %s from userdata for new partition table", bytes(reserve))
+	} else if reserve < 0 {
+		log("Need to award %s to userdata for new partition table", bytes(reserve * -1))
+	} else {
+		log("No additional space will be freed or reserved for new partition table")
+	}
+
+	for i := 0; i < len(dp.Placements); i++ {
+		pl := dp.Placements[i]
+		if pl.Actual == nil {
+			dp.Create = append(dp.Create, pl)
+			continue
+		}
+		oldSize := pl.Old.Length
+		if pl.Size < oldSize {
+			log("Added to shrink list: %s (%s -> %s)", pl.Name(), bytes(oldSize), bytes(pl.Size))
+			dp.Shrink = append(dp.Shrink, pl)
+			plan.Shrink = append(plan.Shrink, &PlanResize{Name: pl.Name(), From: oldSize, To: pl.Size})
+		} else if pl.Size > oldSize {
+			log("Added to grow list: %s (%s -> %s)", pl.Name(), bytes(oldSize), bytes(pl.Size))
+			plan.Grow = append(plan.Grow, &PlanResize{Name: pl.Name(), From: oldSize, To: pl.Size})
+		}
+		if pl.Moves() {
+			log("Added to move list: %s (%d -> %d)", pl.Name(), pl.Old.Offset, pl.Start)
+			plan.Move = append(plan.Move, pl.Name())
+		}
+	}
+
+	// Logical partitions must stay inside the extended one.
+	if err := p.CheckMBR(dp.Placements); err != nil {
+		return nil, fmt.Errorf("Plan doesn't fit the MBR: %v", err)
+	}
+	if err := dp.ScheduleMoves(); err != nil {
+		return nil, fmt.Errorf("Failed to order moves: %v", err)
+	}
+	if err := dp.CheckJournal(); err != nil {
+		return nil, err
+	}
+
+	// Plan the logical partitions inside super, reading the metadata of the slot being kept.
+	if p.Config.Super != nil {
+		slot := 0
+		if activeSlot == "b" {
+			slot = 1
+		}
+		super, err := p.PlanSuper(slot)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to plan dynamic partitions: %v", err)
+		}
+		p.Super = super
+		for i := 0; i < len(p.Config.Super.Partitions); i++ {
+			name := p.Config.Super.Partitions[i].GetName()
+			oldSize := p.Super.GetLogical(name).GetSize()
+			newSize := p.Config.Super.Partitions[i].GetSize()
+			if oldSize != newSize {
+				log("Added to logical resize list: %s (%s -> %s)", name, bytes(oldSize), bytes(newSize))
+				plan.Logical = append(plan.Logical, &PlanResize{Name: name, From: oldSize, To: newSize})
+			}
+		}
+	}
+
+	return dp, nil
+}
+
+// Targets returns the actual partitions the plan may change: the reserved and userdata partitions, and super.
+func (dp *DiskPlan) Targets() []*Partition {
+	p := dp.Parted
+	targets := make([]*Partition, 0)
+	for i := 0; i < len(dp.Reserved); i++ {
+		if partActual := p.GetPartition(false, dp.Reserved[i]); partActual != nil {
+			targets = append(targets, partActual)
+		}
+	}
+	targets = append(targets, dp.UserData...)
+	if p.Super != nil {
+		targets = append(targets, p.Super.Part)
+	}
+	return targets
+}
+
+// Steps returns the number of steps checking and applying the plan is expected to take, for the progress bar.
+func (dp *DiskPlan) Steps() int {
+	steps := len(dp.Reserved) + len(dp.Shrink) + len(dp.Create) //An fsck for each reserved partition, then the changes
+	if dp.Parted.Super != nil {
+		steps++
+	}
+	for i := 0; i < len(dp.Placements); i++ {
+		if dp.Placements[i].UserData && dp.Placements[i].Changes() {
+			steps++
+		}
+	}
+	for i := 0; i < len(dp.Move); i++ {
+		if dp.Move[i].Moves() {
+			steps++
+		}
+		if dp.Move[i].Size > dp.Move[i].Old.Length {
+			steps++
+		}
+	}
+	for i := 0; i < len(dp.Reserved); i++ {
+		if dp.Reserved[i].Wipe {
+			steps++
+		}
+		if dp.Reserved[i].Image != "" {
+			steps++
+		}
+	}
+	return steps + 1 //Verifying the result
+}
+
+// CheckOutside returns an error if path is on one of the partitions the plan may change, where a file written
+// during the run would be unmounted, moved or wiped from under reparted. what names the file in the error.
+func (dp *DiskPlan) CheckOutside(what, path string) error {
+	if path == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve %s %s: %v", what, path, err)
+	}
+	targets := dp.Targets()
+	for i := 0; i < len(targets); i++ {
+		held, err := targets[i].Holds(abs)
+		if err != nil {
+			return err
+		}
+		if held {
+			return fmt.Errorf("The %s %s is on %s, which the plan changes, put it somewhere else", what, path, targets[i].GetName())
+		}
+	}
+	return nil
+}
+
+// Filesystem magic numbers from linux/magic.h of filesystems that only live in memory.
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// warnVolatile warns if path is on a filesystem in memory, such as /tmp in recovery, where it's lost on reboot.
+// what names the file in the warning.
+func warnVolatile(what, path string) {
+	if path == "" {
+		return
+	}
+	st := &syscall.Statfs_t{}
+	dir := path
+	for {
+		err := syscall.Statfs(dir, st)
+		if err == nil {
+			break
+		}
+		if err != syscall.ENOENT || filepath.Dir(dir) == dir {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+	if uint32(st.Type) == tmpfsMagic || uint32(st.Type) == ramfsMagic {
+		warn("The %s %s is in memory and will be lost on reboot, put it on storage the plan doesn't change to keep it", what, path)
+	}
+}
+
+// Fsck checks the filesystems of every reserved partition that will be kept, and of the userdata partitions that
+// will be moved or resized.
+func (dp *DiskPlan) Fsck() error {
+	for i := 0; i < len(dp.Reserved); i++ {
+		step := stepBegin("fsck", dp.Reserved[i].GetName())
+		if dp.Reserved[i].Resuming() {
+			//Half of it is still to be copied to where the rest already is
+			step.Skip()
+			continue
+		}
+		err := dp.Reserved[i].Fsck()
+		step.Done(err)
+		if err != nil {
+			return fmt.Errorf("Failed to fsck %s: %v", dp.Reserved[i].GetName(), err)
+		}
+	}
+	for i := 0; i < len(dp.Placements); i++ {
+		pl := dp.Placements[i]
+		if !pl.UserData || !pl.Changes() {
+			continue
+		}
+		step := stepBegin("fsck", pl.Name())
+		if pl.Actual.Resuming() {
+			step.Skip()
+			continue
+		}
+		err := pl.Actual.Fsck()
+		step.Done(err)
+		if err != nil {
+			return fmt.Errorf("Failed to fsck %s: %v", pl.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Apply makes the planned changes to the disk: the dynamic partition metadata, then the partitions that shrink in
+// place, then the ones that move or grow in the order ScheduleMoves found, then the new partitions, then the
+// partitions marked for wiping, then the images of the partitions that have them. When super grows, its metadata
+// is written once it has grown instead.
+func (dp *DiskPlan) Apply() error {
+	p := dp.Parted
+
+	// Super must describe its new layout before it shrinks, so no extent is ever left outside it, and only once it
+	// has grown, so no extent is ever past its end.
+	writeLp := func() error {
+		log("Writing dynamic partition metadata to %s", p.Super.Part.GetName())
+		step := stepBegin("lp-metadata", p.Super.Part.GetName())
+		err := p.Super.Write()
+		step.Done(err)
+		if err != nil {
+			return fmt.Errorf("Failed to write dynamic partition metadata: %v", err)
+		}
+		return nil
+	}
+	superGrows := p.Super != nil && p.Super.Size > p.Super.Part.GetSize()
+	if p.Super != nil && !superGrows {
+		if err := writeLp(); err != nil {
+			return err
+		}
+	}
+
+	// Shrinking first frees the space the moves and grows need.
+	if len(dp.Shrink) > 0 {
+		log("Attempting to shrink partitions")
+		for i := 0; i < len(dp.Shrink); i++ {
+			pl := dp.Shrink[i]
+			step := stepBegin("shrink", pl.Name())
+			err := pl.Actual.ResizeTo(pl.Size)
+			step.Done(err)
+			if err != nil {
+				return fmt.Errorf("Failed to resize %s: %v", pl.Name(), err)
+			}
+			log("Resized %s: %s -> %s", pl.Name(), bytes(pl.Old.Length), bytes(pl.Actual.GetSize()))
+		}
+	}
+
+	for i := 0; i < len(dp.Move); i++ {
+		pl := dp.Move[i]
+		if dp.Backup != nil {
+			dp.Backup.Outdate(pl.Name())
+		}
+		if pl.Moves() {
+			log("Moving %s from %d to %d", pl.Name(), *pl.Actual.Start, pl.Start)
+			step := stepBegin("move", pl.Name())
+			err := pl.Actual.Move(pl.Start)
+			step.Done(err)
+			if err != nil {
+				return fmt.Errorf("Failed to move %s: %v", pl.Name(), err)
+			}
+		}
+		if oldSize := pl.Actual.GetSize(); pl.Size > oldSize {
+			step := stepBegin("grow", pl.Name())
+			err := pl.Actual.ResizeTo(pl.Size)
+			step.Done(err)
+			if err != nil {
+				return fmt.Errorf("Failed to resize %s: %v", pl.Name(), err)
+			}
+			log("Resized %s: %s -> %s", pl.Name(), bytes(oldSize), bytes(pl.Actual.GetSize()))
+		}
+	}
+	if superGrows {
+		if err := writeLp(); err != nil {
+			return err
+		}
+	}
+
+	if len(dp.Create) > 0 {
+		log("Creating partitions")
+		for i := 0; i < len(dp.Create); i++ {
+			pl := dp.Create[i]
+			step := stepBegin("create", pl.Name())
+			err := p.CreatePartition(pl.Config, pl.Start, pl.Size)
+			step.Done(err)
+			if err != nil {
+				return fmt.Errorf("Failed to create %s: %v", pl.Name(), err)
+			}
+		}
+
+		//parted numbers new partitions itself, so read them back before anything else looks for them
+		reloaded, err := p.Reload()
+		if err != nil {
+			return fmt.Errorf("Failed to reload partition table after creating partitions: %v", err)
+		}
+		reloaded.Super = p.Super
+		dp.Parted = reloaded
+		p = reloaded
+		for i := 0; i < len(dp.Create); i++ {
+			partReserved := dp.Create[i].Config
+			partActual := p.GetPartition(false, partReserved)
+			if partActual == nil {
+				return fmt.Errorf("Failed to create %s: Not found on the disk afterwards", partReserved.GetName())
+			}
+			if partReserved.Flags != nil && *partReserved.Flags != "" {
+				if _, err := p.Set(*partActual.Number, *partReserved.Flags, true); err != nil {
+					return fmt.Errorf("Failed to set flags of %s: %v", partReserved.GetName(), err)
+				}
+			}
+		}
+	}
+
+	log("Wiping partitions marked for wiping")
+	for i := 0; i < len(dp.Reserved); i++ {
+		if !dp.Reserved[i].Wipe {
+			continue
+		}
+		step := stepBegin("wipe", dp.Reserved[i].GetName())
+		err := dp.Reserved[i].WipeData()
+		step.Done(err)
+		if err != nil {
+			return fmt.Errorf("Failed to wipe %s: %v", dp.Reserved[i].GetName(), err)
+		}
+	}
+
+	for i := 0; i < len(dp.Reserved); i++ {
+		if dp.Reserved[i].Image == "" {
+			continue
+		}
+		partActual := p.GetPartition(false, dp.Reserved[i])
+		if partActual == nil {
+			return fmt.Errorf("Failed to flash %s: Actual partition not found", dp.Reserved[i].GetName())
+		}
+		log("Flashing %s to %s", dp.Reserved[i].Image, dp.Reserved[i].GetName())
+		step := stepBegin("flash", dp.Reserved[i].GetName())
+		err := partActual.Flash(dp.Reserved[i].Image)
+		step.Done(err)
+		if err != nil {
+			return fmt.Errorf("Failed to flash %s: %v", dp.Reserved[i].GetName(), err)
+		}
+	}
+	return nil
+}
+
+// Reload reads the partition table of the disk back, so everything after this sees what parted actually did,
+// then discards the space the new layout freed.
+func (dp *DiskPlan) Reload() error {
+	p, err := dp.Parted.Reload()
+	if err != nil {
+		return fmt.Errorf("Failed to reload partition table: %v", err)
+	}
+	dp.Parted = p
+
+	freed := freedRanges(dp.Used, p.UsedRanges())
+	if len(freed) > 0 && p.DiscardMode() != discardOff {
+		log("Discarding space freed by the new layout (%s)", p.DiscardMode())
+		for i := 0; i < len(freed); i++ {
+			step := stepBegin("discard", fmt.Sprintf("%s:%d-%d", p.Config.Disk, freed[i].Offset, freed[i].Offset+freed[i].Length-1))
+			err = p.Trim(freed[i].Offset, freed[i].Length)
+			step.Done(err)
+			if err != nil {
+				warn("Failed to discard %s at %d: %v", bytes(freed[i].Length), freed[i].Offset, err)
+			}
+		}
+	}
+	return nil
+}
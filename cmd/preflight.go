@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+)
+
+// A PreflightCheck is the result of checking that the data on a partition fits in its target size.
+type PreflightCheck struct {
+	Disk    string `json:"disk"`
+	Name    string `json:"name"`
+	FS      string `json:"fs"`
+	Size    int64  `json:"size"`    //The current size
+	Target  int64  `json:"target"`  //The size the plan shrinks it to
+	MinSize int64  `json:"minSize"` //The smallest size its data fits in, -1 if unknown
+	Source  string `json:"source"`  //Where MinSize came from: a filesystem driver, the superblock, the filesystem size or the partition size
+	OK      bool   `json:"ok"`
+}
+
+// Preflight checks that every partition the plan shrinks, including userdata and logical partitions inside super,
+// can hold their data at their target sizes. It doesn't modify anything, so it runs before any changes are made,
+// and returns an error if any target is too small.
+func (p *Parted) Preflight(plan *Plan) ([]*PreflightCheck, error) {
+	checks := make([]*PreflightCheck, 0)
+	for i := 0; i < len(plan.Shrink); i++ {
+		partActual := p.GetPartitionByName(false, plan.Shrink[i].Name)
+		if partActual == nil {
+			continue
+		}
+		checks = append(checks, p.preflightCheck(partActual, plan.Shrink[i].To))
+	}
+
+	if p.Super != nil {
+		for i := 0; i < len(plan.Logical); i++ {
+			if plan.Logical[i].To < plan.Logical[i].From {
+				checks = append(checks, p.preflightCheck(p.Super.GetLogical(plan.Logical[i].Name), plan.Logical[i].To))
+			}
+		}
+	}
+
+	//Images must fit the size the partition will have, not the one it has now
+	for i := 0; i < len(p.Config.Reserved); i++ {
+		if p.Config.Reserved[i].Image != "" {
+			checks = append(checks, p.preflightImage(p.Config.Reserved[i]))
+		}
+	}
+
+	failed := 0
+	for i := 0; i < len(checks); i++ {
+		check := checks[i]
+		if check.OK {
+			log("Preflight: %s (%s) fits, needs %s of %s (from %s)", check.Name, check.FS, bytes(check.MinSize), bytes(check.Target), check.Source)
+			continue
+		}
+		failed++
+		warn("Preflight: %s (%s) needs %s, %s more than its target of %s (from %s)", check.Name, check.FS, bytes(check.MinSize), bytes(check.MinSize-check.Target), bytes(check.Target), check.Source)
+	}
+	if failed > 0 {
+		return checks, fmt.Errorf("%d partition(s) would not fit their data", failed)
+	}
+	return checks, nil
+}
+
+// Work out the minimum size of a single partition, asking its filesystem driver first and falling back to the
+// native superblock. Partitions that are wiped don't keep their data, so anything fits.
+func (p *Parted) preflightCheck(partActual *Partition, target int64) *PreflightCheck {
+	check := &PreflightCheck{Disk: p.Config.Disk, Name: partActual.GetName(), FS: *partActual.FS, Size: partActual.GetSize(), Target: target, MinSize: -1}
+	if partActual.Wipe {
+		check.MinSize = 0
+		check.Source = "wipe"
+		check.OK = true
+		return check
+	}
+
+	if p.Super != nil && partActual == p.Super.Part {
+		//Super holds no filesystem, just the metadata and the extents of the logical partitions
+		check.FS = "super"
+		check.MinSize = p.Super.Metadata.MinSize()
+		check.Source = "lp metadata"
+		check.OK = check.MinSize <= check.Target
+		return check
+	}
+	//An AVB footer pins the end of the partition, so whatever is in front of it can't make it any smaller
+	if sb, err := partActual.Probe(); err == nil && sb.AVB != nil {
+		check.FS = sb.Type
+		check.MinSize = sb.MinSize
+		check.Source = "avb footer"
+		check.OK = check.MinSize <= check.Target
+		return check
+	}
+	//A logical partition shrinks by losing the end of its extents without its filesystem being resized, so it
+	//can't give up any of the space its filesystem covers
+	if partActual.reader != nil {
+		check.MinSize = check.Size
+		check.Source = "partition size"
+		if sb, err := partActual.Probe(); err == nil && sb.Size() > 0 {
+			check.FS = sb.Type
+			check.MinSize = sb.Size()
+			check.Source = "filesystem size"
+		}
+		check.OK = check.MinSize <= check.Target
+		return check
+	}
+	if fs := GetFilesystem(partActual); fs != nil {
+		check.FS = fs.Name()
+		minSize, err := fs.MinSize(partActual)
+		if err == nil {
+			check.MinSize = minSize
+			check.Source = fs.Name()
+		} else {
+			debug("Preflight: %s driver couldn't report the minimum size of %s: %v", fs.Name(), check.Name, err)
+		}
+	}
+	if check.MinSize < 0 {
+		if sb, err := partActual.Probe(); err == nil {
+			check.FS = sb.Type
+			check.MinSize = sb.MinSize
+			check.Source = "superblock"
+		}
+	}
+	if check.MinSize < 0 {
+		//Without knowing where the data is, a raw partition can't lose any of its space
+		check.MinSize = check.Size
+		check.Source = "partition size"
+	}
+
+	check.OK = check.MinSize <= check.Target
+	return check
+}
+
+// Check that the image of a reserved partition can be read and fits its configured size.
+func (p *Parted) preflightImage(partReserved *Partition) *PreflightCheck {
+	size := partReserved.GetSize()
+	check := &PreflightCheck{Disk: p.Config.Disk, Name: partReserved.GetName(), FS: "image", Size: size, Target: size, MinSize: -1, Source: "image " + partReserved.Image}
+	if partActual := p.GetPartition(false, partReserved); partActual != nil {
+		check.Size = partActual.GetSize()
+	}
+	imageSize, err := ImageSize(partReserved.Image)
+	if err != nil {
+		warn("Preflight: %v", err)
+		return check
+	}
+	check.MinSize = imageSize
+	check.OK = imageSize <= check.Target
+	return check
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	progressInterval = time.Second // The minimum time between two progress reports for the same operation
+	progressLogStep  = 0.05        // The minimum change in completion between two progress log lines
+)
+
+// A Progress tracks the completion of a long running operation, such as a copy, fsck or resize, and reports
+// it as log lines, JSON events and recovery progress commands.
+type Progress struct {
+	Action string // The operation, such as "copy" or "fsck"
+	Target string // The partition the operation acts on
+	Total  int64  // The amount of work to do, 0 if only fractions are reported
+	Bytes  bool   // Whether Total and Done count bytes, enabling throughput reports
+
+	done     int64
+	fraction float64
+	started  time.Time
+	reported time.Time
+	logged   float64
+	stage    string
+}
+
+// ProgressInfo is the JSON form of a progress report.
+type ProgressInfo struct {
+	Action   string  `json:"action"`
+	Target   string  `json:"target"`
+	Stage    string  `json:"stage,omitempty"`
+	Done     int64   `json:"done,omitempty"`
+	Total    int64   `json:"total,omitempty"`
+	Fraction float64 `json:"fraction"`
+	Rate     int64   `json:"rate,omitempty"` //Bytes per second
+	Finished bool    `json:"finished"`
+}
+
+func NewProgress(action, target string, total int64, bytes bool) *Progress {
+	now := time.Now()
+	return &Progress{Action: action, Target: target, Total: total, Bytes: bytes, started: now, reported: now, logged: -1}
+}
+
+// Add records that count more units of work have completed.
+func (pr *Progress) Add(count int64) {
+	pr.Set(pr.done + count)
+}
+
+// Set records that done units of work out of Total have completed.
+func (pr *Progress) Set(done int64) {
+	pr.done = done
+	if pr.Total > 0 {
+		pr.fraction = float64(done) / float64(pr.Total)
+	}
+	pr.report(false)
+}
+
+// SetFraction records the completion of operations that only report a fraction, such as external tools.
+func (pr *Progress) SetFraction(fraction float64) {
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	pr.fraction = fraction
+	pr.report(false)
+}
+
+// SetStage changes the stage of the operation, such as a pass of an external tool, and resets its completion.
+func (pr *Progress) SetStage(stage string) {
+	if stage == pr.stage {
+		return
+	}
+	pr.stage = stage
+	pr.fraction = 0
+	pr.logged = -1
+	pr.report(true)
+}
+
+// Finish reports the operation as complete.
+func (pr *Progress) Finish() {
+	if pr.Total > 0 {
+		pr.done = pr.Total
+	}
+	pr.fraction = 1
+	pr.report(true)
+}
+
+// Rate returns the throughput of the operation so far in bytes per second.
+func (pr *Progress) Rate() int64 {
+	elapsed := time.Since(pr.started).Seconds()
+	if !pr.Bytes || elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(pr.done) / elapsed)
+}
+
+func (pr *Progress) Info(finished bool) *ProgressInfo {
+	return &ProgressInfo{
+		Action:   pr.Action,
+		Target:   pr.Target,
+		Stage:    pr.stage,
+		Done:     pr.done,
+		Total:    pr.Total,
+		Fraction: pr.fraction,
+		Rate:     pr.Rate(),
+		Finished: finished,
+	}
+}
+
+func (pr *Progress) String() string {
+	desc := pr.Action + " " + pr.Target
+	if pr.stage != "" {
+		desc += " (" + pr.stage + ")"
+	}
+	desc += fmt.Sprintf(": %.1f%%", pr.fraction*100)
+	if pr.Bytes {
+		desc += fmt.Sprintf(", %s of %s at %s/s", bytes(pr.done), bytes(pr.Total), bytes(pr.Rate()))
+	}
+	return desc
+}
+
+// Report the progress everywhere it is wanted, rate limited unless forced.
+func (pr *Progress) report(force bool) {
+	finished := pr.fraction >= 1
+	if !force && !finished && time.Since(pr.reported) < progressInterval {
+		return
+	}
+	pr.reported = time.Now()
+
+	emit(&Event{Type: "progress", Progress: pr.Info(finished)})
+	recoverySetProgress(pr.fraction)
+	if force || finished || pr.fraction-pr.logged >= progressLogStep {
+		pr.logged = pr.fraction
+		log(pr.String())
+	}
+}
+
+// A lineWatcher splits streamed output into lines, treating carriage returns as line breaks too.
+type lineWatcher struct {
+	partial string
+	line    func(string)
+}
+
+func (lw *lineWatcher) Write(data []byte) {
+	lw.partial += string(data)
+	for {
+		end := strings.IndexAny(lw.partial, "\r\n")
+		if end < 0 {
+			return
+		}
+		line := lw.partial[:end]
+		lw.partial = lw.partial[end+1:]
+		if line != "" {
+			lw.line(line)
+		}
+	}
+}
+
+// The share of e2fsck's total runtime spent in each of its five passes.
+var e2fsckPassWeights = []float64{0.70, 0.20, 0.02, 0.05, 0.03}
+
+// watchE2fsck returns a watcher for the completion information e2fsck writes to the fd given by -C, in the
+// format "pass current max device".
+func watchE2fsck(pr *Progress) func([]byte) {
+	lw := &lineWatcher{line: func(line string) {
+		pass, current, max := 0, int64(0), int64(0)
+		if _, err := fmt.Sscanf(line, "%d %d %d", &pass, &current, &max); err != nil || pass < 1 || pass > len(e2fsckPassWeights) || max <= 0 {
+			return
+		}
+		fraction := 0.0
+		for i := 0; i < pass-1; i++ {
+			fraction += e2fsckPassWeights[i]
+		}
+		fraction += e2fsckPassWeights[pass-1] * float64(current) / float64(max)
+		pr.SetFraction(fraction)
+	}}
+	return lw.Write
+}
+
+// The number of X characters resize2fs -p prints for a complete pass.
+const resize2fsBarWidth = 40
+
+// watchResize2fs returns a watcher for the output of resize2fs -p, which announces each pass with
+// "Begin pass N (max = M)" and a label, then prints a bar of X characters as the pass progresses.
+func watchResize2fs(pr *Progress) func([]byte) {
+	inPass := false
+	marks := 0
+	line := ""
+	return func(data []byte) {
+		for i := 0; i < len(data); i++ {
+			switch data[i] {
+			case '\r', '\n':
+				pass, max := 0, int64(0)
+				if _, err := fmt.Sscanf(line, "Begin pass %d (max = %d)", &pass, &max); err == nil {
+					pr.SetStage(fmt.Sprintf("pass %d", pass))
+					inPass = true
+					marks = 0
+				} else if marks > 0 {
+					inPass = false
+				}
+				line = ""
+			case 'X':
+				if inPass {
+					marks++
+					pr.SetFraction(float64(marks) / resize2fsBarWidth)
+				}
+				line += string(data[i])
+			default:
+				line += string(data[i])
+			}
+		}
+	}
+}
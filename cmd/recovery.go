@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/JoshuaDoes/json"
+
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The pipe to Android recovery's command interpreter, if reparted was given one.
+var recoveryPipe *os.File
+
+// Open the recovery command pipe from the file descriptor recovery passed to us.
+func openRecoveryPipe(fd int) error {
+	pipe := os.NewFile(uintptr(fd), "recovery-pipe")
+	if pipe == nil {
+		return fmt.Errorf("Invalid recovery pipe file descriptor %d", fd)
+	}
+	recoveryPipe = pipe
+	return nil
+}
+
+// Send a single command to recovery, doing nothing when there is no recovery pipe.
+func recoveryCommand(cmd string) {
+	if recoveryPipe == nil {
+		return
+	}
+	fmt.Fprintf(recoveryPipe, "%s\n", cmd)
+}
+
+// Print a message on the recovery screen, one ui_print per line.
+func recoveryPrint(msg string) {
+	lines := strings.Split(msg, "\n")
+	for i := 0; i < len(lines); i++ {
+		recoveryCommand("ui_print " + lines[i])
+	}
+}
+
+// The bar is shared evenly between the steps the run is expected to take, so it fills once over the whole run
+// instead of once for every step.
+var (
+	recoverySteps     = 1   // The number of steps the run is expected to take
+	recoveryStepsDone = 0   // The number of steps finished since then
+	recoveryShown     = 0.0 // The fraction of the bar last filled, it never goes back
+)
+
+// Set the number of steps the rest of the run is expected to take.
+func recoveryExpectSteps(steps int) {
+	if steps < 1 {
+		steps = 1
+	}
+	recoverySteps = steps
+	recoveryStepsDone = 0
+}
+
+// Count a step as finished, filling its share of the bar.
+func recoveryStepDone() {
+	recoveryStepsDone++
+	recoverySetProgress(0)
+}
+
+// Set how much of the running step is done, filling the bar up to the same point of its share.
+func recoverySetProgress(fraction float64) {
+	overall := (float64(recoveryStepsDone) + fraction) / float64(recoverySteps)
+	if overall > 1 {
+		overall = 1 //More steps than expected, the bar waits at the end
+	}
+	if overall <= recoveryShown {
+		return
+	}
+	recoveryShown = overall
+	recoveryCommand(fmt.Sprintf("set_progress %f", overall))
+}
+
+// The name of the configuration inside a flashable zip.
+const updateConfig = "reparted.json"
+
+// UpdateBinary holds the arguments recovery passes to META-INF/com/google/android/update-binary.
+type UpdateBinary struct {
+	API int    // The recovery API version
+	FD  int    // The file descriptor of the recovery command pipe
+	Zip string // The path to the zip being flashed
+}
+
+// parseUpdateBinaryArgs returns the update-binary arguments if reparted was run by recovery as
+// "update-binary <api> <fd> <zip>", or nil if it was run normally.
+func parseUpdateBinaryArgs(args []string) *UpdateBinary {
+	if len(args) != 4 || !strings.HasSuffix(strings.ToLower(args[3]), ".zip") {
+		return nil
+	}
+	ub := &UpdateBinary{Zip: args[3]}
+	if _, err := fmt.Sscanf(args[1], "%d", &ub.API); err != nil {
+		return nil
+	}
+	if _, err := fmt.Sscanf(args[2], "%d", &ub.FD); err != nil {
+		return nil
+	}
+	return ub
+}
+
+// Config reads the reparted configuration from the zip, and extracts any tools the configuration refers to
+// by a relative path (such as "./parted") into the working directory so they can be run.
+func (ub *UpdateBinary) Config() ([]byte, error) {
+	z, err := zip.OpenReader(ub.Zip)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open zip %s: %v", ub.Zip, err)
+	}
+	defer z.Close()
+
+	cfgJSON, err := readZipFile(&z.Reader, updateConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	partedCfg := &PartedConfig{}
+	if err := json.Unmarshal(cfgJSON, &partedCfg); err != nil {
+		return nil, fmt.Errorf("Failed to load JSON from %s in %s: %v", updateConfig, ub.Zip, err)
+	}
+	tools := []string{partedCfg.Parted, partedCfg.Fsck, partedCfg.Resize}
+	for i := 0; i < len(tools); i++ {
+		tool := strings.Split(tools[i], " ")[0]
+		if tool == "" || filepath.IsAbs(tool) {
+			continue
+		}
+		data, err := readZipFile(&z.Reader, filepath.ToSlash(filepath.Clean(tool)))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(tool, data, 0755); err != nil {
+			return nil, fmt.Errorf("Failed to extract %s from %s: %v", tool, ub.Zip, err)
+		}
+	}
+
+	return cfgJSON, nil
+}
+
+func readZipFile(z *zip.Reader, name string) ([]byte, error) {
+	f, err := z.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find %s in zip: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s from zip: %v", name, err)
+	}
+	return data, nil
+}
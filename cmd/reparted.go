@@ -4,11 +4,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
-
-	"github.com/dustin/go-humanize"
+	"strings"
 	//"github.com/JoshuaDoes/json"
 )
 
@@ -25,177 +25,432 @@ var (
 )
 
 func main() {
-	// Create a new Parted struct and initialize it with configuration data from a JSON file.
-	p, err := NewParted(filepath.Base(os.Args[0]) + ".json")
+	logLevelName := "info"
+	unitsName := sizeUnits
+	logPath := ""
+	recoveryFD := -1
+	flag.StringVar(&outputMode, "output", outputText, "Output format, either text or json")
+	flag.StringVar(&logLevelName, "log-level", logLevelName, "Minimum level of console messages: debug, info, warn or error")
+	flag.StringVar(&logPath, "log-file", "", "Path to the persistent log file, overriding logFile in the config")
+	flag.StringVar(&unitsName, "units", unitsName, "Units of sizes in logs and reports: iec, si, bytes or sectors")
+	flag.BoolVar(&noDiscard, "no-discard", noDiscard, "Don't discard or zero space freed by the new layout")
+	flag.StringVar(&activeSlot, "slot", "", "Slot to keep, a, b or auto to detect the booted one, so only the other slot is wiped or flashed")
+	flag.BoolVar(&imageSparse, "sparse", imageSparse, "Dump partitions as Android sparse images, leaving out space their filesystem doesn't use")
+	flag.StringVar(&imageCompress, "compress", "", "Compression of dumped images, gzip, zstd or none, from the file extension by default")
+	flag.BoolVar(&assumeYes, "yes", assumeYes, "Make changes without asking for confirmation, required when not on a terminal")
+	flag.IntVar(&recoveryFD, "recovery-fd", recoveryFD, "File descriptor of the recovery command pipe for ui_print and progress reports")
+
+	// When flashed from a zip, recovery runs us as update-binary with its own arguments instead of our flags.
+	update := parseUpdateBinaryArgs(os.Args)
+	command := ""
+	if update != nil {
+		recoveryFD = update.FD
+	} else {
+		flag.Parse()
+		command = flag.Arg(0)
+	}
+	if recoveryFD >= 0 {
+		if err := openRecoveryPipe(recoveryFD); err != nil {
+			fatal("%v", err)
+		}
+	}
+	if outputMode != outputText && outputMode != outputJSON {
+		fatal("Unknown output format %s", outputMode)
+	}
+	switch command {
+	case "", "verify":
+	case "dump", "flash":
+		if flag.NArg() != 3 {
+			fatal("Usage: %s %s <partition> <image>", filepath.Base(os.Args[0]), command)
+		}
+	default:
+		fatal("Unknown command %s", command)
+	}
+	level, err := ParseLogLevel(logLevelName)
 	if err != nil {
-		fatal("Failed to create parted instance: %v", err)
+		fatal("%v", err)
+	}
+	logLevel = level
+	if sizeUnits, err = ParseUnits(unitsName); err != nil {
+		fatal("%v", err)
 	}
 
-	log("Loaded parted for disk " + p.Config.Disk)
-	defer p.Close()
+	// Open every disk in the configuration, loaded from a JSON file or the zip we were flashed from.
+	var disks []*Parted
+	if update != nil {
+		imageZip = update.Zip
+		assumeYes = true //Flashing the zip is the confirmation, and recovery has no terminal to ask on
+		recoveryCommand("progress 1.0 0") //Claim the whole progress bar, we report with set_progress
+		log("Running as update-binary from %s (recovery API %d)", update.Zip, update.API)
+		cfgJSON, err := update.Config()
+		if err != nil {
+			fatal("Failed to load configuration from zip: %v", err)
+		}
+		disks, err = NewDisksJSON(cfgJSON, update.Zip + ":" + updateConfig)
+		if err != nil {
+			fatal("Failed to create parted instance: %v", err)
+		}
+	} else {
+		disks, err = NewDisks(filepath.Base(os.Args[0]) + ".json")
+		if err != nil {
+			fatal("Failed to create parted instance: %v", err)
+		}
+	}
+	cfg := disks[0].Config //Logging and fstab are shared by every disk
+	if disks[0].SectorSizeLogical > 0 {
+		sizeSector = disks[0].SectorSizeLogical
+	}
 
-	// Print out information about the disk and its partitions.
-	/*for i := 0; i < len(p.Partitions); i++ {
-		partJSON, err := json.Marshal(p.Partitions[i], false)
-		if err == nil {
-			log(string(partJSON))
+	if logPath == "" {
+		logPath = cfg.LogFile
+	}
+	if logPath != "" {
+		if err := openLog(logPath); err != nil {
+			warn("%v", err)
 		}
-	}*/
+	} else {
+		logBacklog = nil //Nowhere to write it
+	}
+	defer closeLog()
+	logRun = cfg.LogRun
 
-	log("Disk model: %s", p.DiskModel)
-	log("Disk total size: %s (%s logical / %s physical)", bytes(p.DiskSize), bytes(p.SectorSizeLogical), bytes(p.SectorSizePhysical))
-	log("Disk flags: %s", p.DiskFlags)
-	log("Partition table: %s", p.PartitionTable)
-	log("Size of partition table: %s (partitions: %s)", bytes(p.TableSize), bytes(p.PartsSize))
+	reservedCount := 0
+	for _, p := range disks {
+		log("Loaded parted for disk " + p.Config.Disk)
+		defer p.Close()
 
-	// Calculate the total amount of space that needs to be reserved for the new partition table.
-	// Store the reserved partitions and the actual partitions that will be modified.
-	reserve := int64(0)
-	partsReserved := make([]*Partition, 0)
-	partsCreate := make([]*Partition, 0)
-	for i := 0; i < len(p.Config.Reserved); i++ {
-		// Add the expected reservation to the total reserve size.
-		partReserved := p.Config.Reserved[i]
-		reservedSize := partReserved.GetSize()
-		reserve += reservedSize
+		log("Disk model: %s", p.DiskModel)
+		log("Disk total size: %s (%s logical / %s physical)", bytes(p.DiskSize), bytes(p.SectorSizeLogical), bytes(p.SectorSizePhysical))
+		log("Disk flags: %s", p.DiskFlags)
+		log("Partition table: %s", p.PartitionTable)
+		log("Size of partition table: %s (partitions: %s)", bytes(p.TableSize), bytes(p.PartsSize))
+		result.Disks = append(result.Disks, NewDiskInfo(p))
+		for i := 0; i < len(slotSuffixes); i++ {
+			if boot := p.GetPartitionByName(false, "boot"+slotSuffixes[i]); boot != nil && boot.Attributes != nil {
+				log("Slot %s: %s", slotSuffixes[i][1:], slotAttrString(*boot.Attributes))
+			}
+		}
+		reservedCount += len(p.Config.Reserved)
+	}
+	result.Disk = result.Disks[0]
 
-		// Check if the reserved partition matches an existing partition on the disk.
-		partActual := p.GetPartition(false, partReserved)
-		if partActual == nil {
-			log("Reserved partition %s could not be matched to disk, adding to create list", partReserved.GetName())
-			partsCreate = append(partsCreate, partReserved)
+	// Dumping and flashing work on one partition by name, whichever disk it's on. Both arguments are there, the
+	// command check above made sure of it.
+	if command == "dump" || command == "flash" {
+		name, path := flag.Arg(1), flag.Arg(2)
+		var part *Partition
+		for _, p := range disks {
+			if part = p.GetPartitionByName(false, name); part != nil {
+				break
+			}
 		}
+		if part == nil {
+			fatal("Partition %s not found", name)
+		}
+		if command == "dump" {
+			//An image of a filesystem that's being written to wouldn't be consistent
+			if err := part.CheckSettled(); err != nil {
+				fatal("Refusing to dump %s: %v", name, err)
+			}
+			compression := imageCompress
+			if compression == "" {
+				compression = imageCompression(path)
+			}
+			step := stepBegin("dump", name)
+			err = part.Dump(path, imageSparse, compression)
+			step.Done(err)
+			if err != nil {
+				fatal("%v", err)
+			}
+			log("Dumped %s to %s", name, path)
+		} else {
+			summary := fmt.Sprintf("Flash %s to %s on %s (%s)\nWARNING:\n  All data on %s will be overwritten", path, name, part.Parted.Config.Disk, bytes(part.GetSize()), name)
+			if err := Confirm(summary); err != nil {
+				fatal("%v", err)
+			}
+			if err := part.Parted.Release([]*Partition{part}); err != nil {
+				fatal("Partition %s is busy: %v", name, err)
+			}
+			part.Parted.AllowWrites([]Extent{{Offset: *part.Start, Length: part.GetSize()}})
+			step := stepBegin("flash", name)
+			err = part.Flash(path)
+			step.Done(err)
+			if err != nil {
+				fatal("%v", err)
+			}
+			log("Flashed %s to %s", path, name)
+		}
+		finish(nil)
+		return
+	}
 
-		// Remove the actual size of the existing partition from the total reserve count.
-		// If reserve is 300MiB and actual is 400MiB, subtracting 400MiB results in -100MiB.
-		actualSize := partActual.GetSize()
-		reserve -= actualSize // Subtract only the amount that's already reserved.
+	if reservedCount == 0 {
+		fatal("No reserved partitions specified for resizing")
+	}
 
-		//Add the reserved partition to the reserved partitions list
-		partsReserved = append(partsReserved, partReserved)
+	// Verifying on its own only compares the disks to the config, without planning or changing anything.
+	// Partitions hashed in the manifest of an earlier run must still hold the same bytes.
+	if command == "verify" {
+		var hashes []map[string]*ContentHash
+		if cfg.Manifest != "" {
+			if _, err := os.Stat(cfg.Manifest); err == nil {
+				manifest, err := ReadManifest(cfg.Manifest)
+				if err != nil {
+					fatal("%v", err)
+				}
+				for _, p := range disks {
+					hashes = append(hashes, manifest.Disk(p.Config.Disk).Hashes())
+				}
+			}
+		}
+		recoveryExpectSteps(len(disks))
+		if !verifyDisks(disks, hashes) {
+			fatal("Disks don't match the config")
+		}
+		finish(nil)
+		return
 	}
-	for i := 0; i < len(p.Partitions); i++ {
-		if *p.Partitions[i].Number != 0 || *p.Partitions[i].FS != "Free Space" {
-			continue
+
+	// The boot partitions that say which slot is active may be on any of the disks.
+	if activeSlot == "auto" {
+		for _, p := range disks {
+			activeSlot, err = p.DetectActiveSlot()
+			if err == nil {
+				break
+			}
 		}
-		reserve -= p.Partitions[i].GetSize() //Subtract actual free space from the size we must reserve from userdata
+		if err != nil {
+			fatal("Failed to detect active slot: %v", err)
+		}
+		log("Detected active slot %s", activeSlot)
+	}
+	if activeSlot != "" && activeSlot != "a" && activeSlot != "b" {
+		fatal("Unknown slot %s", activeSlot)
 	}
 
-	if len(partsReserved) == 0 {
-		fatal("No reserved partitions specified for resizing")
+	// Plan every disk before touching any of them, so one plan covers them all.
+	plans := make([]*DiskPlan, 0)
+	for _, p := range disks {
+		if len(disks) > 1 {
+			log("Planning changes to %s", p.Config.Disk)
+		}
+		dp, err := p.PlanDisk()
+		if err != nil {
+			fatal("Failed to plan %s: %v", p.Config.Disk, err)
+		}
+		plans = append(plans, dp)
+		result.Plans = append(result.Plans, dp.Plan)
 	}
+	result.Plan = result.Plans[0]
 
-	// Calculate space to be freed or reserved for new partition table.
-	// A positive reserve size is the size that will be taken from userdata.
-	// A negative reserve size is the size that will be awarded to userdata.
-	if reserve > 0 {
-		log("Need to reserve %s from userdata for new partition table", bytes(reserve))
-	} else if reserve < 0 {
-		log("Need to award %s to userdata for new partition table", bytes(reserve * -1))
-	} else {
-		log("No additional space will be freed or reserved for new partition table")
+	steps := 0
+	for _, dp := range plans {
+		steps += dp.Steps()
+	}
+	if cfg.Manifest != "" {
+		steps++
 	}
+	if cfg.Fstab != nil {
+		steps++
+	}
+	recoveryExpectSteps(steps)
 
-	partsReservedUserData := p.GetUserDataPartitions(true)
-	if len(partsReservedUserData) == 0 {
-		fatal("No userdata partitions specified for resizing")
+	// The log, the manifest and the copy journals must outlive the run, so they can't be on a partition that's
+	// unmounted or wiped along the way, and shouldn't be lost on reboot either.
+	warnVolatile("log file", logPath)
+	warnVolatile("manifest", cfg.Manifest)
+	for _, dp := range plans {
+		if dp.Parted.Config.Copy != nil {
+			warnVolatile("copy journal", dp.Parted.Config.Copy.Journal)
+		}
+	}
+	for _, dp := range plans {
+		if err := dp.CheckOutside("log file", logPath); err != nil {
+			fatal("%v", err)
+		}
+		if err := dp.CheckOutside("manifest", cfg.Manifest); err != nil {
+			fatal("%v", err)
+		}
+		for _, other := range plans {
+			if other.Parted.Config.Copy == nil {
+				continue
+			}
+			if err := dp.CheckOutside("copy journal", other.Parted.Config.Copy.Journal); err != nil {
+				fatal("%v", err)
+			}
+		}
 	}
 
-	partsActualUserData := p.GetUserDataPartitions(false)
-	if len(partsActualUserData) != len(partsReservedUserData) {
-		fatal("Actual count of userdata partitions (%d) does not match count in config (%d), too risky", len(partsActualUserData), len(partsReservedUserData))
+	// Make sure the data on every partition that shrinks still fits before anything is modified.
+	log("Checking minimum sizes of partitions that will shrink")
+	failed := false
+	for _, dp := range plans {
+		checks, err := dp.Parted.Preflight(dp.Plan)
+		result.Preflight = append(result.Preflight, checks...)
+		if err != nil {
+			logAt(LevelError, "Preflight of %s failed: %v", dp.Parted.Config.Disk, err)
+			failed = true
+		}
+	}
+	if failed {
+		fatal("Preflight failed, refusing to apply plan")
 	}
 
-	sizeUserData := int64(0)
-	for i := 0; i < len(partsActualUserData); i++ {
-		if *partsActualUserData[i].FS == "" {
-			panic(fmt.Sprintf("Unknown partition type for userdata partition %d", *partsActualUserData[i].Number))
+	// Everything up to here only read the disks, so this is the last chance to back out.
+	summaries := make([]string, 0)
+	for _, dp := range plans {
+		summaries = append(summaries, dp.DescribePlan())
+	}
+	if err := Confirm(strings.Join(summaries, "\n\n")); err != nil {
+		fatal("%v", err)
+	}
+
+	// The manifest is opened while everything is still mounted, keeping the last run's hashes for a copy it cut
+	// short, which can only be checked against them.
+	previous := &Manifest{Disks: make([]*ManifestDisk, 0)}
+	var manifestFile *os.File
+	if cfg.Manifest != "" {
+		if _, err := os.Stat(cfg.Manifest); err == nil {
+			if previous, err = ReadManifest(cfg.Manifest); err != nil {
+				fatal("%v", err)
+			}
 		}
-		log("Actual userdata partition %d: %s", *partsActualUserData[i].Number, *partsActualUserData[i].FS)
-		sizeUserData += partsActualUserData[i].GetSize()
+		if manifestFile, err = OpenManifest(cfg.Manifest); err != nil {
+			fatal("%v", err)
+		}
+		defer manifestFile.Close()
 	}
-	if reserve > sizeUserData {
-		fatal("Need to reserve %s, %s larger than size of userdata %s", bytes(reserve), bytes(reserve - sizeUserData), bytes(sizeUserData))
+
+	// Nothing may be using a partition that's about to change.
+	log("Checking partitions that will change aren't in use")
+	for _, dp := range plans {
+		if err := dp.Parted.Release(dp.Targets()); err != nil {
+			fatal("Partitions of %s are busy: %v", dp.Parted.Config.Disk, err)
+		}
 	}
 
-	log("Running fsck on partitions that must be wiped")
-	for i := 0; i < len(partsReserved); i++ {
-		err = partsReserved[i].Fsck()
+	log("Running fsck on partitions that will be kept")
+	for _, dp := range plans {
+		if err := dp.Fsck(); err != nil {
+			fatal("%v", err)
+		}
+	}
+
+	// Partitions that move or resize keep their data, so hash it now to prove it's the same afterwards.
+	manifest := &Manifest{Disks: make([]*ManifestDisk, 0)}
+	hashes := make([]map[string]*ContentHash, 0)
+	for _, dp := range plans {
+		md, err := dp.HashPreserved(previous.Disk(dp.Parted.Config.Disk))
+		if err != nil {
+			fatal("Failed to hash partitions that will be kept: %v", err)
+		}
+		manifest.Disks = append(manifest.Disks, md)
+		hashes = append(hashes, md.Hashes())
+	}
+	result.Manifest = manifest
+	if manifestFile != nil {
+		step := stepBegin("manifest", cfg.Manifest)
+		err = manifest.Write(manifestFile)
+		step.Done(err)
 		if err != nil {
-			fatal("Failed to fsck %s: %v", partsReserved[i].GetName(), err)
+			fatal("%v", err)
 		}
 	}
 
-	partsShrink := make([]*Partition, 0)
-	partsGrow := make([]*Partition, 0)
-	partsMove := make([]*Partition, 0)
-	for i := 0; i < len(partsReserved); i++ {
-		partActual := p.GetPartition(false, partsReserved[i])
-		oldSize := partActual.GetSize()
-		if partsReserved[i].GetSize() < oldSize {
-			log("Added to shrink list: %s (%d -> %d)", partsReserved[i].GetName(), oldSize, partsReserved[i].GetSize())
-			partsShrink = append(partsShrink, partsReserved[i])
-		} else if partsReserved[i].GetSize() > oldSize {
-			log("Added to grow list: %s (%d -> %d)", partsReserved[i].GetName(), oldSize, partsReserved[i].GetSize())
-			partsGrow = append(partsGrow, partsReserved[i])
+	// Save every partition table first, so a failure on any disk puts all of them back the way they were until a
+	// partition starts to move or grow, then approve the plan, which is the first time any disk may be written to.
+	for _, dp := range plans {
+		backup, err := dp.Parted.BackupTables()
+		if err != nil {
+			fatal("Failed to back up partition table of %s: %v", dp.Parted.Config.Disk, err)
+		}
+		backups = append(backups, backup)
+		dp.Backup = backup
+		dp.Parted.AllowWrites(dp.WriteRanges(backup))
+	}
+	for _, dp := range plans {
+		if len(plans) > 1 {
+			log("Applying changes to %s", dp.Parted.Config.Disk)
 		}
-		if partsReserved[i].Number == nil {
-			log("Added to move list: %s", partsReserved[i].GetName())
-			partsMove = append(partsMove, partsReserved[i])
+		if err := dp.Apply(); err != nil {
+			fatal("%v", err)
 		}
 	}
+	backups = nil //Every disk has its new layout now, there's nothing left to roll back to
 
-	if len(partsShrink) > 0 {
-		log("Attempting to shrink partitions")
-		for i := 0; i < len(partsShrink); i++ {
-			partActual := p.GetPartition(false, partsShrink[i])
-			oldSize := partActual.GetSize()
-			if partsShrink[i].GetSize() > oldSize {
-				log("Skipping shrinking of %s (%d is greater than %d)", partsShrink[i].GetName(), oldSize, partsShrink[i].GetSize())
-				continue
-			}
-			err = partsShrink[i].Resize()
-			if err != nil {
-				fatal("Failed to resize %s: %v", partsShrink[i].GetName(), err)
-			}
-			log("Requested size: %d", partsShrink[i].GetSize())
-			log("Resized %s: %d -> %d", partsShrink[i].GetName(), oldSize, partActual.GetSize())
+	layouts := make([]map[string]int, 0)
+	reloaded := make([]*Parted, 0)
+	for _, dp := range plans {
+		if err := dp.Reload(); err != nil {
+			fatal("%v", err)
 		}
+		defer dp.Parted.Close()
+		layouts = append(layouts, dp.Layout)
+		reloaded = append(reloaded, dp.Parted)
+	}
+
+	if cfg.Fstab != nil {
+		step := stepBegin("fstab", cfg.Fstab.Input)
+		err = WriteFstabs(cfg.Fstab, reloaded, layouts)
+		step.Done(err)
+		if err != nil {
+			fatal("Failed to generate fstab: %v", err)
+		}
+	}
+
+	// Nothing confirms the result like reading it back from scratch.
+	if !verifyDisks(reloaded, hashes) {
+		fatal("Verification failed, the disks don't match the config")
 	}
-}
 
-// Convert a number of bytes to a human-readable string.
-func bytes(num int64) string {
-	return humanize.Bytes(uint64(num))
+	finish(nil)
 }
 
-// Print a log message.
-func log(msg ...interface{}) {
-	if len(msg) > 0 {
-		fmt.Printf(logPrefix)
-		logMsg := msg[0].(string)
-		if len(msg) > 1 {
-			logMsg = fmt.Sprintf(msg[0].(string), msg[1:]...)
+// Verify every disk as its own step, returning whether they all passed. hashes may be nil, or hold the content
+// hashes of each disk in the same order.
+func verifyDisks(disks []*Parted, hashes []map[string]*ContentHash) bool {
+	ok := true
+	for i, p := range disks {
+		var hash map[string]*ContentHash
+		if hashes != nil {
+			hash = hashes[i]
 		}
-		for {
-			if logMsg[len(logMsg)-1] != '\n' {
-				break
-			}
-			logMsg = string(logMsg[:len(logMsg)-1])
+		step := stepBegin("verify", p.Config.Disk)
+		checks, err := p.Verify(hash)
+		step.Done(err)
+		result.Verify = append(result.Verify, checks...)
+		if err != nil {
+			logAt(LevelError, "%v", err)
+			ok = false
 		}
-		fmt.Println(logMsg)
 	}
+	return ok
+}
+
+// Print a log message.
+func log(msg ...interface{}) {
+	logAt(LevelInfo, msg...)
 }
 
 // Print a fatal error message and exit the program.
 //
 // This function is similar to the log() function, but it also prints the
 // "!!!FATAL!!!" log message and exits the program with a non-zero exit code.
+// Partition tables saved before the plan was applied are restored first.
+// In JSON output mode, the failed result document is emitted before exiting.
 func fatal(msg ...interface{}) {
+	errMsg := ""
 	if len(msg) >= 1 {
+		errMsg = msg[0].(string)
+		if len(msg) > 1 {
+			errMsg = fmt.Sprintf(errMsg, msg[1:]...)
+		}
 		fatalMsg := "!!!FATAL!!! " + msg[0].(string)
 		msg[0] = fatalMsg
 	}
-	log(msg...)
+	logAt(LevelError, msg...)
+	rollback()
+	finish(fmt.Errorf("%s", errMsg))
+	closeLog()
 	os.Exit(1)
 }
@@ -1,22 +1,108 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
 func Run(prog, args string) (string, error) {
+	return RunWatch(prog, args, nil, nil)
+}
+
+// A watchWriter passes everything written to it to a watcher while keeping a copy.
+type watchWriter struct {
+	buf []byte
+	watch func([]byte)
+}
+
+func (ww *watchWriter) Write(data []byte) (int, error) {
+	ww.buf = append(ww.buf, data...)
+	if ww.watch != nil {
+		ww.watch(data)
+	}
+	return len(data), nil
+}
+
+// RunWatch is like Run, but passes the output to watchOutput as it arrives. If watchFD is not nil, a pipe is
+// passed to the program as file descriptor 3 and anything written to it is passed to watchFD, for programs that
+// report progress on a separate file descriptor.
+func RunWatch(prog, args string, watchOutput func([]byte), watchFD func([]byte)) (string, error) {
+	ret, code, err := RunCode(prog, args, watchOutput, watchFD)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exit status %d", code)
+	}
+	if len(ret) > 0 || (err != nil && err.Error() == "signal: aborted") {
+		err = nil //Hack to get around programs that exit non-zero or abort, we always want the output
+	}
+	return ret, err
+}
+
+// RunCode is like RunWatch, but returns the exit code of the program instead of hiding it, for programs whose
+// exit code carries meaning (such as e2fsck). The error is only set if the program could not run to completion.
+func RunCode(prog, args string, watchOutput func([]byte), watchFD func([]byte)) (string, int, error) {
 	cmd := strings.Split(prog, " ")
 	cmdArgs := strings.Split(args, " ")
 	if len(cmd) > 0 {
 		cmdArgs = append(cmd[1:], cmdArgs...)
 	}
 
-	ret, err := exec.Command(cmd[0], cmdArgs...).CombinedOutput()
-	if len(ret) > 0 || (err != nil && err.Error() == "signal: aborted") {
-		err = nil //Hack to get around programs that exit non-zero or abort, we always want the output
+	output := &watchWriter{watch: watchOutput}
+	run := exec.Command(cmd[0], cmdArgs...)
+	run.Stdout = output
+	run.Stderr = output
+
+	var err error
+	if watchFD != nil {
+		r, w, pipeErr := os.Pipe()
+		if pipeErr != nil {
+			return "", -1, fmt.Errorf("Failed to create progress pipe for %s: %v", cmd[0], pipeErr)
+		}
+		run.ExtraFiles = []*os.File{w}
+		done := make(chan bool)
+		go func() {
+			data := make([]byte, 4096)
+			for {
+				n, err := r.Read(data)
+				if n > 0 {
+					watchFD(data[:n])
+				}
+				if err != nil {
+					break
+				}
+			}
+			r.Close()
+			done <- true
+		}()
+		err = run.Start()
+		w.Close() //Only the program holds the write end now, so the reader stops when it exits
+		if err == nil {
+			err = run.Wait()
+		}
+		<-done
+	} else {
+		err = run.Run()
+	}
+
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+		code = exitErr.ExitCode()
+		err = nil
+	} else if err != nil {
+		code = -1
+	}
+
+	ret := output.buf
+	debug("RUN: %s %v", cmd[0], cmdArgs)
+	if logRun {
+		logToFile(LevelDebug, fmt.Sprintf("RUN OUTPUT: %s %v (code: %d, err: %v)\n%s", cmd[0], cmdArgs, code, err, string(ret)))
 	}
-	//log("RUN: %s %v\n%s", cmd[0], cmdArgs, string(ret))
-	//log("RUN: %s %v", cmd[0], cmdArgs)
-	return string(ret), err
-}
\ No newline at end of file
+	return string(ret), code, err
+}
+
+// isTool returns true if the program in a configured command line, such as "/sbin/e2fsck -p -f", is the named tool.
+func isTool(prog, name string) bool {
+	return filepath.Base(strings.Split(prog, " ")[0]) == name
+}
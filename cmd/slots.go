@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The ways slotted partitions can be laid out on the disk.
+const (
+	slotLayoutAdjacent    = "adjacent"    //Each _a partition is immediately followed by its _b, like boot_a boot_b system_a system_b
+	slotLayoutInterleaved = "interleaved" //A run of _a partitions is followed by the same run of _b, like boot_a system_a boot_b system_b
+)
+
+// The GPT attribute bits used by the Android boot control HAL to track the state of a slot, set on boot_a/boot_b.
+const (
+	slotAttrPriority   = 48 //2 bits
+	slotAttrActive     = 50
+	slotAttrRetries    = 51 //3 bits
+	slotAttrSuccessful = 54
+	slotAttrUnbootable = 55
+)
+
+// The slots a slotted partition is expanded into.
+var slotSuffixes = []string{"_a", "_b"}
+
+// Set by --slot to the slot that must survive, so wiping is limited to the other one.
+var activeSlot = ""
+
+// Slot returns the slot of a partition, "a" or "b", or "" if it isn't slotted.
+func (part *Partition) Slot() string {
+	name := part.GetName()
+	for i := 0; i < len(slotSuffixes); i++ {
+		if strings.HasSuffix(name, slotSuffixes[i]) && len(name) > len(slotSuffixes[i]) {
+			return slotSuffixes[i][1:]
+		}
+	}
+	return ""
+}
+
+// Return a copy of a configured partition with the given name, for expanding it into its slots.
+func (part *Partition) cloneAs(name string) *Partition {
+	clone := *part
+	clone.Name = &name
+	clone.Slotted = false
+	clone.Number = nil //Numbers can't be shared by both slots, they're matched by name instead
+	if part.Size != nil {
+		size := *part.Size
+		clone.Size = &size
+	}
+	if part.FS != nil {
+		fs := *part.FS
+		clone.FS = &fs
+	}
+	if part.Flags != nil {
+		flags := *part.Flags
+		clone.Flags = &flags
+	}
+	return &clone
+}
+
+// SlotLayout works out how the slotted partitions already on the disk are laid out. A disk without any is
+// treated as adjacent.
+func (p *Parted) SlotLayout() string {
+	parts := make([]*Partition, 0)
+	for i := 0; i < len(p.Partitions); i++ {
+		if *p.Partitions[i].Number != 0 {
+			parts = append(parts, p.Partitions[i])
+		}
+	}
+	for i := 0; i < len(parts); i++ {
+		name := parts[i].GetName()
+		if parts[i].Slot() != "a" {
+			continue
+		}
+		if i+1 >= len(parts) || parts[i+1].GetName() != strings.TrimSuffix(name, "_a")+"_b" {
+			return slotLayoutInterleaved
+		}
+	}
+	return slotLayoutAdjacent
+}
+
+// ExpandSlots replaces every reserved partition marked as slotted with one partition per slot, with identical
+// sizes, in the order matching the current layout of the disk. PlanLayout puts the reserved partitions on the disk
+// in the order they're in here, so this is also the order the slots end up in. Expanded partitions aren't marked as
+// slotted, so reading the partition table again leaves them alone.
+func (p *Parted) ExpandSlots() {
+	layout := p.SlotLayout()
+	reserved := make([]*Partition, 0)
+	for i := 0; i < len(p.Config.Reserved); {
+		if !p.Config.Reserved[i].Slotted {
+			reserved = append(reserved, p.Config.Reserved[i])
+			i++
+			continue
+		}
+
+		//Collect the run of slotted partitions, which an interleaved layout keeps together per slot
+		run := make([]*Partition, 0)
+		for ; i < len(p.Config.Reserved) && p.Config.Reserved[i].Slotted; i++ {
+			run = append(run, p.Config.Reserved[i])
+		}
+		if layout == slotLayoutAdjacent {
+			for j := 0; j < len(run); j++ {
+				for k := 0; k < len(slotSuffixes); k++ {
+					reserved = append(reserved, run[j].cloneAs(run[j].GetName()+slotSuffixes[k]))
+				}
+			}
+		} else {
+			for k := 0; k < len(slotSuffixes); k++ {
+				for j := 0; j < len(run); j++ {
+					reserved = append(reserved, run[j].cloneAs(run[j].GetName()+slotSuffixes[k]))
+				}
+			}
+		}
+		debug("Expanded %d slotted partition(s) into both slots (%s)", len(run), layout)
+	}
+	p.Config.Reserved = reserved
+}
+
+// DetectActiveSlot reads the slot Android booted from the kernel command line, falling back to the active bit
+// the boot control HAL sets in the GPT attributes of boot_a and boot_b.
+func (p *Parted) DetectActiveSlot() (string, error) {
+	if cmdline, err := os.ReadFile("/proc/cmdline"); err == nil {
+		args := strings.Fields(string(cmdline))
+		for i := 0; i < len(args); i++ {
+			if strings.HasPrefix(args[i], "androidboot.slot_suffix=") {
+				return strings.TrimPrefix(strings.TrimPrefix(args[i], "androidboot.slot_suffix="), "_"), nil
+			}
+			if strings.HasPrefix(args[i], "androidboot.slot=") {
+				return strings.TrimPrefix(args[i], "androidboot.slot="), nil
+			}
+		}
+	}
+
+	active := ""
+	for i := 0; i < len(slotSuffixes); i++ {
+		boot := p.GetPartitionByName(false, "boot"+slotSuffixes[i])
+		if boot == nil || boot.Attributes == nil {
+			continue
+		}
+		if *boot.Attributes&(1<<slotAttrActive) != 0 {
+			if active != "" {
+				return "", fmt.Errorf("Both slots are marked active")
+			}
+			active = slotSuffixes[i][1:]
+		}
+	}
+	if active == "" {
+		return "", fmt.Errorf("No slot is marked active")
+	}
+	return active, nil
+}
+
+// LimitWipeToSlot keeps the partitions of the given slot from being wiped or flashed, leaving wipes and images of
+// the other slot and of partitions that aren't slotted as configured.
+func (p *Parted) LimitWipeToSlot(slot string) {
+	for i := 0; i < len(p.Config.Reserved); i++ {
+		part := p.Config.Reserved[i]
+		if (!part.Wipe && part.Image == "") || part.Slot() != slot {
+			continue
+		}
+		log("Not wiping or flashing %s, it belongs to the active slot %s", part.GetName(), slot)
+		part.Wipe = false
+		part.Image = ""
+		part.slotKept = true
+		if partActual := p.GetPartition(false, part); partActual != nil {
+			partActual.Wipe = false
+		}
+	}
+}
+
+// Describe the boot control state of a partition from its GPT attributes, for logging.
+func slotAttrString(attr uint64) string {
+	return fmt.Sprintf("priority=%d active=%v retries=%d successful=%v unbootable=%v",
+		(attr>>slotAttrPriority)&3, attr&(1<<slotAttrActive) != 0, (attr>>slotAttrRetries)&7,
+		attr&(1<<slotAttrSuccessful) != 0, attr&(1<<slotAttrUnbootable) != 0)
+}
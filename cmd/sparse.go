@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The Android sparse image format from system/core/libsparse/sparse_format.h.
+const (
+	sparseMagic      = 0xed26ff3a
+	sparseHeaderSize = 28
+	sparseChunkSize  = 12
+
+	sparseChunkRaw      = 0xcac1 //Blocks of data that follow the chunk header
+	sparseChunkFill     = 0xcac2 //Blocks filled with a 4 byte pattern
+	sparseChunkDontCare = 0xcac3 //Blocks whose contents don't matter
+	sparseChunkCRC32    = 0xcac4 //The CRC32 of everything up to here
+)
+
+// The header at the start of a sparse image.
+type SparseHeader struct {
+	Magic       uint32
+	Major       uint16
+	Minor       uint16
+	HeaderSize  uint16
+	ChunkSize   uint16
+	BlockSize   uint32
+	TotalBlocks uint32
+	TotalChunks uint32
+	Checksum    uint32
+}
+
+// Size returns the size of the image once it's expanded.
+func (h *SparseHeader) Size() int64 {
+	return int64(h.TotalBlocks) * int64(h.BlockSize)
+}
+
+// A SparseChunk is one run of blocks in a sparse image, with Offset and Length in bytes of the expanded image.
+type SparseChunk struct {
+	Type   uint16
+	Offset int64
+	Length int64
+	Fill   [4]byte   //The pattern of a fill chunk
+	Data   io.Reader //The data of a raw chunk, which must be read before the next chunk
+}
+
+// A SparseReader reads the chunks of a sparse image in order, checking CRC chunks against what it has read.
+type SparseReader struct {
+	Header *SparseHeader
+
+	r      io.Reader
+	chunk  int
+	offset int64
+	data   io.Reader
+	crc    hash.Hash32
+}
+
+// isSparse reports whether a header starts with the magic of a sparse image.
+func isSparse(header []byte) bool {
+	return len(header) >= 4 && binary.LittleEndian.Uint32(header) == sparseMagic
+}
+
+// NewSparseReader reads the header of a sparse image.
+func NewSparseReader(r io.Reader) (*SparseReader, error) {
+	buf := make([]byte, sparseHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("sparse: Failed to read header: %v", err)
+	}
+	h := &SparseHeader{
+		Magic:       binary.LittleEndian.Uint32(buf[0:4]),
+		Major:       binary.LittleEndian.Uint16(buf[4:6]),
+		Minor:       binary.LittleEndian.Uint16(buf[6:8]),
+		HeaderSize:  binary.LittleEndian.Uint16(buf[8:10]),
+		ChunkSize:   binary.LittleEndian.Uint16(buf[10:12]),
+		BlockSize:   binary.LittleEndian.Uint32(buf[12:16]),
+		TotalBlocks: binary.LittleEndian.Uint32(buf[16:20]),
+		TotalChunks: binary.LittleEndian.Uint32(buf[20:24]),
+		Checksum:    binary.LittleEndian.Uint32(buf[24:28]),
+	}
+	if h.Magic != sparseMagic {
+		return nil, fmt.Errorf("sparse: Bad magic %#x", h.Magic)
+	}
+	if h.Major != 1 {
+		return nil, fmt.Errorf("sparse: Unsupported version %d.%d", h.Major, h.Minor)
+	}
+	if h.HeaderSize < sparseHeaderSize || h.ChunkSize < sparseChunkSize {
+		return nil, fmt.Errorf("sparse: Bad header sizes %d and %d", h.HeaderSize, h.ChunkSize)
+	}
+	if h.BlockSize == 0 || h.BlockSize%4 != 0 {
+		return nil, fmt.Errorf("sparse: Bad block size %d", h.BlockSize)
+	}
+	//Newer versions of the format may add fields, which we skip
+	if _, err := io.CopyN(io.Discard, r, int64(h.HeaderSize-sparseHeaderSize)); err != nil {
+		return nil, fmt.Errorf("sparse: Failed to skip header: %v", err)
+	}
+	return &SparseReader{Header: h, r: r, crc: crc32.NewIEEE()}, nil
+}
+
+// Next returns the next chunk of data, or io.EOF after the last one. CRC chunks are checked and skipped.
+func (sr *SparseReader) Next() (*SparseChunk, error) {
+	//Whatever the caller didn't read of the last raw chunk still counts towards the checksum
+	if sr.data != nil {
+		if _, err := io.Copy(io.Discard, sr.data); err != nil {
+			return nil, fmt.Errorf("sparse: Failed to skip chunk %d: %v", sr.chunk-1, err)
+		}
+		sr.data = nil
+	}
+
+	for sr.chunk < int(sr.Header.TotalChunks) {
+		buf := make([]byte, sparseChunkSize)
+		if _, err := io.ReadFull(sr.r, buf); err != nil {
+			return nil, fmt.Errorf("sparse: Failed to read chunk %d: %v", sr.chunk, err)
+		}
+		if _, err := io.CopyN(io.Discard, sr.r, int64(sr.Header.ChunkSize-sparseChunkSize)); err != nil {
+			return nil, fmt.Errorf("sparse: Failed to skip chunk %d header: %v", sr.chunk, err)
+		}
+		kind := binary.LittleEndian.Uint16(buf[0:2])
+		blocks := int64(binary.LittleEndian.Uint32(buf[4:8]))
+		total := int64(binary.LittleEndian.Uint32(buf[8:12])) - int64(sr.Header.ChunkSize)
+		length := blocks * int64(sr.Header.BlockSize)
+		chunk := &SparseChunk{Type: kind, Offset: sr.offset, Length: length}
+		sr.chunk++
+
+		switch kind {
+		case sparseChunkRaw:
+			if total != length {
+				return nil, fmt.Errorf("sparse: Raw chunk %d holds %d bytes for %d blocks", sr.chunk-1, total, blocks)
+			}
+			sr.data = io.TeeReader(io.LimitReader(sr.r, length), sr.crc)
+			chunk.Data = sr.data
+		case sparseChunkFill:
+			if total != 4 {
+				return nil, fmt.Errorf("sparse: Fill chunk %d has %d bytes of data", sr.chunk-1, total)
+			}
+			if _, err := io.ReadFull(sr.r, chunk.Fill[:]); err != nil {
+				return nil, fmt.Errorf("sparse: Failed to read fill of chunk %d: %v", sr.chunk-1, err)
+			}
+			crcFill(sr.crc, chunk.Fill, length)
+		case sparseChunkDontCare:
+			if total != 0 {
+				return nil, fmt.Errorf("sparse: Don't care chunk %d has %d bytes of data", sr.chunk-1, total)
+			}
+			crcFill(sr.crc, [4]byte{}, length) //libsparse counts them as zeroes
+		case sparseChunkCRC32:
+			if total != 4 {
+				return nil, fmt.Errorf("sparse: CRC chunk %d has %d bytes of data", sr.chunk-1, total)
+			}
+			crc := make([]byte, 4)
+			if _, err := io.ReadFull(sr.r, crc); err != nil {
+				return nil, fmt.Errorf("sparse: Failed to read CRC of chunk %d: %v", sr.chunk-1, err)
+			}
+			if binary.LittleEndian.Uint32(crc) != sr.crc.Sum32() {
+				return nil, fmt.Errorf("sparse: CRC mismatch at chunk %d, expected %#x but read %#x", sr.chunk-1, binary.LittleEndian.Uint32(crc), sr.crc.Sum32())
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("sparse: Unknown type %#x of chunk %d", kind, sr.chunk-1)
+		}
+
+		sr.offset += length
+		if sr.offset > sr.Header.Size() {
+			return nil, fmt.Errorf("sparse: Chunk %d ends at %d, past the end of the image at %d", sr.chunk-1, sr.offset, sr.Header.Size())
+		}
+		return chunk, nil
+	}
+	return nil, io.EOF
+}
+
+// Add length bytes of a repeated 4 byte pattern to a checksum.
+func crcFill(crc hash.Hash32, fill [4]byte, length int64) {
+	buf := make([]byte, 4096)
+	for i := 0; i < len(buf); i += 4 {
+		copy(buf[i:], fill[:])
+	}
+	for length > 0 {
+		count := int64(len(buf))
+		if count > length {
+			count = length
+		}
+		crc.Write(buf[:count])
+		length -= count
+	}
+}
+
+// A SparseWriter writes a sparse image of known size and chunk count, chunk by chunk.
+type SparseWriter struct {
+	w         io.Writer
+	blockSize int64
+	blocks    int64
+	chunks    int
+	written   int64 //Blocks written so far
+	crc       hash.Hash32
+}
+
+// NewSparseWriter writes the header of a sparse image with the given number of blocks and chunks, not counting
+// the CRC chunk Close adds at the end.
+func NewSparseWriter(w io.Writer, blockSize, blocks int64, chunks int) (*SparseWriter, error) {
+	buf := make([]byte, sparseHeaderSize)
+	binary.LittleEndian.PutUint32(buf[0:4], sparseMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], 1)
+	binary.LittleEndian.PutUint16(buf[6:8], 0)
+	binary.LittleEndian.PutUint16(buf[8:10], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(buf[10:12], sparseChunkSize)
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(blockSize))
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(blocks))
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(chunks+1))
+	if _, err := w.Write(buf); err != nil {
+		return nil, fmt.Errorf("sparse: Failed to write header: %v", err)
+	}
+	return &SparseWriter{w: w, blockSize: blockSize, blocks: blocks, chunks: chunks, crc: crc32.NewIEEE()}, nil
+}
+
+// Write the header of a chunk covering length bytes of the image.
+func (sw *SparseWriter) chunkHeader(kind uint16, length int64, data int) error {
+	if length%sw.blockSize != 0 {
+		return fmt.Errorf("sparse: Chunk of %d bytes isn't a whole number of %d byte blocks", length, sw.blockSize)
+	}
+	blocks := length / sw.blockSize
+	if sw.chunks == 0 {
+		return fmt.Errorf("sparse: More chunks written than the header says")
+	}
+	if sw.written+blocks > sw.blocks {
+		return fmt.Errorf("sparse: Chunk of %d blocks at block %d is past the end of the image", blocks, sw.written)
+	}
+	buf := make([]byte, sparseChunkSize)
+	binary.LittleEndian.PutUint16(buf[0:2], kind)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(blocks))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(sparseChunkSize+data))
+	if _, err := sw.w.Write(buf); err != nil {
+		return fmt.Errorf("sparse: Failed to write chunk header: %v", err)
+	}
+	sw.chunks--
+	sw.written += blocks
+	return nil
+}
+
+// Raw writes a chunk of length bytes read from r.
+func (sw *SparseWriter) Raw(r io.Reader, length int64) error {
+	if err := sw.chunkHeader(sparseChunkRaw, length, int(length)); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.MultiWriter(sw.w, sw.crc), r, length); err != nil {
+		return fmt.Errorf("sparse: Failed to write raw chunk: %v", err)
+	}
+	return nil
+}
+
+// Fill writes a chunk of blocks filled with a 4 byte pattern.
+func (sw *SparseWriter) Fill(fill [4]byte, length int64) error {
+	if err := sw.chunkHeader(sparseChunkFill, length, 4); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(fill[:]); err != nil {
+		return fmt.Errorf("sparse: Failed to write fill chunk: %v", err)
+	}
+	crcFill(sw.crc, fill, length)
+	return nil
+}
+
+// DontCare writes a chunk of blocks whose contents don't matter.
+func (sw *SparseWriter) DontCare(length int64) error {
+	if err := sw.chunkHeader(sparseChunkDontCare, length, 0); err != nil {
+		return err
+	}
+	crcFill(sw.crc, [4]byte{}, length)
+	return nil
+}
+
+// Close finishes the image with the CRC of everything in it, once every block and chunk has been written.
+func (sw *SparseWriter) Close() error {
+	if sw.chunks != 0 || sw.written != sw.blocks {
+		return fmt.Errorf("sparse: Image ended after %d of %d blocks with %d chunks missing", sw.written, sw.blocks, sw.chunks)
+	}
+	sw.chunks++ //The CRC chunk was counted in the header
+	if err := sw.chunkHeader(sparseChunkCRC32, 0, 4); err != nil {
+		return err
+	}
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, sw.crc.Sum32())
+	if _, err := sw.w.Write(crc); err != nil {
+		return fmt.Errorf("sparse: Failed to write CRC chunk: %v", err)
+	}
+	return nil
+}
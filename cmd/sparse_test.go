@@ -0,0 +1,269 @@
+package main
+
+import (
+	stdbytes "bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// A sparseOp is one chunk written to a test image.
+type sparseOp struct {
+	kind   uint16
+	data   []byte  //Raw chunks
+	fill   [4]byte //Fill chunks
+	length int64   //Fill and don't care chunks
+}
+
+// Expand a sparse image into the bytes it stands for, with don't care blocks as zeroes.
+func expandSparse(t *testing.T, image []byte) []byte {
+	t.Helper()
+	sr, err := NewSparseReader(stdbytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewSparseReader: %v", err)
+	}
+	expanded := make([]byte, sr.Header.Size())
+	for {
+		chunk, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		out := expanded[chunk.Offset : chunk.Offset+chunk.Length]
+		switch chunk.Type {
+		case sparseChunkRaw:
+			if _, err := io.ReadFull(chunk.Data, out); err != nil {
+				t.Fatalf("reading raw chunk at %d: %v", chunk.Offset, err)
+			}
+		case sparseChunkFill:
+			for i := 0; i < len(out); i += 4 {
+				copy(out[i:], chunk.Fill[:])
+			}
+		}
+	}
+	return expanded
+}
+
+func randomBytes(seed int64, length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockSize int64
+		ops       []sparseOp
+	}{
+		{"empty", 4096, nil},
+		{"raw", 4096, []sparseOp{{kind: sparseChunkRaw, data: randomBytes(1, 3*4096)}}},
+		{"fill", 512, []sparseOp{{kind: sparseChunkFill, fill: [4]byte{0xde, 0xad, 0xbe, 0xef}, length: 8 * 512}}},
+		{"dont care", 4096, []sparseOp{{kind: sparseChunkDontCare, length: 16 * 4096}}},
+		{"mixed", 1024, []sparseOp{
+			{kind: sparseChunkDontCare, length: 2 * 1024},
+			{kind: sparseChunkRaw, data: randomBytes(2, 1024)},
+			{kind: sparseChunkFill, fill: [4]byte{1, 2, 3, 4}, length: 5 * 1024},
+			{kind: sparseChunkRaw, data: randomBytes(3, 4*1024)},
+			{kind: sparseChunkDontCare, length: 1024},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := []byte{}
+			for _, op := range tt.ops {
+				switch op.kind {
+				case sparseChunkRaw:
+					want = append(want, op.data...)
+				case sparseChunkFill:
+					for i := int64(0); i < op.length; i += 4 {
+						want = append(want, op.fill[:]...)
+					}
+				case sparseChunkDontCare:
+					want = append(want, make([]byte, op.length)...)
+				}
+			}
+
+			var image stdbytes.Buffer
+			sw, err := NewSparseWriter(&image, tt.blockSize, int64(len(want))/tt.blockSize, len(tt.ops))
+			if err != nil {
+				t.Fatalf("NewSparseWriter: %v", err)
+			}
+			for _, op := range tt.ops {
+				switch op.kind {
+				case sparseChunkRaw:
+					err = sw.Raw(stdbytes.NewReader(op.data), int64(len(op.data)))
+				case sparseChunkFill:
+					err = sw.Fill(op.fill, op.length)
+				case sparseChunkDontCare:
+					err = sw.DontCare(op.length)
+				}
+				if err != nil {
+					t.Fatalf("writing chunk %#x: %v", op.kind, err)
+				}
+			}
+			if err := sw.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if !isSparse(image.Bytes()) {
+				t.Fatalf("written image doesn't start with the sparse magic")
+			}
+			if got := expandSparse(t, image.Bytes()); !stdbytes.Equal(got, want) {
+				t.Errorf("expanded image differs from what was written")
+			}
+		})
+	}
+}
+
+func TestSparseWriterErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(sw *SparseWriter) error
+		err   string
+	}{
+		{"partial block", func(sw *SparseWriter) error { return sw.DontCare(100) }, "whole number"},
+		{"past the end", func(sw *SparseWriter) error { return sw.DontCare(8 * 512) }, "past the end"},
+		{"too many chunks", func(sw *SparseWriter) error {
+			sw.DontCare(512)
+			return sw.DontCare(512)
+		}, "More chunks"},
+		{"missing blocks", func(sw *SparseWriter) error {
+			sw.DontCare(512)
+			return sw.Close()
+		}, "Image ended"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sw, err := NewSparseWriter(io.Discard, 512, 4, 1)
+			if err != nil {
+				t.Fatalf("NewSparseWriter: %v", err)
+			}
+			err = tt.write(sw)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSparseReaderCorrupt(t *testing.T) {
+	var image stdbytes.Buffer
+	sw, err := NewSparseWriter(&image, 512, 3, 2)
+	if err != nil {
+		t.Fatalf("NewSparseWriter: %v", err)
+	}
+	if err := sw.Raw(stdbytes.NewReader(randomBytes(4, 2*512)), 2*512); err != nil {
+		t.Fatalf("Raw: %v", err)
+	}
+	if err := sw.Fill([4]byte{9, 9, 9, 9}, 512); err != nil {
+		t.Fatalf("Fill: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	good := image.Bytes()
+	rawData := sparseHeaderSize + sparseChunkSize
+	fillChunk := rawData + 2*512
+
+	tests := []struct {
+		name    string
+		corrupt func(image []byte)
+		err     string
+	}{
+		{"bad magic", func(image []byte) { image[0] ^= 0xff }, "Bad magic"},
+		{"bad version", func(image []byte) { binary.LittleEndian.PutUint16(image[4:6], 2) }, "Unsupported version"},
+		{"bad block size", func(image []byte) { binary.LittleEndian.PutUint32(image[12:16], 513) }, "Bad block size"},
+		{"raw data", func(image []byte) { image[rawData+100] ^= 0x01 }, "CRC mismatch"},
+		{"fill pattern", func(image []byte) { image[fillChunk+sparseChunkSize] ^= 0x01 }, "CRC mismatch"},
+		{"unknown chunk", func(image []byte) { binary.LittleEndian.PutUint16(image[fillChunk:], 0xcaff) }, "Unknown type"},
+		{"raw size", func(image []byte) { binary.LittleEndian.PutUint32(image[rawData-4:], 100) }, "holds"},
+		{"past the end", func(image []byte) { binary.LittleEndian.PutUint32(image[16:20], 2) }, "past the end"},
+		{"truncated", nil, "Failed to read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := append([]byte{}, good...)
+			if tt.corrupt != nil {
+				tt.corrupt(image)
+			} else {
+				image = image[:len(image)-2]
+			}
+			sr, err := NewSparseReader(stdbytes.NewReader(image))
+			for err == nil {
+				_, err = sr.Next()
+			}
+			if err == io.EOF || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAlignExtents(t *testing.T) {
+	tests := []struct {
+		name    string
+		extents []Extent
+		size    int64
+		want    []Extent
+	}{
+		{"none", nil, 8192, []Extent{}},
+		{"aligned", []Extent{{0, 4096}}, 8192, []Extent{{0, 4096}}},
+		{"grown to blocks", []Extent{{100, 10}}, 16384, []Extent{{0, 4096}}},
+		{"across a boundary", []Extent{{4000, 200}}, 16384, []Extent{{0, 8192}}},
+		{"clipped to size", []Extent{{8192, 100}}, 10000, []Extent{{8192, 1808}}},
+		{"joined once touching", []Extent{{5000, 10}, {100, 10}}, 16384, []Extent{{0, 8192}}},
+		{"kept apart", []Extent{{0, 10}, {8192, 10}}, 16384, []Extent{{0, 4096}, {8192, 4096}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := alignExtents(tt.extents, 4096, tt.size)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := 0; i < len(got); i++ {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSparseImage(t *testing.T) {
+	const blockSize = 4096
+	tests := []struct {
+		name    string
+		size    int64
+		extents []Extent
+	}{
+		{"nothing allocated", 8 * blockSize, nil},
+		{"everything allocated", 8 * blockSize, []Extent{{0, 8 * blockSize}}},
+		{"holes", 16 * blockSize, []Extent{{blockSize, 2 * blockSize}, {8 * blockSize, blockSize}}},
+		{"ends allocated", 16 * blockSize, []Extent{{0, blockSize}, {15 * blockSize, blockSize}}},
+		{"split raw chunks", sparseMaxRaw + 4*blockSize, []Extent{{blockSize, sparseMaxRaw + 2*blockSize}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := randomBytes(tt.size, int(tt.size))
+			var image stdbytes.Buffer
+			pr := NewProgress("Testing", tt.name, tt.size, true)
+			if err := writeSparseImage(&image, stdbytes.NewReader(src), tt.size, blockSize, tt.extents, pr); err != nil {
+				t.Fatalf("writeSparseImage: %v", err)
+			}
+
+			want := make([]byte, tt.size)
+			for i := 0; i < len(tt.extents); i++ {
+				e := tt.extents[i]
+				copy(want[e.Offset:e.Offset+e.Length], src[e.Offset:e.Offset+e.Length])
+			}
+			if got := expandSparse(t, image.Bytes()); !stdbytes.Equal(got, want) {
+				t.Errorf("expanded image differs from the allocated extents of the source")
+			}
+		})
+	}
+}
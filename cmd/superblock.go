@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A Superblock is what a native probe learned about the contents of a partition, with sizes in blocks of BlockSize.
+type Superblock struct {
+	Type       string // ext2, ext3, ext4, f2fs, vfat, erofs, squashfs, sparse or avb
+	BlockSize  int64
+	BlockCount int64
+	FreeBlocks int64
+	MinSize    int64 // The smallest size in bytes the contents fit in, including filesystem metadata
+
+	AVB *AVBFooter // The AVB footer at the end of the partition, if any
+}
+
+// An AVBFooter is the footer avbtool appends to partitions with hashtree or hash descriptors.
+type AVBFooter struct {
+	OriginalImageSize int64
+	VBMetaOffset      int64
+	VBMetaSize        int64
+}
+
+// UsedSize returns the size in bytes of the blocks in use.
+func (sb *Superblock) UsedSize() int64 {
+	return (sb.BlockCount - sb.FreeBlocks) * sb.BlockSize
+}
+
+// Size returns the size in bytes of the filesystem or image.
+func (sb *Superblock) Size() int64 {
+	return sb.BlockCount * sb.BlockSize
+}
+
+// A superblock probe reads what it needs through the partition and returns nil if the partition isn't its type.
+type superblockProbe func(part *Partition) (*Superblock, error)
+
+var superblockProbes = []superblockProbe{
+	probeExt,
+	probeF2FS,
+	probeEROFS,
+	probeSquashFS,
+	probeVFAT,
+	probeSparse,
+}
+
+// Probe identifies the contents of the partition from its superblock, without running external tools.
+// The result is cached until the partition changes.
+func (part *Partition) Probe() (*Superblock, error) {
+	if part.superblock != nil {
+		return part.superblock, nil
+	}
+
+	footer, err := probeAVBFooter(part)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(superblockProbes); i++ {
+		sb, err := superblockProbes[i](part)
+		if err != nil {
+			return nil, err
+		}
+		if sb != nil {
+			sb.AVB = footer
+			if footer != nil {
+				//The footer lives in the last block and says where vbmeta is, so nothing can be cut off
+				//without rewriting it at the new end, which needs the signing key
+				sb.MinSize = part.GetSize()
+			}
+			part.superblock = sb
+			return sb, nil
+		}
+	}
+	if footer != nil {
+		part.superblock = &Superblock{Type: "avb", BlockSize: 1, BlockCount: footer.OriginalImageSize, MinSize: part.GetSize(), AVB: footer}
+		return part.superblock, nil
+	}
+
+	return nil, fmt.Errorf("probe: No known superblock on partition %s", part.GetName())
+}
+
+// Read exactly count bytes from the partition, failing if the partition is too small.
+func readExact(part *Partition, offset, count int64) ([]byte, error) {
+	data, err := part.Read(offset, count)
+	if err != nil {
+		return nil, fmt.Errorf("probe: Failed to read %d bytes from partition %s at offset %d: %v", count, part.GetName(), offset, err)
+	}
+	if int64(len(data)) < count {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// ext2/3/4 keep their superblock 1024 bytes into the partition.
+func probeExt(part *Partition) (*Superblock, error) {
+	data, err := readExact(part, 1024, 1024)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint16(data[0x38:]) != 0xEF53 {
+		return nil, nil
+	}
+
+	sb := &Superblock{Type: "ext2", BlockSize: 1024 << le.Uint32(data[0x18:])}
+	compat := le.Uint32(data[0x5C:])
+	incompat := le.Uint32(data[0x60:])
+	sb.BlockCount = int64(le.Uint32(data[0x04:]))
+	sb.FreeBlocks = int64(le.Uint32(data[0x0C:]))
+	if incompat&0x80 != 0 { //64bit
+		sb.BlockCount |= int64(le.Uint32(data[0x150:])) << 32
+		sb.FreeBlocks |= int64(le.Uint32(data[0x158:])) << 32
+	}
+	if compat&0x4 != 0 { //has_journal
+		sb.Type = "ext3"
+	}
+	if incompat&(0x40|0x80|0x200) != 0 { //extents, 64bit or flex_bg
+		sb.Type = "ext4"
+	}
+	sb.MinSize = sb.UsedSize()
+	return sb, nil
+}
+
+// f2fs keeps its superblock 1024 bytes into the partition, and its free space in the newest checkpoint pack.
+func probeF2FS(part *Partition) (*Superblock, error) {
+	data, err := readExact(part, 1024, 512)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(data[0:]) != 0xF2F52010 {
+		return nil, nil
+	}
+
+	sb := &Superblock{Type: "f2fs", BlockSize: 1 << le.Uint32(data[16:])}
+	sb.BlockCount = int64(le.Uint64(data[36:]))
+	blocksPerSeg := int64(1) << le.Uint32(data[20:])
+	cpAddr := int64(le.Uint32(data[76:]))
+	mainAddr := int64(le.Uint32(data[92:]))
+
+	//There are two checkpoint packs, the one with the higher version is current
+	var cp []byte
+	cpVersion := uint64(0)
+	for pack := int64(0); pack < 2; pack++ {
+		packData, err := readExact(part, (cpAddr+pack*blocksPerSeg)*sb.BlockSize, 64)
+		if err != nil {
+			return nil, err
+		}
+		if packData != nil && (cp == nil || le.Uint64(packData[0:]) > cpVersion) {
+			cp = packData
+			cpVersion = le.Uint64(packData[0:])
+		}
+	}
+	if cp == nil {
+		return nil, fmt.Errorf("probe: Failed to read f2fs checkpoint on partition %s", part.GetName())
+	}
+	userBlocks := int64(le.Uint64(cp[8:]))
+	validBlocks := int64(le.Uint64(cp[16:]))
+	reservedSegs := int64(le.Uint32(cp[24:]))
+	overprovSegs := int64(le.Uint32(cp[28:]))
+	sb.FreeBlocks = userBlocks - validBlocks
+
+	//Metadata before the main area, the data, and the segments f2fs keeps back for cleaning
+	sb.MinSize = (mainAddr + validBlocks + (reservedSegs+overprovSegs)*blocksPerSeg) * sb.BlockSize
+	return sb, nil
+}
+
+// erofs keeps its superblock 1024 bytes into the partition. It is read-only, so it has no free space.
+func probeEROFS(part *Partition) (*Superblock, error) {
+	data, err := readExact(part, 1024, 128)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(data[0:]) != 0xE0F5E1E2 {
+		return nil, nil
+	}
+
+	sb := &Superblock{Type: "erofs", BlockSize: 1 << data[12]}
+	sb.BlockCount = int64(le.Uint32(data[36:]))
+	sb.MinSize = sb.Size()
+	return sb, nil
+}
+
+// squashfs keeps its superblock at the start of the partition. It is read-only, so it has no free space.
+func probeSquashFS(part *Partition) (*Superblock, error) {
+	data, err := readExact(part, 0, 96)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(data[0:]) != 0x73717368 {
+		return nil, nil
+	}
+
+	sb := &Superblock{Type: "squashfs", BlockSize: int64(le.Uint32(data[12:]))}
+	bytesUsed := int64(le.Uint64(data[40:]))
+	sb.BlockCount = (bytesUsed + sb.BlockSize - 1) / sb.BlockSize
+	sb.MinSize = bytesUsed
+	return sb, nil
+}
+
+// FAT keeps its BIOS parameter block in the boot sector. Free space comes from the FAT32 FSInfo sector when it
+// knows it, and from counting free clusters in the first FAT otherwise.
+func probeVFAT(part *Partition) (*Superblock, error) {
+	data, err := readExact(part, 0, 512)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if data[510] != 0x55 || data[511] != 0xAA {
+		return nil, nil
+	}
+	fat32 := string(data[82:87]) == "FAT32"
+	if !fat32 && string(data[54:57]) != "FAT" {
+		return nil, nil
+	}
+
+	sectorSize := int64(le.Uint16(data[11:]))
+	sectorsPerCluster := int64(data[13])
+	reserved := int64(le.Uint16(data[14:]))
+	fats := int64(data[16])
+	rootEntries := int64(le.Uint16(data[17:]))
+	sectors := int64(le.Uint16(data[19:]))
+	if sectors == 0 {
+		sectors = int64(le.Uint32(data[32:]))
+	}
+	fatSectors := int64(le.Uint16(data[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(le.Uint32(data[36:]))
+	}
+	if sectorSize == 0 || sectorsPerCluster == 0 {
+		return nil, nil
+	}
+
+	metaSectors := reserved + fats*fatSectors + (rootEntries*32+sectorSize-1)/sectorSize
+	sb := &Superblock{Type: "vfat", BlockSize: sectorSize * sectorsPerCluster}
+	sb.BlockCount = (sectors - metaSectors) / sectorsPerCluster
+
+	sb.FreeBlocks = -1
+	if fat32 {
+		fsInfo, err := readExact(part, int64(le.Uint16(data[48:]))*sectorSize, 512)
+		if err != nil {
+			return nil, err
+		}
+		if fsInfo != nil && le.Uint32(fsInfo[0:]) == 0x41615252 && le.Uint32(fsInfo[484:]) == 0x61417272 {
+			if free := le.Uint32(fsInfo[488:]); free != 0xFFFFFFFF {
+				sb.FreeBlocks = int64(free)
+			}
+		}
+	}
+	if sb.FreeBlocks < 0 {
+		fat, err := readExact(part, reserved*sectorSize, fatSectors*sectorSize)
+		if err != nil {
+			return nil, err
+		}
+		if fat == nil {
+			return nil, fmt.Errorf("probe: FAT on partition %s is truncated", part.GetName())
+		}
+		sb.FreeBlocks = countFreeClusters(fat, sb.BlockCount, fat32)
+	}
+
+	//Data can be anywhere in the data area, so only the metadata and used clusters are certain
+	sb.MinSize = metaSectors*sectorSize + sb.UsedSize()
+	return sb, nil
+}
+
+// Count the free entries for the data clusters in a FAT, which start at entry 2.
+// FAT12 is told apart from FAT16 by its cluster count, as the FAT specification does.
+func countFreeClusters(fat []byte, clusters int64, fat32 bool) int64 {
+	le := binary.LittleEndian
+	free := int64(0)
+	for cluster := int64(2); cluster < clusters+2; cluster++ {
+		entry := uint32(0)
+		switch {
+		case fat32:
+			if (cluster+1)*4 > int64(len(fat)) {
+				return free
+			}
+			entry = le.Uint32(fat[cluster*4:]) & 0x0FFFFFFF
+		case clusters >= 4085:
+			if (cluster+1)*2 > int64(len(fat)) {
+				return free
+			}
+			entry = uint32(le.Uint16(fat[cluster*2:]))
+		default:
+			offset := cluster + cluster/2
+			if offset+2 > int64(len(fat)) {
+				return free
+			}
+			entry = uint32(le.Uint16(fat[offset:]))
+			if cluster%2 == 1 {
+				entry >>= 4
+			}
+			entry &= 0xFFF
+		}
+		if entry == 0 {
+			free++
+		}
+	}
+	return free
+}
+
+// Android sparse images are sometimes written to partitions as-is, so recognise their header too.
+func probeSparse(part *Partition) (*Superblock, error) {
+	data, err := readExact(part, 0, 28)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(data[0:]) != 0xED26FF3A {
+		return nil, nil
+	}
+
+	sb := &Superblock{Type: "sparse", BlockSize: int64(le.Uint32(data[12:])), BlockCount: int64(le.Uint32(data[16:]))}
+	sb.MinSize = sb.Size()
+	return sb, nil
+}
+
+// The AVB footer is the last 64 bytes of the partition and, unlike everything else here, big endian.
+func probeAVBFooter(part *Partition) (*AVBFooter, error) {
+	if part.Size == nil || part.GetSize() < 64 {
+		return nil, nil
+	}
+	data, err := readExact(part, part.GetSize()-64, 64)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	if string(data[0:4]) != "AVBf" {
+		return nil, nil
+	}
+
+	be := binary.BigEndian
+	return &AVBFooter{
+		OriginalImageSize: int64(be.Uint64(data[12:])),
+		VBMetaOffset:      int64(be.Uint64(data[20:])),
+		VBMetaSize:        int64(be.Uint64(data[28:])),
+	}, nil
+}
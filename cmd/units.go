@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+
+	"fmt"
+)
+
+// Units sizes are shown in, selected with --units.
+const (
+	unitsIEC     = "iec"     // Powers of 1024, such as 95 MiB, matching the sizes the config is usually written in
+	unitsSI      = "si"      // Powers of 1000, such as 100 MB
+	unitsBytes   = "bytes"   // Exact byte counts, such as 100003840 B
+	unitsSectors = "sectors" // Logical sectors of the first disk, with any remainder in bytes
+)
+
+var (
+	sizeUnits        = unitsIEC // The units of every size in logs and reports
+	sizeSector int64 = 512      // The sector size used by the sectors units, set from the first disk
+)
+
+// ParseUnits checks the name of a size unit.
+func ParseUnits(name string) (string, error) {
+	switch name {
+	case unitsIEC, unitsSI, unitsBytes, unitsSectors:
+		return name, nil
+	}
+	return "", fmt.Errorf("Unknown units %s, must be iec, si, bytes or sectors", name)
+}
+
+// Convert a number of bytes to a string in the selected units.
+func bytes(num int64) string {
+	if num < 0 {
+		return "-" + bytes(-num)
+	}
+	switch sizeUnits {
+	case unitsSI:
+		return humanize.Bytes(uint64(num))
+	case unitsBytes:
+		return fmt.Sprintf("%d B", num)
+	case unitsSectors:
+		sectors, rest := num/sizeSector, num%sizeSector
+		unit := "sectors"
+		if sectors == 1 {
+			unit = "sector"
+		}
+		if rest != 0 {
+			return fmt.Sprintf("%d %s + %d B", sectors, unit, rest)
+		}
+		return fmt.Sprintf("%d %s", sectors, unit)
+	}
+	return humanize.IBytes(uint64(num))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The size of each read when hashing partition contents.
+const hashChunk = 8 * 1024 * 1024
+
+// A VerifyCheck is one comparison between the disk and the config after the plan has been applied.
+type VerifyCheck struct {
+	Disk       string `json:"disk"`
+	Partition  string `json:"partition"`
+	Check      string `json:"check"` //exists, size, name, flags, order, fsck or hash
+	Expected   string `json:"expected,omitempty"`
+	Actual     string `json:"actual,omitempty"`
+	OK         bool   `json:"ok"`
+	Unverified bool   `json:"unverified,omitempty"` //The check couldn't be made, so it neither passed nor failed
+}
+
+// A ContentHash is the SHA-256 of the parts of a partition that hold data, taken before it's changed so its
+// contents can be checked afterwards.
+type ContentHash struct {
+	Name    string   `json:"name"`
+	Mode    string   `json:"mode"`              //used for the data of a filesystem, image for a raw partition
+	Resized bool     `json:"resized,omitempty"` //The filesystem was resized, so its blocks can't be compared and the hash is unverified
+	Extents []Extent `json:"extents"`           //Relative to the start of the partition
+	Sum     string   `json:"sha256"`
+}
+
+// HashContent hashes the given extents of the partition, or all of it if extents is nil.
+func (part *Partition) HashContent(extents []Extent) (*ContentHash, error) {
+	if extents == nil {
+		extents = []Extent{{Offset: 0, Length: part.GetSize()}}
+	}
+	p := part.Parted
+	h := sha256.New()
+	buf := make([]byte, hashChunk)
+	for i := 0; i < len(extents); i++ {
+		for done := int64(0); done < extents[i].Length; done += hashChunk {
+			count := extents[i].Length - done
+			if count > hashChunk {
+				count = hashChunk
+			}
+			offset := *part.Start + extents[i].Offset + done
+			if _, err := p.File.ReadAt(buf[:count], offset); err != nil && err != io.EOF {
+				return nil, fmt.Errorf("hash: Failed to read %d bytes of %s at offset %d: %v", count, part.GetName(), offset, err)
+			}
+			h.Write(buf[:count])
+		}
+	}
+	return &ContentHash{Name: part.GetName(), Extents: extents, Sum: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Verify reads the partition table of the disk again from scratch and compares it to the config: every reserved
+// and userdata partition must exist with its configured name and flags, reserved partitions must have their
+// configured sizes and be in their configured order, and every filesystem that was kept must pass a read-only
+// check. Partitions in hashes must still hash the same, except resized filesystems, whose blocks move around, so
+// their hashes are reported as unverified. It returns every check made, and an error if any failed.
+func (p *Parted) Verify(hashes map[string]*ContentHash) ([]*VerifyCheck, error) {
+	p, err := p.Reload()
+	if err != nil {
+		return nil, fmt.Errorf("verify: Failed to reload partition table: %v", err)
+	}
+	defer p.Close()
+
+	checks := make([]*VerifyCheck, 0)
+	add := func(part *Partition, check, expected, actual string, ok bool) {
+		checks = append(checks, &VerifyCheck{Disk: p.Config.Disk, Partition: part.GetName(), Check: check, Expected: expected, Actual: actual, OK: ok})
+	}
+
+	kept := make([]*Partition, 0)
+	lastStart := int64(-1)
+	for i := 0; i < len(p.Config.Reserved); i++ {
+		partReserved := p.Config.Reserved[i]
+		partActual := p.GetPartition(false, partReserved)
+		if partActual == nil {
+			add(partReserved, "exists", "present", "missing", false)
+			continue
+		}
+		size := partReserved.GetSize()
+		add(partReserved, "size", bytes(size), bytes(partActual.GetSize()), partActual.GetSize() == size)
+		add(partReserved, "order", fmt.Sprintf("after %d", lastStart), fmt.Sprintf("%d", *partActual.Start), *partActual.Start > lastStart)
+		lastStart = *partActual.Start
+		p.verifyAttrs(partReserved, partActual, add)
+		if !partReserved.Wipe {
+			kept = append(kept, partActual)
+		}
+	}
+	for i := 0; i < len(p.Config.UserData); i++ {
+		partActual := p.GetPartition(false, p.Config.UserData[i])
+		if partActual == nil {
+			add(p.Config.UserData[i], "exists", "present", "missing", false)
+			continue
+		}
+		p.verifyAttrs(p.Config.UserData[i], partActual, add)
+		kept = append(kept, partActual)
+	}
+
+	for i := 0; i < len(kept); i++ {
+		fs := GetFilesystem(kept[i])
+		if fs == nil {
+			continue
+		}
+		err := fs.Check(kept[i], false)
+		actual := "clean"
+		if err != nil {
+			actual = err.Error()
+		}
+		add(kept[i], "fsck", "clean", actual, err == nil)
+	}
+
+	for name, hash := range hashes {
+		partActual := p.GetPartitionByName(false, name)
+		if partActual == nil {
+			continue //Already reported as missing
+		}
+		if hash.Resized {
+			checks = append(checks, &VerifyCheck{Disk: p.Config.Disk, Partition: name, Check: "hash", Expected: hash.Sum, Actual: "not compared, the filesystem was resized", Unverified: true})
+			continue
+		}
+		after, err := partActual.HashContent(hash.Extents)
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		} else {
+			actual = after.Sum
+		}
+		add(partActual, "hash", hash.Sum, actual, err == nil && after.Sum == hash.Sum)
+	}
+
+	failed := 0
+	unverified := 0
+	for i := 0; i < len(checks); i++ {
+		check := checks[i]
+		if check.OK {
+			debug("Verify: %s %s ok (%s)", check.Partition, check.Check, check.Actual)
+			continue
+		}
+		if check.Unverified {
+			unverified++
+			warn("Verify: %s %s unverified, %s", check.Partition, check.Check, check.Actual)
+			continue
+		}
+		failed++
+		logAt(LevelError, "Verify: %s %s failed, expected %s but found %s", check.Partition, check.Check, check.Expected, check.Actual)
+	}
+	if failed > 0 {
+		return checks, fmt.Errorf("%d of %d checks failed on %s", failed, len(checks), p.Config.Disk)
+	}
+	if unverified > 0 {
+		log("Verified %s: %d checks passed, %d unverified", p.Config.Disk, len(checks)-unverified, unverified)
+		return checks, nil
+	}
+	log("Verified %s: %d checks passed", p.Config.Disk, len(checks))
+	return checks, nil
+}
+
+// Check the name and flags of a partition against its config, where the config gives them.
+func (p *Parted) verifyAttrs(partConfig, partActual *Partition, add func(*Partition, string, string, string, bool)) {
+	if p.HasNames() && partConfig.Name != nil {
+		add(partConfig, "name", *partConfig.Name, *partActual.Name, *partActual.Name == *partConfig.Name)
+	}
+	if partConfig.Flags != nil && *partConfig.Flags != "" {
+		flags := strings.Split(*partConfig.Flags, ",")
+		ok := true
+		for i := 0; i < len(flags); i++ {
+			ok = ok && strings.Contains(*partActual.Flags, strings.TrimSpace(flags[i]))
+		}
+		add(partConfig, "flags", *partConfig.Flags, *partActual.Flags, ok)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+)
+
+// How much of the start and end of a partition is zeroed when wiping, covering the superblocks of every
+// filesystem reparted knows of and the AVB footer.
+const wipeHeaderSize = 4 * 1024 * 1024
+
+// WipeData destroys the contents of a partition marked with "wipe", once it has been recreated at its new size.
+// The whole partition is trimmed unless discard is off, and the start and end are zeroed too so no old filesystem
+// is ever detected again on disks that don't return zeroes after a discard. If the partition has a filesystem
+// configured with "fs", a new one is then formatted, unless an image will be flashed over it.
+func (part *Partition) WipeData() error {
+	if !part.Wipe {
+		return nil
+	}
+	if err := part.Unmount(); err != nil {
+		return fmt.Errorf("wipe: %v", err)
+	}
+
+	partActual := part.Parted.GetPartition(false, part)
+	if partActual == nil {
+		return fmt.Errorf("wipe: Actual partition %s not found", part.GetName())
+	}
+	start := *partActual.Start
+	size := partActual.GetSize()
+
+	if part.Parted.DiscardMode() != discardOff && part.Parted.DiscardGranularity() > 0 {
+		if err := part.Parted.Trim(start, size); err != nil {
+			return fmt.Errorf("wipe: Failed to discard %s: %v", part.GetName(), err)
+		}
+	}
+	headerSize := int64(wipeHeaderSize)
+	if headerSize*2 > size {
+		headerSize = size / 2
+	}
+	if err := part.Parted.ZeroDisk(start, headerSize); err != nil {
+		return fmt.Errorf("wipe: Failed to zero start of %s: %v", part.GetName(), err)
+	}
+	if err := part.Parted.ZeroDisk(start+size-headerSize, headerSize); err != nil {
+		return fmt.Errorf("wipe: Failed to zero end of %s: %v", part.GetName(), err)
+	}
+	if err := part.Parted.WriteFile.Sync(); err != nil {
+		return fmt.Errorf("wipe: Failed to sync disk after wiping %s: %v", part.GetName(), err)
+	}
+	partActual.superblock = nil
+
+	if part.FS == nil || *part.FS == "" || part.Image != "" {
+		return nil
+	}
+	fs := GetFilesystemByName(*part.FS)
+	if fs == nil {
+		return fmt.Errorf("wipe: Unknown filesystem %s configured for %s", *part.FS, part.GetName())
+	}
+	log("Formatting %s as %s", part.GetName(), fs.Name())
+	if err := fs.Format(partActual); err != nil {
+		return fmt.Errorf("wipe: Failed to format %s as %s: %v", part.GetName(), fs.Name(), err)
+	}
+	*partActual.FS = fs.Name()
+	return nil
+}
@@ -0,0 +1,15 @@
+@echo off
+cls
+
+echo [*] Building reparted
+pushd cmd & go env -w GOOS=linux GOARCH=arm64 GO111MODULE=off & go build -o ..\bin\reparted .\ & popd
+
+echo [*] Staging flashable zip (warning: wipes .\zip)
+rmdir /s /q zip & mkdir zip\META-INF\com\google\android
+
+echo [*] Copying reparted as update-binary and adding dependencies
+xcopy /y /q bin zip\ & move /y zip\reparted zip\META-INF\com\google\android\update-binary & copy /y reparted.json zip\
+echo # reparted runs as update-binary, this file is only here for recoveries that require it> zip\META-INF\com\google\android\updater-script
+
+echo [*] Creating reparted.zip
+powershell -NoProfile -Command "Compress-Archive -Path zip\* -DestinationPath reparted.zip -Force"
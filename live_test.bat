@@ -19,5 +19,5 @@ adb shell su -c mv /data/local/tmp/reparted/ /mnt/ramdisk/reparted/
 echo [*] Marking reparted and dependencies as executable
 adb shell su -c chmod +x /mnt/ramdisk/reparted/*
 
-echo [*] Starting reparted
-adb shell su -c /mnt/ramdisk/reparted/reparted
\ No newline at end of file
+echo [*] Starting reparted (on a terminal, so it can ask for confirmation)
+adb shell -t su -c /mnt/ramdisk/reparted/reparted
\ No newline at end of file
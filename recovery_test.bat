@@ -16,5 +16,5 @@ adb push bin /mnt/ramdisk/reparted/ & adb push reparted.json /mnt/ramdisk/repart
 echo [*] Marking reparted and dependencies as executable
 adb shell chmod +x /mnt/ramdisk/reparted/*
 
-echo [*] Starting reparted
-adb shell /mnt/ramdisk/reparted/reparted
\ No newline at end of file
+echo [*] Starting reparted (on a terminal, so it can ask for confirmation)
+adb shell -t /mnt/ramdisk/reparted/reparted
\ No newline at end of file